@@ -0,0 +1,505 @@
+package main
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"manta/internal/agentrpc"
+)
+
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// serveArchiveImport extracts the tar stream carried by the "file_data" frames
+// that follow an "archive_import" request. The returned error is a
+// connection-level write failure.
+func serveArchiveImport(fw *frameWriter, req agentrpc.Request, op *inflight) error {
+	if req.Archive == nil {
+		return fw.write(agentrpc.Response{OK: false, Error: "missing archive payload"})
+	}
+	res, err := importArchive(*req.Archive, op)
+	if err != nil {
+		if errors.Is(err, errTransferCancelled) {
+			return nil
+		}
+		return fw.write(errorResponse(err))
+	}
+	return fw.write(agentrpc.Response{OK: true, Archive: &res})
+}
+
+func importArchive(req agentrpc.ArchiveRequest, op *inflight) (agentrpc.ArchiveResponse, error) {
+	root, err := cleanGuestPath(req.Path)
+	if err != nil {
+		return agentrpc.ArchiveResponse{}, err
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return agentrpc.ArchiveResponse{}, err
+	}
+
+	in := bufio.NewReaderSize(&inputReader{op: op}, agentrpc.FileChunkBytes)
+	compression := req.Compression
+	if compression == "" {
+		// Peek errors (e.g. an empty stream) surface from the tar reader.
+		head, _ := in.Peek(len(zstdMagic))
+		switch {
+		case bytes.HasPrefix(head, gzipMagic):
+			compression = "gzip"
+		case bytes.HasPrefix(head, zstdMagic):
+			compression = "zstd"
+		}
+	}
+
+	var r io.Reader = in
+	switch compression {
+	case "", "none":
+	case "gzip":
+		zr, err := gzip.NewReader(in)
+		if err != nil {
+			return agentrpc.ArchiveResponse{}, fmt.Errorf("gzip: %w", err)
+		}
+		defer zr.Close()
+		r = zr
+	case "zstd":
+		zr, err := zstdDecompress(in)
+		if err != nil {
+			return agentrpc.ArchiveResponse{}, err
+		}
+		defer zr.Close()
+		r = zr
+	default:
+		return agentrpc.ArchiveResponse{}, fmt.Errorf("unsupported compression %q", compression)
+	}
+	return extractTar(tar.NewReader(r), root, op)
+}
+
+// extractTar unpacks tr under root. Entry names are resolved as if root were
+// "/", and nothing is ever created through a symlink, so neither "../" names
+// nor links planted by earlier entries can write outside root. Regular files,
+// directories, symlinks and hard links are extracted with their mode,
+// ownership and mtime; other entry types are skipped.
+func extractTar(tr *tar.Reader, root string, op *inflight) (agentrpc.ArchiveResponse, error) {
+	var res agentrpc.ArchiveResponse
+	for {
+		if op.cancelled() {
+			return res, errTransferCancelled
+		}
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return res, fmt.Errorf("read archive: %w", err)
+		}
+
+		target, err := confinedPath(root, hdr.Name)
+		if err != nil {
+			return res, err
+		}
+		if target == root {
+			// "./" entries describe root itself, which already exists.
+			continue
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := replaceWithDir(target); err != nil {
+				return res, err
+			}
+		case tar.TypeReg:
+			if err := clearForFile(target); err != nil {
+				return res, err
+			}
+			f, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+			if err != nil {
+				return res, err
+			}
+			n, err := io.Copy(f, tr)
+			res.Bytes += n
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				return res, fmt.Errorf("write %s: %w", target, err)
+			}
+		case tar.TypeSymlink:
+			if err := clearForFile(target); err != nil {
+				return res, err
+			}
+			if err := os.Symlink(hdr.Linkname, target); err != nil {
+				return res, err
+			}
+		case tar.TypeLink:
+			src, err := confinedPath(root, hdr.Linkname)
+			if err != nil {
+				return res, err
+			}
+			// A hard link to a symlink would let the chmod below reach
+			// whatever the symlink points at, inside root or not.
+			if st, err := os.Lstat(src); err != nil {
+				return res, err
+			} else if st.Mode()&fs.ModeSymlink != 0 {
+				return res, fmt.Errorf("refusing to extract %q: hard link to symlink %q", hdr.Name, hdr.Linkname)
+			}
+			if err := clearForFile(target); err != nil {
+				return res, err
+			}
+			if err := os.Link(src, target); err != nil {
+				return res, err
+			}
+		default:
+			log.Printf("archive: skipping %q (type %q)", hdr.Name, hdr.Typeflag)
+			res.Skipped++
+			continue
+		}
+
+		if err := os.Lchown(target, hdr.Uid, hdr.Gid); err != nil {
+			return res, err
+		}
+		if hdr.Typeflag != tar.TypeSymlink {
+			// After chown, which clears setuid/setgid.
+			if err := setModeAndTime(target, uint32(hdr.Mode), hdr.ModTime); err != nil {
+				return res, err
+			}
+		}
+		res.Entries++
+	}
+}
+
+// setModeAndTime applies an entry's permission bits and mtime to target
+// without following a symlink there. Kernels before 6.6 (no fchmodat2) can't
+// chmod with AT_SYMLINK_NOFOLLOW; plain fchmodat is safe then because target
+// is never a symlink: symlink entries are skipped and hard links to symlinks
+// refused.
+func setModeAndTime(target string, bits uint32, mtime time.Time) error {
+	err := unix.Fchmodat(unix.AT_FDCWD, target, bits&0o7777, unix.AT_SYMLINK_NOFOLLOW)
+	if errors.Is(err, unix.EOPNOTSUPP) {
+		err = unix.Fchmodat(unix.AT_FDCWD, target, bits&0o7777, 0)
+	}
+	if err != nil {
+		return &fs.PathError{Op: "chmod", Path: target, Err: err}
+	}
+	ts := []unix.Timespec{{Nsec: unix.UTIME_OMIT}, unix.NsecToTimespec(mtime.UnixNano())}
+	if err := unix.UtimesNanoAt(unix.AT_FDCWD, target, ts, unix.AT_SYMLINK_NOFOLLOW); err != nil {
+		return &fs.PathError{Op: "chtimes", Path: target, Err: err}
+	}
+	return nil
+}
+
+// confinedPath maps an archive name to a path under root and verifies that
+// every existing directory between root and it is a real directory, not a
+// symlink. Missing parents are created.
+func confinedPath(root, name string) (string, error) {
+	rel := strings.TrimPrefix(path.Clean("/"+name), "/")
+	if rel == "" {
+		return root, nil
+	}
+	target := filepath.Join(root, filepath.FromSlash(rel))
+
+	dir := root
+	parts := strings.Split(rel, "/")
+	for _, part := range parts[:len(parts)-1] {
+		dir = filepath.Join(dir, part)
+		st, err := os.Lstat(dir)
+		if errors.Is(err, fs.ErrNotExist) {
+			if err := os.Mkdir(dir, 0o755); err != nil {
+				return "", err
+			}
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if st.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("refusing to extract %q through symlink %s", name, dir)
+		}
+		if !st.IsDir() {
+			return "", fmt.Errorf("cannot extract %q: %s is not a directory", name, dir)
+		}
+	}
+	return target, nil
+}
+
+// clearForFile removes whatever non-directory entry is at target so it can be
+// recreated without following an existing symlink.
+func clearForFile(target string) error {
+	st, err := os.Lstat(target)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if st.IsDir() {
+		return fmt.Errorf("cannot replace directory %s with a file", target)
+	}
+	return os.Remove(target)
+}
+
+func replaceWithDir(target string) error {
+	st, err := os.Lstat(target)
+	if err == nil && st.IsDir() {
+		return nil
+	}
+	if err == nil {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.Mkdir(target, 0o755)
+}
+
+// serveArchiveExport streams a tar of the request path to the host: a frame
+// with the path's FileInfo, then Chunk frames, the last marked EOF. A
+// directory is archived by its contents (like tar -C dir .); a file as a
+// single entry under its base name. The returned error is a
+// connection-level write failure.
+func serveArchiveExport(fw *frameWriter, req agentrpc.Request, op *inflight) error {
+	if req.Archive == nil {
+		return fw.write(agentrpc.Response{OK: false, Error: "missing archive payload"})
+	}
+	root, err := cleanGuestPath(req.Archive.Path)
+	if err != nil {
+		return fw.write(errorResponse(err))
+	}
+	st, err := os.Stat(root)
+	if err != nil {
+		return fw.write(errorResponse(err))
+	}
+	switch req.Archive.Compression {
+	case "", "none", "gzip", "zstd":
+	default:
+		return fw.write(agentrpc.Response{OK: false, Error: fmt.Sprintf("unsupported compression %q", req.Archive.Compression)})
+	}
+	info := fileInfo(root, st)
+	if err := fw.write(agentrpc.Response{OK: true, More: true, File: &info}); err != nil {
+		return err
+	}
+
+	cw := &chunkWriter{fw: fw}
+	bw := bufio.NewWriterSize(cw, agentrpc.FileChunkBytes)
+	err = exportArchive(bw, root, st, req.Archive.Compression, op)
+	if err == nil {
+		err = bw.Flush()
+	}
+	switch {
+	case cw.err != nil:
+		return cw.err
+	case errors.Is(err, errTransferCancelled):
+		return nil
+	case err != nil:
+		return fw.write(errorResponse(err))
+	}
+	return fw.write(agentrpc.Response{OK: true, Chunk: &agentrpc.DataChunk{EOF: true}})
+}
+
+func exportArchive(w io.Writer, root string, st fs.FileInfo, compression string, op *inflight) error {
+	var out io.WriteCloser
+	switch compression {
+	case "gzip":
+		out = gzip.NewWriter(w)
+	case "zstd":
+		zw, err := zstdCompress(w)
+		if err != nil {
+			return err
+		}
+		out = zw
+	default:
+		out = nopWriteCloser{w}
+	}
+
+	tw := tar.NewWriter(out)
+	var err error
+	if st.IsDir() {
+		err = filepath.WalkDir(root, func(p string, d fs.DirEntry, werr error) error {
+			if werr != nil {
+				return werr
+			}
+			if op.cancelled() {
+				return errTransferCancelled
+			}
+			if p == root {
+				return nil
+			}
+			rel, err := filepath.Rel(root, p)
+			if err != nil {
+				return err
+			}
+			return addTarEntry(tw, p, filepath.ToSlash(rel))
+		})
+	} else {
+		err = addTarEntry(tw, root, filepath.Base(root))
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func addTarEntry(tw *tar.Writer, p, name string) error {
+	st, err := os.Lstat(p)
+	if err != nil {
+		return err
+	}
+	var link string
+	if st.Mode()&fs.ModeSymlink != 0 {
+		if link, err = os.Readlink(p); err != nil {
+			return err
+		}
+	}
+	hdr, err := tar.FileInfoHeader(st, link)
+	if err != nil {
+		// Sockets and the like have no tar representation.
+		log.Printf("archive: skipping %s: %v", p, err)
+		return nil
+	}
+	hdr.Name = name
+	if st.IsDir() {
+		hdr.Name += "/"
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	if !st.Mode().IsRegular() {
+		return nil
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	// Copy exactly the header size in case the file changes underneath.
+	_, err = io.CopyN(tw, f, hdr.Size)
+	return err
+}
+
+// chunkWriter sends everything written to it as Chunk frames. It remembers
+// the first frame write failure so callers can tell it apart from archive
+// errors.
+type chunkWriter struct {
+	fw  *frameWriter
+	err error
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	if cw.err != nil {
+		return 0, cw.err
+	}
+	for off := 0; off < len(p); off += agentrpc.FileChunkBytes {
+		end := min(off+agentrpc.FileChunkBytes, len(p))
+		if err := cw.fw.write(agentrpc.Response{OK: true, More: true, Chunk: &agentrpc.DataChunk{Data: p[off:end]}}); err != nil {
+			cw.err = err
+			return off, err
+		}
+	}
+	return len(p), nil
+}
+
+type nopWriteCloser struct{ io.Writer }
+
+func (nopWriteCloser) Close() error { return nil }
+
+// zstd support shells out to the guest's zstd binary; the standard library
+// has no codec.
+
+// zstdWaitDelay bounds how long a finished zstd process may hold its pipes.
+const zstdWaitDelay = 5 * time.Second
+
+type zstdReader struct {
+	out      io.Reader
+	cmd      *exec.Cmd
+	waitOnce sync.Once
+	waitErr  error
+}
+
+func zstdDecompress(r io.Reader) (*zstdReader, error) {
+	cmd := exec.Command("zstd", "-d", "-c", "-q")
+	cmd.Stdin = r
+	cmd.Stderr = os.Stderr
+	cmd.WaitDelay = zstdWaitDelay
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("zstd: %w", err)
+	}
+	return &zstdReader{out: out, cmd: cmd}, nil
+}
+
+// Read reports a failed decompression at the end of the output rather than
+// as a truncated stream.
+func (zr *zstdReader) Read(p []byte) (int, error) {
+	n, err := zr.out.Read(p)
+	if err == io.EOF {
+		if werr := zr.wait(); werr != nil {
+			return n, fmt.Errorf("zstd: %w", werr)
+		}
+	}
+	return n, err
+}
+
+func (zr *zstdReader) wait() error {
+	zr.waitOnce.Do(func() { zr.waitErr = zr.cmd.Wait() })
+	return zr.waitErr
+}
+
+// Close stops zstd if the tar ended before the compressed stream did.
+func (zr *zstdReader) Close() error {
+	_ = zr.cmd.Process.Kill()
+	_ = zr.wait()
+	return nil
+}
+
+type zstdWriter struct {
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+func zstdCompress(w io.Writer) (*zstdWriter, error) {
+	cmd := exec.Command("zstd", "-c", "-q")
+	cmd.Stdout = w
+	cmd.Stderr = os.Stderr
+	cmd.WaitDelay = zstdWaitDelay
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("zstd: %w", err)
+	}
+	return &zstdWriter{WriteCloser: in, cmd: cmd}, nil
+}
+
+// Close ends the input and waits for zstd to flush its output.
+func (zw *zstdWriter) Close() error {
+	if err := zw.WriteCloser.Close(); err != nil {
+		return err
+	}
+	if err := zw.cmd.Wait(); err != nil {
+		return fmt.Errorf("zstd: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+
+	"manta/internal/agentrpc"
+)
+
+// inputBuffer is how many follow-up frames may queue for one request before
+// the connection reader waits for its consumer.
+const inputBuffer = 16
+
+func serveConn(c net.Conn) {
+	defer c.Close()
+
+	fw := &frameWriter{mu: &sync.Mutex{}, w: c}
+	br := bufio.NewReader(c)
+	reqs := &inflightTable{byID: make(map[uint64]*inflight)}
+	// When the host goes away, stop everything still running on its behalf.
+	defer reqs.cancelAll()
+
+	for {
+		var req agentrpc.Request
+		if err := agentrpc.ReadMessage(br, &req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return
+			}
+			// Connection-level protocol error; close.
+			log.Printf("read request: %v", err)
+			return
+		}
+
+		switch req.Type {
+		case "stdin", "pty_input", "file_data", "cancel":
+			op := reqs.get(req.ID)
+			if op == nil {
+				// Data for an upload that already failed (or finished early,
+				// like a tar with trailing padding) is expected until the host
+				// sees the answer.
+				if req.Type != "file_data" {
+					log.Printf("ignoring %q frame for unknown request %d", req.Type, req.ID)
+				}
+				continue
+			}
+			if req.Type == "cancel" {
+				op.stop()
+			} else {
+				op.deliver(req)
+			}
+			continue
+		}
+
+		rw := fw.forRequest(req.ID)
+		op, err := reqs.start(req.ID)
+		if err != nil {
+			if werr := rw.write(agentrpc.Response{OK: false, Error: err.Error()}); werr != nil {
+				log.Printf("write response: %v", werr)
+				return
+			}
+			continue
+		}
+		// Every request runs in its own goroutine so a long exec or stream
+		// doesn't hold up others on the same connection.
+		go func() {
+			defer reqs.finish(req.ID, op)
+			var err error
+			switch req.Type {
+			case "exec_stream":
+				err = serveExecStream(rw, req, op)
+			case "pty":
+				err = servePTY(rw, req, op)
+			case "file_write":
+				err = serveFileWrite(rw, req, op)
+			case "file_read":
+				err = serveFileRead(rw, req, op)
+			case "archive_import":
+				err = serveArchiveImport(rw, req, op)
+			case "archive_export":
+				err = serveArchiveExport(rw, req, op)
+			case "watch":
+				err = serveWatch(rw, req, op)
+			default:
+				err = rw.write(handle(req, op.cancel))
+			}
+			if err != nil {
+				log.Printf("write %s response: %v", req.Type, err)
+				_ = c.Close()
+			}
+		}()
+	}
+}
+
+// frameWriter serializes frame writes from concurrent producers (requests
+// multiplexed on the connection, and e.g. the stdout and stderr pumps of a
+// single streaming exec). Each frameWriter stamps its request's ID on the
+// frames it writes.
+type frameWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+	id uint64
+}
+
+func (fw *frameWriter) forRequest(id uint64) *frameWriter {
+	return &frameWriter{mu: fw.mu, w: fw.w, id: id}
+}
+
+func (fw *frameWriter) write(resp agentrpc.Response) error {
+	resp.ID = fw.id
+	fw.mu.Lock()
+	defer fw.mu.Unlock()
+	return agentrpc.WriteMessage(fw.w, resp)
+}
+
+// inflight is a request that is still being served. Follow-up frames carrying
+// its ID are queued on input; a "cancel" frame or the host hanging up closes
+// cancel.
+type inflight struct {
+	input    chan agentrpc.Request
+	cancel   chan struct{}
+	stopOnce sync.Once
+	done     chan struct{}
+}
+
+func (op *inflight) stop() {
+	op.stopOnce.Do(func() { close(op.cancel) })
+}
+
+func (op *inflight) cancelled() bool {
+	select {
+	case <-op.cancel:
+		return true
+	default:
+		return false
+	}
+}
+
+// deliver queues a follow-up frame, dropping it if the request has finished.
+func (op *inflight) deliver(req agentrpc.Request) {
+	select {
+	case op.input <- req:
+	case <-op.done:
+	}
+}
+
+// next returns the next follow-up frame, or false once the request has been
+// cancelled or has finished.
+func (op *inflight) next() (agentrpc.Request, bool) {
+	select {
+	case in := <-op.input:
+		return in, true
+	case <-op.cancel:
+		return agentrpc.Request{}, false
+	case <-op.done:
+		return agentrpc.Request{}, false
+	}
+}
+
+type inflightTable struct {
+	mu   sync.Mutex
+	byID map[uint64]*inflight
+}
+
+func (t *inflightTable) start(id uint64) (*inflight, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.byID[id]; ok {
+		return nil, fmt.Errorf("request id %d is already in flight", id)
+	}
+	op := &inflight{
+		input:  make(chan agentrpc.Request, inputBuffer),
+		cancel: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	t.byID[id] = op
+	return op, nil
+}
+
+func (t *inflightTable) get(id uint64) *inflight {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.byID[id]
+}
+
+func (t *inflightTable) finish(id uint64, op *inflight) {
+	t.mu.Lock()
+	if t.byID[id] == op {
+		delete(t.byID, id)
+	}
+	t.mu.Unlock()
+	close(op.done)
+}
+
+func (t *inflightTable) cancelAll() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, op := range t.byID {
+		op.stop()
+	}
+}
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+
+	"manta/internal/agentrpc"
+)
+
+const defaultFileMode = 0o644
+
+var errTransferCancelled = errors.New("transfer cancelled")
+
+// serveFileWrite stores the content of the "file_data" frames that follow a
+// "file_write" request. Data goes straight to disk chunk by chunk, so file
+// size is not bounded by memory. The returned error is a connection-level
+// write failure.
+func serveFileWrite(fw *frameWriter, req agentrpc.Request, op *inflight) error {
+	if req.File == nil {
+		return fw.write(agentrpc.Response{OK: false, Error: "missing file payload"})
+	}
+	info, err := writeFile(*req.File, op)
+	if err != nil {
+		if errors.Is(err, errTransferCancelled) {
+			// The host is gone or no longer waiting for an answer.
+			return nil
+		}
+		return fw.write(errorResponse(err))
+	}
+	return fw.write(agentrpc.Response{OK: true, File: info})
+}
+
+func writeFile(req agentrpc.FileRequest, op *inflight) (*agentrpc.FileInfo, error) {
+	path, err := cleanGuestPath(req.Path)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Dir(path)
+	if req.Parents {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	mode := fs.FileMode(defaultFileMode)
+	if req.Mode != nil {
+		mode = fileModeFromBits(*req.Mode)
+	} else if st, err := os.Stat(path); err == nil {
+		mode = st.Mode() & (fs.ModePerm | fs.ModeSetuid | fs.ModeSetgid | fs.ModeSticky)
+	}
+
+	var f *os.File
+	if req.Atomic {
+		f, err = os.CreateTemp(dir, "."+filepath.Base(path)+".manta-*")
+	} else {
+		f, err = os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode.Perm())
+	}
+	if err != nil {
+		return nil, err
+	}
+	tmpPath := f.Name()
+	fail := func(err error) (*agentrpc.FileInfo, error) {
+		_ = f.Close()
+		if req.Atomic {
+			_ = os.Remove(tmpPath)
+		}
+		return nil, err
+	}
+
+	if _, err := io.Copy(f, &inputReader{op: op}); err != nil {
+		return fail(err)
+	}
+
+	// Chmod explicitly so the umask doesn't apply and special bits stick.
+	if err := f.Chmod(mode); err != nil {
+		return fail(err)
+	}
+	if req.Atomic {
+		// Make the content durable before it becomes visible under path.
+		if err := f.Sync(); err != nil {
+			return fail(err)
+		}
+	}
+	if err := f.Close(); err != nil {
+		if req.Atomic {
+			_ = os.Remove(tmpPath)
+		}
+		return nil, err
+	}
+	if req.Atomic {
+		if err := os.Rename(tmpPath, path); err != nil {
+			_ = os.Remove(tmpPath)
+			return nil, err
+		}
+	}
+	return statFile(path)
+}
+
+// serveFileRead streams a guest file to the host: a frame with its FileInfo,
+// then its content in FileChunkBytes pieces, the last marked EOF.
+func serveFileRead(fw *frameWriter, req agentrpc.Request, op *inflight) error {
+	if req.File == nil {
+		return fw.write(agentrpc.Response{OK: false, Error: "missing file payload"})
+	}
+	path, err := cleanGuestPath(req.File.Path)
+	if err != nil {
+		return fw.write(errorResponse(err))
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return fw.write(errorResponse(err))
+	}
+	defer f.Close()
+	st, err := f.Stat()
+	if err != nil {
+		return fw.write(errorResponse(err))
+	}
+	if !st.Mode().IsRegular() {
+		return fw.write(agentrpc.Response{OK: false, Error: fmt.Sprintf("%s is not a regular file", path)})
+	}
+	info := fileInfo(path, st)
+	if err := fw.write(agentrpc.Response{OK: true, More: true, File: &info}); err != nil {
+		return err
+	}
+
+	buf := make([]byte, agentrpc.FileChunkBytes)
+	for {
+		if op.cancelled() {
+			return nil
+		}
+		n, rerr := f.Read(buf)
+		if n > 0 {
+			if err := fw.write(agentrpc.Response{OK: true, More: true, Chunk: &agentrpc.DataChunk{Data: buf[:n]}}); err != nil {
+				return err
+			}
+		}
+		if rerr == io.EOF {
+			return fw.write(agentrpc.Response{OK: true, Chunk: &agentrpc.DataChunk{EOF: true}})
+		}
+		if rerr != nil {
+			return fw.write(errorResponse(rerr))
+		}
+	}
+}
+
+// inputReader reads the data of the "file_data" frames that follow a request,
+// up to the frame marked EOF. It fails with errTransferCancelled if the
+// request is cancelled first.
+type inputReader struct {
+	op  *inflight
+	buf []byte
+	eof bool
+}
+
+func (r *inputReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		if r.eof {
+			return 0, io.EOF
+		}
+		in, ok := r.op.next()
+		if !ok {
+			return 0, errTransferCancelled
+		}
+		if in.Type != "file_data" || in.Chunk == nil {
+			log.Printf("ignoring %q frame during upload", in.Type)
+			continue
+		}
+		r.buf, r.eof = in.Chunk.Data, in.Chunk.EOF
+	}
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
+
+// cleanGuestPath requires an absolute path and normalizes it.
+func cleanGuestPath(path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		return "", fmt.Errorf("path must be absolute: %q", path)
+	}
+	return filepath.Clean(path), nil
+}
+
+func statFile(path string) (*agentrpc.FileInfo, error) {
+	st, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	info := fileInfo(path, st)
+	return &info, nil
+}
+
+func fileInfo(path string, st fs.FileInfo) agentrpc.FileInfo {
+	info := agentrpc.FileInfo{
+		Path:          path,
+		Name:          filepath.Base(path),
+		Type:          fileType(st.Mode()),
+		Size:          st.Size(),
+		Mode:          fileModeBits(st.Mode()),
+		ModTimeUnixMs: st.ModTime().UnixMilli(),
+	}
+	if info.Type == agentrpc.FileTypeSymlink {
+		// Best effort: the link may have been replaced since it was stat'ed.
+		info.LinkTarget, _ = os.Readlink(path)
+	}
+	return info
+}
+
+func fileType(m fs.FileMode) string {
+	switch {
+	case m.IsRegular():
+		return agentrpc.FileTypeFile
+	case m.IsDir():
+		return agentrpc.FileTypeDir
+	case m&fs.ModeSymlink != 0:
+		return agentrpc.FileTypeSymlink
+	case m&fs.ModeNamedPipe != 0:
+		return agentrpc.FileTypeFIFO
+	case m&fs.ModeSocket != 0:
+		return agentrpc.FileTypeSocket
+	case m&fs.ModeDevice != 0:
+		return agentrpc.FileTypeDevice
+	default:
+		return agentrpc.FileTypeOther
+	}
+}
+
+// fileModeBits converts Go's mode representation to Unix permission bits.
+func fileModeBits(m fs.FileMode) uint32 {
+	bits := uint32(m.Perm())
+	if m&fs.ModeSetuid != 0 {
+		bits |= 0o4000
+	}
+	if m&fs.ModeSetgid != 0 {
+		bits |= 0o2000
+	}
+	if m&fs.ModeSticky != 0 {
+		bits |= 0o1000
+	}
+	return bits
+}
+
+func fileModeFromBits(bits uint32) fs.FileMode {
+	m := fs.FileMode(bits) & fs.ModePerm
+	if bits&0o4000 != 0 {
+		m |= fs.ModeSetuid
+	}
+	if bits&0o2000 != 0 {
+		m |= fs.ModeSetgid
+	}
+	if bits&0o1000 != 0 {
+		m |= fs.ModeSticky
+	}
+	return m
+}
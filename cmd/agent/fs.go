@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+
+	"manta/internal/agentrpc"
+)
+
+// maxListEntries caps an fs_list answer well below agentrpc.MaxMessageBytes.
+const maxListEntries = 10000
+
+func handleFS(req agentrpc.Request) agentrpc.Response {
+	if req.FS == nil {
+		return agentrpc.Response{OK: false, Error: "missing fs payload"}
+	}
+	path, err := cleanGuestPath(req.FS.Path)
+	if err != nil {
+		return agentrpc.Response{OK: false, Error: err.Error()}
+	}
+
+	switch req.Type {
+	case "fs_list":
+		res, err := listDir(path, req.FS.Limit)
+		if err != nil {
+			return errorResponse(err)
+		}
+		return agentrpc.Response{OK: true, FS: res}
+	case "fs_stat":
+		st, err := os.Lstat(path)
+		if err != nil {
+			return errorResponse(err)
+		}
+		info := fileInfo(path, st)
+		return agentrpc.Response{OK: true, File: &info}
+	case "fs_mkdir":
+		return fileInfoResponse(path, makeDir(path, *req.FS))
+	case "fs_remove":
+		if err := removePath(path, req.FS.Recursive); err != nil {
+			return errorResponse(err)
+		}
+		return agentrpc.Response{OK: true}
+	case "fs_rename":
+		newPath, err := cleanGuestPath(req.FS.NewPath)
+		if err != nil {
+			return agentrpc.Response{OK: false, Error: fmt.Sprintf("new_path: %v", err)}
+		}
+		return fileInfoResponse(newPath, renamePath(path, newPath, req.FS.Overwrite))
+	default:
+		return agentrpc.Response{OK: false, Error: fmt.Sprintf("unknown request type %q", req.Type)}
+	}
+}
+
+// fileInfoResponse answers with path's FileInfo if err (the outcome of the
+// operation that produced path) is nil.
+func fileInfoResponse(path string, err error) agentrpc.Response {
+	if err != nil {
+		return errorResponse(err)
+	}
+	st, err := os.Lstat(path)
+	if err != nil {
+		return errorResponse(err)
+	}
+	info := fileInfo(path, st)
+	return agentrpc.Response{OK: true, File: &info}
+}
+
+func listDir(path string, limit int) (*agentrpc.FSResponse, error) {
+	if limit <= 0 || limit > maxListEntries {
+		limit = maxListEntries
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	res := &agentrpc.FSResponse{Entries: []agentrpc.FileInfo{}}
+	for _, e := range entries {
+		if len(res.Entries) == limit {
+			res.Truncated = true
+			break
+		}
+		st, err := e.Info()
+		if errors.Is(err, fs.ErrNotExist) {
+			// Removed since the directory was read.
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res.Entries = append(res.Entries, fileInfo(filepath.Join(path, e.Name()), st))
+	}
+	return res, nil
+}
+
+func makeDir(path string, req agentrpc.FSRequest) error {
+	mode := fs.FileMode(0o755)
+	if req.Mode != nil {
+		mode = fileModeFromBits(*req.Mode)
+	}
+	if req.Parents {
+		if err := os.MkdirAll(path, mode.Perm()); err != nil {
+			return err
+		}
+	} else if err := os.Mkdir(path, mode.Perm()); err != nil {
+		return err
+	}
+	if req.Mode == nil {
+		return nil
+	}
+	// Chmod explicitly so the umask doesn't apply and special bits stick.
+	return os.Chmod(path, mode)
+}
+
+func removePath(path string, recursive bool) error {
+	if path == "/" {
+		return fmt.Errorf("refusing to remove /")
+	}
+	if !recursive {
+		return os.Remove(path)
+	}
+	// RemoveAll succeeds on a missing path; report it like os.Remove does.
+	if _, err := os.Lstat(path); err != nil {
+		return err
+	}
+	return os.RemoveAll(path)
+}
+
+func renamePath(oldPath, newPath string, overwrite bool) error {
+	if oldPath == "/" {
+		return fmt.Errorf("refusing to rename /")
+	}
+	if overwrite {
+		return os.Rename(oldPath, newPath)
+	}
+	// RENAME_NOREPLACE makes the existence check and the move one step.
+	if err := unix.Renameat2(unix.AT_FDCWD, oldPath, unix.AT_FDCWD, newPath, unix.RENAME_NOREPLACE); err != nil {
+		return &os.LinkError{Op: "rename", Old: oldPath, New: newPath, Err: err}
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// processIdentity is the resolved account a command runs as.
+type processIdentity struct {
+	cred *syscall.Credential
+	home string
+	name string
+}
+
+// resolveIdentity maps a requested user name and/or numeric ids onto process
+// credentials. It returns nil when nothing was requested, meaning "run as the
+// agent". A named (or numerically known) account supplies the primary gid,
+// supplementary groups and home directory; an explicit gid overrides the
+// primary group. A uid with no passwd entry runs with gid == uid unless gid is
+// given.
+func resolveIdentity(name string, uid, gid *uint32) (*processIdentity, error) {
+	name = strings.TrimSpace(name)
+	if name == "" && uid == nil && gid == nil {
+		return nil, nil
+	}
+
+	id := &processIdentity{cred: &syscall.Credential{Uid: uint32(os.Getuid()), Gid: uint32(os.Getgid())}}
+
+	var u *user.User
+	var err error
+	switch {
+	case name != "":
+		u, err = user.Lookup(name)
+		if err != nil {
+			return nil, fmt.Errorf("lookup user %q: %w", name, err)
+		}
+	case uid != nil:
+		// Unknown numeric ids are allowed; they just get no home or groups.
+		u, _ = user.LookupId(strconv.FormatUint(uint64(*uid), 10))
+		id.cred.Uid = *uid
+		id.cred.Gid = *uid
+	}
+
+	if u != nil {
+		parsedUID, err := strconv.ParseUint(u.Uid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("user %q has invalid uid %q", u.Username, u.Uid)
+		}
+		parsedGID, err := strconv.ParseUint(u.Gid, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("user %q has invalid gid %q", u.Username, u.Gid)
+		}
+		id.cred.Uid = uint32(parsedUID)
+		id.cred.Gid = uint32(parsedGID)
+		id.home = u.HomeDir
+		id.name = u.Username
+
+		groupIDs, err := u.GroupIds()
+		if err != nil {
+			return nil, fmt.Errorf("lookup groups for %q: %w", u.Username, err)
+		}
+		for _, g := range groupIDs {
+			v, err := strconv.ParseUint(g, 10, 32)
+			if err != nil {
+				continue
+			}
+			id.cred.Groups = append(id.cred.Groups, uint32(v))
+		}
+	}
+	if gid != nil {
+		id.cred.Gid = *gid
+	}
+	// Always call setgroups so root's supplementary groups are dropped.
+	if id.cred.Groups == nil {
+		id.cred.Groups = []uint32{}
+	}
+	return id, nil
+}
+
+// apply sets the credentials, default working directory and login-style
+// environment of the identity on cmd. cmd.SysProcAttr must already be set, and
+// request-supplied cwd/env should be applied afterwards so they take
+// precedence. A nil identity leaves cmd unchanged.
+func (id *processIdentity) apply(cmd *exec.Cmd) {
+	if id == nil {
+		return
+	}
+	cmd.SysProcAttr.Credential = id.cred
+	cmd.Dir = id.dir()
+	cmd.Env = append(cmd.Env, id.env()...)
+}
+
+func (id *processIdentity) env() []string {
+	var env []string
+	if id.home != "" {
+		env = append(env, "HOME="+id.home)
+	}
+	if id.name != "" {
+		env = append(env, "USER="+id.name, "LOGNAME="+id.name)
+	}
+	return env
+}
+
+func (id *processIdentity) dir() string {
+	if id.home == "" {
+		return ""
+	}
+	if st, err := os.Stat(id.home); err != nil || !st.IsDir() {
+		return ""
+	}
+	return id.home
+}
@@ -1,16 +1,17 @@
 package main
 
 import (
-	"bufio"
 	"bytes"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
 	"log"
 	"net"
 	"os"
 	"os/exec"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -20,7 +21,10 @@ import (
 	"manta/internal/agentrpc"
 )
 
-const agentVersion = "v0.2.0"
+const agentVersion = "v0.5.0"
+
+// outputChunkBytes bounds the payload of a single streamed output frame.
+const outputChunkBytes = 32 << 10
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
@@ -41,30 +45,9 @@ func main() {
 	}
 }
 
-func serveConn(c net.Conn) {
-	defer c.Close()
-
-	br := bufio.NewReader(c)
-	for {
-		var req agentrpc.Request
-		if err := agentrpc.ReadMessage(br, &req); err != nil {
-			if errors.Is(err, io.EOF) {
-				return
-			}
-			// Connection-level protocol error; close.
-			log.Printf("read request: %v", err)
-			return
-		}
-
-		resp := handle(req)
-		if err := agentrpc.WriteMessage(c, resp); err != nil {
-			log.Printf("write response: %v", err)
-			return
-		}
-	}
-}
-
-func handle(req agentrpc.Request) agentrpc.Response {
+// handle answers a single-frame request. Commands it runs are killed, and
+// waits abandoned, when cancel is closed.
+func handle(req agentrpc.Request, cancel <-chan struct{}) agentrpc.Response {
 	switch req.Type {
 	case "ping":
 		return agentrpc.Response{
@@ -78,8 +61,20 @@ func handle(req agentrpc.Request) agentrpc.Response {
 		if req.Exec == nil {
 			return agentrpc.Response{OK: false, Error: "missing exec payload"}
 		}
-		out := runExec(*req.Exec)
+		out := runExec(*req.Exec, cancel)
 		return agentrpc.Response{OK: out.err == nil, Error: errString(out.err), Exec: out.resp}
+	case "signal":
+		if req.Signal == nil {
+			return agentrpc.Response{OK: false, Error: "missing signal payload"}
+		}
+		if err := execs.signal(req.Signal.ExecID, req.Signal.Signal); err != nil {
+			return errorResponse(err)
+		}
+		return agentrpc.Response{OK: true}
+	case "proc_start", "proc_list", "proc_get", "proc_logs", "proc_signal", "proc_wait":
+		return handleProc(req, cancel)
+	case "fs_list", "fs_stat", "fs_mkdir", "fs_remove", "fs_rename":
+		return handleFS(req)
 	case "net":
 		if req.Net == nil {
 			return agentrpc.Response{OK: false, Error: "missing net payload"}
@@ -98,31 +93,148 @@ type execResult struct {
 	err  error
 }
 
-func runExec(req agentrpc.ExecRequest) execResult {
-	timeout := time.Duration(req.TimeoutMs) * time.Millisecond
-	if timeout <= 0 {
-		timeout = 20 * time.Second
-	}
-
+func runExec(req agentrpc.ExecRequest, cancel <-chan struct{}) execResult {
 	maxOut := req.MaxOutputBytes
 	if maxOut <= 0 {
 		maxOut = 1 << 20 // 1 MiB per stream
 	}
 
-	argv, err := normalizeArgv(req)
-	if err != nil {
-		return execResult{resp: &agentrpc.ExecResponse{ExitCode: 2}, err: err}
+	var feed func(io.WriteCloser)
+	if len(req.Stdin) > 0 {
+		feed = writeStdin(req.Stdin)
 	}
 
-	cmd := exec.Command(argv[0], argv[1:]...)
-	if strings.TrimSpace(req.Cwd) != "" {
-		cmd.Dir = req.Cwd
+	var stdoutBuf, stderrBuf bytes.Buffer
+	out := runCommand(req, cancel, feed,
+		func(r io.Reader) { _, _ = io.Copy(&stdoutBuf, io.LimitReader(r, maxOut)) },
+		func(r io.Reader) { _, _ = io.Copy(&stderrBuf, io.LimitReader(r, maxOut)) },
+	)
+	if out.resp != nil {
+		out.resp.Stdout = stdoutBuf.String()
+		out.resp.Stderr = stderrBuf.String()
 	}
-	cmd.Env = append(os.Environ(), req.Env...)
+	return out
+}
 
-	// Put the command in its own process group so we can SIGKILL the whole tree.
-	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+// serveExecStream runs an exec request and relays its output as it is
+// produced, finishing with a frame that carries the exit status. With
+// StdinStream set, follow-up "stdin" frames for the request are written to the
+// process. The command is killed if the request is cancelled. The returned
+// error is a connection-level write failure; command failures are reported in
+// the final frame.
+func serveExecStream(fw *frameWriter, req agentrpc.Request, op *inflight) error {
+	if req.Exec == nil {
+		return fw.write(agentrpc.Response{OK: false, Error: "missing exec payload"})
+	}
+
+	var errOnce sync.Once
+	var sendErr error
+	pump := func(stream string) func(io.Reader) {
+		return func(r io.Reader) {
+			buf := make([]byte, outputChunkBytes)
+			for {
+				n, err := r.Read(buf)
+				if n > 0 {
+					werr := fw.write(agentrpc.Response{
+						OK:     true,
+						More:   true,
+						Output: &agentrpc.ExecOutput{Stream: stream, Data: buf[:n]},
+					})
+					if werr != nil {
+						errOnce.Do(func() { sendErr = werr })
+						// Nobody is left to read the output, so stop the
+						// command instead of letting it run to its timeout.
+						op.stop()
+						_, _ = io.Copy(io.Discard, r)
+						return
+					}
+				}
+				if err != nil {
+					return
+				}
+			}
+		}
+	}
+
+	var feed func(io.WriteCloser)
+	switch {
+	case req.Exec.StdinStream:
+		feed = func(w io.WriteCloser) { streamStdin(op, w, req.Exec.Stdin) }
+	case len(req.Exec.Stdin) > 0:
+		feed = writeStdin(req.Exec.Stdin)
+	}
+
+	out := runCommand(*req.Exec, op.cancel, feed, pump("stdout"), pump("stderr"))
+	if sendErr != nil {
+		return sendErr
+	}
+	return fw.write(agentrpc.Response{OK: out.err == nil, Error: errString(out.err), Exec: out.resp})
+}
+
+func writeStdin(data []byte) func(io.WriteCloser) {
+	return func(w io.WriteCloser) {
+		_, _ = w.Write(data)
+		_ = w.Close()
+	}
+}
+
+// streamStdin writes initial, then copies "stdin" frames from the host into
+// the process until EOF. Stdin is also closed if the request is cancelled.
+func streamStdin(op *inflight, w io.WriteCloser, initial []byte) {
+	open := true
+	if len(initial) > 0 {
+		_, _ = w.Write(initial)
+	}
+	for {
+		in, ok := op.next()
+		if !ok {
+			if open {
+				_ = w.Close()
+			}
+			return
+		}
+		if in.Type != "stdin" || in.Chunk == nil {
+			log.Printf("exec_stream: ignoring %q frame during stdin stream", in.Type)
+			continue
+		}
+		if !open {
+			continue
+		}
+		if len(in.Chunk.Data) > 0 {
+			// A process that stopped reading stdin is not an error for the
+			// stream as a whole; drop the data.
+			_, _ = w.Write(in.Chunk.Data)
+		}
+		if in.Chunk.EOF {
+			_ = w.Close()
+			open = false
+		}
+	}
+}
+
+// runCommand starts the requested command, hands its stdout/stderr pipes to the
+// given consumers, and waits for it to exit, time out, or be cancelled. Closing
+// cancel kills the process group. If stdin is nil the process reads from
+// /dev/null; otherwise stdin runs in the background with the write end of the
+// process's stdin pipe and is not waited for.
+func runCommand(req agentrpc.ExecRequest, cancel <-chan struct{}, stdin func(io.WriteCloser), stdout, stderr func(io.Reader)) execResult {
+	timeout := time.Duration(req.TimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = 20 * time.Second
+	}
+
+	cmd, exitCode, err := buildCommand(req)
+	if err != nil {
+		return execResult{resp: &agentrpc.ExecResponse{ExitCode: exitCode}, err: err}
+	}
 
+	var stdinPipe io.WriteCloser
+	if stdin != nil {
+		stdinPipe, err = cmd.StdinPipe()
+		if err != nil {
+			return execResult{resp: &agentrpc.ExecResponse{ExitCode: 1}, err: err}
+		}
+	}
 	stdoutPipe, err := cmd.StdoutPipe()
 	if err != nil {
 		return execResult{resp: &agentrpc.ExecResponse{ExitCode: 1}, err: err}
@@ -136,16 +248,24 @@ func runExec(req agentrpc.ExecRequest) execResult {
 		return execResult{resp: &agentrpc.ExecResponse{ExitCode: 127}, err: err}
 	}
 
-	var stdoutBuf, stderrBuf bytes.Buffer
-	stdoutDone := make(chan struct{}, 1)
-	stderrDone := make(chan struct{}, 1)
+	if req.ExecID != "" {
+		execs.add(req.ExecID, cmd)
+		defer execs.remove(req.ExecID, cmd)
+	}
+
+	if stdin != nil {
+		go stdin(stdinPipe)
+	}
+
+	var pumps sync.WaitGroup
+	pumps.Add(2)
 	go func() {
-		_, _ = io.Copy(&stdoutBuf, io.LimitReader(stdoutPipe, maxOut))
-		stdoutDone <- struct{}{}
+		defer pumps.Done()
+		stdout(stdoutPipe)
 	}()
 	go func() {
-		_, _ = io.Copy(&stderrBuf, io.LimitReader(stderrPipe, maxOut))
-		stderrDone <- struct{}{}
+		defer pumps.Done()
+		stderr(stderrPipe)
 	}()
 
 	waitCh := make(chan error, 1)
@@ -163,18 +283,24 @@ func runExec(req agentrpc.ExecRequest) execResult {
 		// On timeout we intentionally treat the kill/wait outcome as success and
 		// return a synthetic exit code.
 		waitErr = nil
+	case <-cancel:
+		killProcessGroup(cmd)
+		waitErr = <-waitCh
 	}
 
-	<-stdoutDone
-	<-stderrDone
+	pumps.Wait()
 
-	exitCode := 0
+	exitCode = 0
 	if timedOut {
 		exitCode = 124
 	} else if waitErr != nil {
 		var exitErr *exec.ExitError
 		if errors.As(waitErr, &exitErr) {
 			exitCode = exitErr.ProcessState.ExitCode()
+			// Report death by signal the way shells do.
+			if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+				exitCode = 128 + int(ws.Signal())
+			}
 			waitErr = nil
 		} else {
 			exitCode = 1
@@ -184,14 +310,37 @@ func runExec(req agentrpc.ExecRequest) execResult {
 	return execResult{
 		resp: &agentrpc.ExecResponse{
 			ExitCode: exitCode,
-			Stdout:   stdoutBuf.String(),
-			Stderr:   stderrBuf.String(),
 			TimedOut: timedOut,
 		},
 		err: waitErr,
 	}
 }
 
+// buildCommand prepares (but does not start) the process described by req in
+// its own process group. On error it also returns the exit code to report.
+func buildCommand(req agentrpc.ExecRequest) (*exec.Cmd, int, error) {
+	argv, err := normalizeArgv(req)
+	if err != nil {
+		return nil, 2, err
+	}
+
+	ident, err := resolveIdentity(req.User, req.UID, req.GID)
+	if err != nil {
+		return nil, 126, err
+	}
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	// Put the command in its own process group so we can SIGKILL the whole tree.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+	cmd.Env = os.Environ()
+	ident.apply(cmd)
+	if strings.TrimSpace(req.Cwd) != "" {
+		cmd.Dir = req.Cwd
+	}
+	cmd.Env = append(cmd.Env, req.Env...)
+	return cmd, 0, nil
+}
+
 func normalizeArgv(req agentrpc.ExecRequest) ([]string, error) {
 	cmd := strings.TrimSpace(req.Cmd)
 	if req.UseShell {
@@ -218,6 +367,50 @@ func killProcessGroup(cmd *exec.Cmd) {
 	_ = cmd.Process.Kill()
 }
 
+// execs tracks running commands that were given an exec ID.
+var execs = &execTable{byID: make(map[string]*exec.Cmd)}
+
+type execTable struct {
+	mu   sync.Mutex
+	byID map[string]*exec.Cmd
+}
+
+func (t *execTable) add(id string, cmd *exec.Cmd) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.byID[id]; ok {
+		log.Printf("exec %q already running; not tracking duplicate", id)
+		return
+	}
+	t.byID[id] = cmd
+}
+
+func (t *execTable) remove(id string, cmd *exec.Cmd) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.byID[id] == cmd {
+		delete(t.byID, id)
+	}
+}
+
+// signal sends sig to the process group of a running exec.
+func (t *execTable) signal(id, rawSig string) error {
+	sig, err := parseSignal(rawSig)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	cmd := t.byID[strings.TrimSpace(id)]
+	t.mu.Unlock()
+	if cmd == nil {
+		return fmt.Errorf("exec %q %w", id, errNotFound)
+	}
+	if err := syscall.Kill(-cmd.Process.Pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+		return fmt.Errorf("signal exec %q: %w", id, err)
+	}
+	return nil
+}
+
 func configureNetwork(req agentrpc.NetRequest) error {
 	iface := strings.TrimSpace(req.Interface)
 	if iface == "" {
@@ -279,3 +472,21 @@ func errString(err error) string {
 	}
 	return err.Error()
 }
+
+// errNotFound marks lookups of unknown processes and execs.
+var errNotFound = errors.New("not found")
+
+// errorResponse reports err as a failed response, classified so the host can
+// map it to a status without parsing the message.
+func errorResponse(err error) agentrpc.Response {
+	resp := agentrpc.Response{OK: false, Error: err.Error()}
+	switch {
+	case errors.Is(err, errNotFound), errors.Is(err, fs.ErrNotExist):
+		resp.Code = agentrpc.CodeNotFound
+	case errors.Is(err, fs.ErrExist):
+		resp.Code = agentrpc.CodeExists
+	case errors.Is(err, fs.ErrPermission):
+		resp.Code = agentrpc.CodePermission
+	}
+	return resp
+}
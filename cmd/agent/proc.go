@@ -0,0 +1,319 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"manta/internal/agentrpc"
+)
+
+const (
+	// procLogBytes is the per-process output ring buffer size.
+	procLogBytes = 1 << 20
+
+	// procMaxExited caps how many finished processes are remembered. The
+	// oldest finished entries are dropped first.
+	procMaxExited = 256
+
+	procDefaultWait = 30 * time.Second
+)
+
+// procs is the agent-wide background process table. It is independent of any
+// connection so processes keep running (and stay addressable) across host
+// reconnects.
+var procs = &procTable{byID: make(map[string]*managedProc)}
+
+type procTable struct {
+	mu     sync.Mutex
+	nextID uint64
+	byID   map[string]*managedProc
+}
+
+type managedProc struct {
+	id        string
+	argv      []string
+	cmd       *exec.Cmd
+	startedAt time.Time
+	logs      *ringBuffer
+	done      chan struct{}
+
+	// Guarded by done: only written before done is closed.
+	exitCode int
+	signal   string
+	exitedAt time.Time
+}
+
+func (p *managedProc) info() agentrpc.ProcInfo {
+	info := agentrpc.ProcInfo{
+		ID:              p.id,
+		PID:             p.cmd.Process.Pid,
+		Argv:            p.argv,
+		Running:         true,
+		StartedAtUnixMs: p.startedAt.UnixMilli(),
+	}
+	select {
+	case <-p.done:
+		info.Running = false
+		info.ExitCode = p.exitCode
+		info.Signal = p.signal
+		info.ExitedAtUnixMs = p.exitedAt.UnixMilli()
+	default:
+	}
+	return info
+}
+
+// handleProc serves the proc_* requests. A pending proc_wait returns early
+// when cancel is closed.
+func handleProc(req agentrpc.Request, cancel <-chan struct{}) agentrpc.Response {
+	if req.Type == "proc_start" {
+		if req.Exec == nil {
+			return agentrpc.Response{OK: false, Error: "missing exec payload"}
+		}
+		p, err := procs.start(*req.Exec)
+		if err != nil {
+			return agentrpc.Response{OK: false, Error: err.Error()}
+		}
+		info := p.info()
+		return agentrpc.Response{OK: true, Proc: &agentrpc.ProcResponse{Process: &info}}
+	}
+	if req.Type == "proc_list" {
+		return agentrpc.Response{OK: true, Proc: &agentrpc.ProcResponse{Processes: procs.list()}}
+	}
+
+	if req.Proc == nil {
+		return agentrpc.Response{OK: false, Error: "missing proc payload"}
+	}
+	p := procs.get(req.Proc.ID)
+	if p == nil {
+		return errorResponse(fmt.Errorf("process %q %w", req.Proc.ID, errNotFound))
+	}
+
+	switch req.Type {
+	case "proc_get":
+	case "proc_logs":
+		logs := p.logs.readFrom(req.Proc.Offset, req.Proc.MaxBytes)
+		return agentrpc.Response{OK: true, Proc: &agentrpc.ProcResponse{Logs: &logs}}
+	case "proc_signal":
+		sig, err := parseSignal(req.Proc.Signal)
+		if err != nil {
+			return agentrpc.Response{OK: false, Error: err.Error()}
+		}
+		select {
+		case <-p.done:
+			return agentrpc.Response{OK: false, Error: fmt.Sprintf("process %q has exited", p.id)}
+		default:
+		}
+		// Signal the whole process group, like killProcessGroup does.
+		if err := syscall.Kill(-p.cmd.Process.Pid, sig); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return agentrpc.Response{OK: false, Error: fmt.Sprintf("signal process %q: %v", p.id, err)}
+		}
+	case "proc_wait":
+		timeout := time.Duration(req.Proc.TimeoutMs) * time.Millisecond
+		if timeout <= 0 {
+			timeout = procDefaultWait
+		}
+		select {
+		case <-p.done:
+		case <-time.After(timeout):
+		case <-cancel:
+		}
+	default:
+		return agentrpc.Response{OK: false, Error: fmt.Sprintf("unknown request type %q", req.Type)}
+	}
+	info := p.info()
+	return agentrpc.Response{OK: true, Proc: &agentrpc.ProcResponse{Process: &info}}
+}
+
+func (t *procTable) start(req agentrpc.ExecRequest) (*managedProc, error) {
+	cmd, _, err := buildCommand(req)
+	if err != nil {
+		return nil, err
+	}
+	logs := newRingBuffer(procLogBytes)
+	cmd.Stdout = logs
+	cmd.Stderr = logs
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	t.mu.Lock()
+	t.nextID++
+	p := &managedProc{
+		id:        "p-" + strconv.FormatUint(t.nextID, 10),
+		argv:      cmd.Args,
+		cmd:       cmd,
+		startedAt: time.Now(),
+		logs:      logs,
+		done:      make(chan struct{}),
+	}
+	t.byID[p.id] = p
+	t.pruneLocked()
+	t.mu.Unlock()
+
+	go func() {
+		err := cmd.Wait()
+		if err != nil {
+			var exitErr *exec.ExitError
+			if errors.As(err, &exitErr) {
+				p.exitCode = exitErr.ProcessState.ExitCode()
+				if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+					p.signal = unix.SignalName(ws.Signal())
+				}
+			} else {
+				p.exitCode = 1
+			}
+		}
+		p.exitedAt = time.Now()
+		close(p.done)
+	}()
+	return p, nil
+}
+
+func (t *procTable) get(id string) *managedProc {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.byID[strings.TrimSpace(id)]
+}
+
+func (t *procTable) list() []agentrpc.ProcInfo {
+	t.mu.Lock()
+	all := make([]*managedProc, 0, len(t.byID))
+	for _, p := range t.byID {
+		all = append(all, p)
+	}
+	t.mu.Unlock()
+
+	out := make([]agentrpc.ProcInfo, 0, len(all))
+	for _, p := range all {
+		out = append(out, p.info())
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].StartedAtUnixMs < out[j].StartedAtUnixMs })
+	return out
+}
+
+// pruneLocked forgets the oldest finished processes beyond procMaxExited.
+func (t *procTable) pruneLocked() {
+	var exited []*managedProc
+	for _, p := range t.byID {
+		select {
+		case <-p.done:
+			exited = append(exited, p)
+		default:
+		}
+	}
+	if len(exited) <= procMaxExited {
+		return
+	}
+	sort.Slice(exited, func(i, j int) bool { return exited[i].exitedAt.Before(exited[j].exitedAt) })
+	for _, p := range exited[:len(exited)-procMaxExited] {
+		delete(t.byID, p.id)
+	}
+}
+
+// ringBuffer keeps the most recent output of a process. It is an io.Writer
+// so exec.Cmd copies both pipes into it.
+type ringBuffer struct {
+	mu    sync.Mutex
+	buf   []byte
+	total int64 // bytes ever written
+}
+
+var _ io.Writer = (*ringBuffer)(nil)
+
+func newRingBuffer(size int) *ringBuffer {
+	return &ringBuffer{buf: make([]byte, size)}
+}
+
+func (rb *ringBuffer) Write(p []byte) (int, error) {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	n := len(p)
+	size := len(rb.buf)
+	if len(p) > size {
+		rb.total += int64(len(p) - size)
+		p = p[len(p)-size:]
+	}
+	for len(p) > 0 {
+		pos := int(rb.total % int64(size))
+		c := copy(rb.buf[pos:], p)
+		rb.total += int64(c)
+		p = p[c:]
+	}
+	return n, nil
+}
+
+// readFrom returns retained output starting at the absolute offset, up to
+// maxBytes (0 => everything retained).
+func (rb *ringBuffer) readFrom(offset, maxBytes int64) agentrpc.ProcLogs {
+	rb.mu.Lock()
+	defer rb.mu.Unlock()
+	size := int64(len(rb.buf))
+	oldest := rb.total - size
+	if oldest < 0 {
+		oldest = 0
+	}
+
+	logs := agentrpc.ProcLogs{Offset: offset}
+	if offset < oldest {
+		logs.Offset = oldest
+		logs.Truncated = true
+	}
+	if logs.Offset > rb.total {
+		logs.Offset = rb.total
+	}
+	end := rb.total
+	if maxBytes > 0 && end-logs.Offset > maxBytes {
+		end = logs.Offset + maxBytes
+	}
+
+	logs.Data = make([]byte, 0, end-logs.Offset)
+	for off := logs.Offset; off < end; {
+		pos := off % size
+		chunk := min(end-off, size-pos)
+		logs.Data = append(logs.Data, rb.buf[pos:pos+chunk]...)
+		off += chunk
+	}
+	logs.NextOffset = end
+	return logs
+}
+
+var signalsByName = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"TERM": syscall.SIGTERM,
+	"CONT": syscall.SIGCONT,
+	"STOP": syscall.SIGSTOP,
+	"TSTP": syscall.SIGTSTP,
+}
+
+// parseSignal accepts "SIGTERM", "TERM" or "15".
+func parseSignal(raw string) (syscall.Signal, error) {
+	name := strings.ToUpper(strings.TrimSpace(raw))
+	if name == "" {
+		return 0, fmt.Errorf("signal is required")
+	}
+	if n, err := strconv.Atoi(name); err == nil {
+		if n <= 0 || n > 64 {
+			return 0, fmt.Errorf("invalid signal %q", raw)
+		}
+		return syscall.Signal(n), nil
+	}
+	if sig, ok := signalsByName[strings.TrimPrefix(name, "SIG")]; ok {
+		return sig, nil
+	}
+	return 0, fmt.Errorf("unsupported signal %q", raw)
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"manta/internal/agentrpc"
+)
+
+// ptyDrainTimeout bounds how long output is drained after the session process
+// exits. Background jobs that inherited the terminal would otherwise keep the
+// master open forever.
+const ptyDrainTimeout = 250 * time.Millisecond
+
+// servePTY runs an interactive session for a "pty" request. Follow-up
+// "pty_input" frames for the request are terminal input; cancelling the
+// request hangs up the session. The returned error is a connection-level
+// write failure.
+func servePTY(fw *frameWriter, req agentrpc.Request, op *inflight) error {
+	if req.PTY == nil {
+		return fw.write(agentrpc.Response{OK: false, Error: "missing pty payload"})
+	}
+	p := *req.PTY
+
+	argv := p.Argv
+	if len(argv) == 0 {
+		argv = []string{"/bin/sh", "-l"}
+	}
+	term := strings.TrimSpace(p.Term)
+	if term == "" {
+		term = "xterm-256color"
+	}
+
+	ident, err := resolveIdentity(p.User, nil, nil)
+	if err != nil {
+		return fw.write(agentrpc.Response{OK: false, Error: err.Error(), Exec: &agentrpc.ExecResponse{ExitCode: 126}})
+	}
+
+	master, tty, err := openPTY()
+	if err != nil {
+		return fw.write(agentrpc.Response{OK: false, Error: fmt.Sprintf("open pty: %v", err)})
+	}
+	defer master.Close()
+	if err := resizePTY(master, p.Rows, p.Cols); err != nil {
+		log.Printf("pty resize: %v", err)
+	}
+
+	cmd := exec.Command(argv[0], argv[1:]...)
+	// New session with the pty as controlling terminal so job control and
+	// SIGHUP on hangup behave like a real login.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true, Setctty: true, Ctty: 0}
+	cmd.Env = append(os.Environ(), "TERM="+term)
+	ident.apply(cmd)
+	if strings.TrimSpace(p.Cwd) != "" {
+		cmd.Dir = p.Cwd
+	}
+	cmd.Env = append(cmd.Env, p.Env...)
+	cmd.Stdin = tty
+	cmd.Stdout = tty
+	cmd.Stderr = tty
+	if err := cmd.Start(); err != nil {
+		_ = tty.Close()
+		return fw.write(agentrpc.Response{OK: false, Error: err.Error(), Exec: &agentrpc.ExecResponse{ExitCode: 127}})
+	}
+	_ = tty.Close()
+
+	// Host -> terminal. Cancellation means the host hung up, which ends the
+	// session the same way closing a terminal window does.
+	go func() {
+		for {
+			in, ok := op.next()
+			if !ok {
+				if op.cancelled() {
+					killProcessGroup(cmd)
+				}
+				return
+			}
+			if in.Type != "pty_input" || in.PTYInput == nil {
+				log.Printf("pty: ignoring %q frame during session", in.Type)
+				continue
+			}
+			if in.PTYInput.Rows > 0 && in.PTYInput.Cols > 0 {
+				if err := resizePTY(master, in.PTYInput.Rows, in.PTYInput.Cols); err != nil {
+					log.Printf("pty resize: %v", err)
+				}
+			}
+			if len(in.PTYInput.Data) > 0 {
+				if _, err := master.Write(in.PTYInput.Data); err != nil {
+					log.Printf("pty write input: %v", err)
+				}
+			}
+		}
+	}()
+
+	// Terminal -> host.
+	var sendErr error
+	outputDone := make(chan struct{})
+	go func() {
+		defer close(outputDone)
+		buf := make([]byte, outputChunkBytes)
+		for {
+			n, err := master.Read(buf)
+			if n > 0 && sendErr == nil {
+				sendErr = fw.write(agentrpc.Response{
+					OK:     true,
+					More:   true,
+					Output: &agentrpc.ExecOutput{Stream: "pty", Data: buf[:n]},
+				})
+				if sendErr != nil {
+					killProcessGroup(cmd)
+				}
+			}
+			if err != nil {
+				// EIO once every slave fd is closed.
+				return
+			}
+		}
+	}()
+
+	exitCode := 0
+	if err := cmd.Wait(); err != nil {
+		var exitErr *exec.ExitError
+		if !errors.As(err, &exitErr) {
+			return fw.write(agentrpc.Response{OK: false, Error: err.Error(), Exec: &agentrpc.ExecResponse{ExitCode: 1}})
+		}
+		exitCode = exitErr.ProcessState.ExitCode()
+		// Report death by signal the way shells do.
+		if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+			exitCode = 128 + int(ws.Signal())
+		}
+	}
+	select {
+	case <-outputDone:
+	case <-time.After(ptyDrainTimeout):
+		_ = master.Close()
+		<-outputDone
+	}
+	if sendErr != nil {
+		return sendErr
+	}
+	return fw.write(agentrpc.Response{OK: true, Exec: &agentrpc.ExecResponse{ExitCode: exitCode}})
+}
+
+// openPTY allocates a pseudo-terminal pair via /dev/ptmx.
+func openPTY() (master, tty *os.File, err error) {
+	master, err = os.OpenFile("/dev/ptmx", os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		return nil, nil, err
+	}
+	fd := int(master.Fd())
+	if err := unix.IoctlSetPointerInt(fd, unix.TIOCSPTLCK, 0); err != nil {
+		_ = master.Close()
+		return nil, nil, fmt.Errorf("unlock pty: %w", err)
+	}
+	n, err := unix.IoctlGetUint32(fd, unix.TIOCGPTN)
+	if err != nil {
+		_ = master.Close()
+		return nil, nil, fmt.Errorf("get pty number: %w", err)
+	}
+	tty, err = os.OpenFile(fmt.Sprintf("/dev/pts/%d", n), os.O_RDWR|syscall.O_NOCTTY, 0)
+	if err != nil {
+		_ = master.Close()
+		return nil, nil, err
+	}
+	return master, tty, nil
+}
+
+func resizePTY(master *os.File, rows, cols uint16) error {
+	if rows == 0 || cols == 0 {
+		return nil
+	}
+	return unix.IoctlSetWinsize(int(master.Fd()), unix.TIOCSWINSZ, &unix.Winsize{Row: rows, Col: cols})
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+
+	"manta/internal/agentrpc"
+)
+
+const (
+	watchMask = unix.IN_CREATE | unix.IN_MODIFY | unix.IN_DELETE |
+		unix.IN_MOVED_FROM | unix.IN_MOVED_TO | unix.IN_DELETE_SELF | unix.IN_MOVE_SELF
+
+	// maxEventsPerFrame keeps event frames well below agentrpc.MaxMessageBytes
+	// even when a large tree appears at once.
+	maxEventsPerFrame = 1000
+)
+
+// serveWatch streams inotify events for a "watch" request until it is
+// cancelled. The returned error is a connection-level write failure.
+func serveWatch(fw *frameWriter, req agentrpc.Request, op *inflight) error {
+	if req.Watch == nil {
+		return fw.write(agentrpc.Response{OK: false, Error: "missing watch payload"})
+	}
+	root, err := cleanGuestPath(req.Watch.Path)
+	if err != nil {
+		return fw.write(errorResponse(err))
+	}
+	w, err := newWatcher(root, req.Watch.Recursive)
+	if err != nil {
+		return fw.write(errorResponse(err))
+	}
+	defer w.close()
+
+	// Closing the inotify file is what unblocks the read loop.
+	go func() {
+		select {
+		case <-op.cancel:
+		case <-op.done:
+		}
+		w.close()
+	}()
+
+	if err := fw.write(agentrpc.Response{OK: true, More: true}); err != nil {
+		return err
+	}
+	send := func(events []agentrpc.FSEvent, last bool) error {
+		for len(events) > 0 {
+			n := min(len(events), maxEventsPerFrame)
+			more := !last || n < len(events)
+			if err := fw.write(agentrpc.Response{OK: true, More: more, Events: events[:n]}); err != nil {
+				return err
+			}
+			events = events[n:]
+		}
+		return nil
+	}
+
+	buf := make([]byte, 64<<10)
+	for {
+		n, err := w.f.Read(buf)
+		if err != nil {
+			if op.cancelled() || errors.Is(err, os.ErrClosed) {
+				return nil
+			}
+			return fw.write(agentrpc.Response{OK: false, Error: fmt.Sprintf("read inotify: %v", err)})
+		}
+		events, ended := w.translate(buf[:n])
+		if ended {
+			if len(events) == 0 {
+				return fw.write(agentrpc.Response{OK: true})
+			}
+			return send(events, true)
+		}
+		if err := send(events, false); err != nil {
+			return err
+		}
+	}
+}
+
+// watcher turns raw inotify events into FSEvents with absolute paths. A
+// recursive watcher adds a watch for every directory under root, including
+// ones created or moved in later. Watching a single file watches its parent
+// directory, so the file being replaced (e.g. by an editor's atomic save)
+// doesn't end the watch.
+type watcher struct {
+	f         *os.File
+	fd        int
+	root      string
+	rootWD    int32
+	fileOnly  bool // root is not a directory
+	recursive bool
+	dirs      map[int32]string // watch descriptor -> directory path
+
+	// pending is an IN_MOVED_FROM waiting for its IN_MOVED_TO.
+	pending *pendingMove
+}
+
+type pendingMove struct {
+	ev     agentrpc.FSEvent
+	cookie uint32
+}
+
+func newWatcher(root string, recursive bool) (*watcher, error) {
+	st, err := os.Stat(root)
+	if err != nil {
+		return nil, err
+	}
+	fd, err := unix.InotifyInit1(unix.IN_NONBLOCK | unix.IN_CLOEXEC)
+	if err != nil {
+		return nil, fmt.Errorf("inotify_init: %w", err)
+	}
+	w := &watcher{
+		// A non-blocking fd lets the runtime poller wake reads on Close.
+		f:         os.NewFile(uintptr(fd), "inotify"),
+		fd:        fd,
+		root:      root,
+		fileOnly:  !st.IsDir(),
+		recursive: recursive && st.IsDir(),
+		dirs:      make(map[int32]string),
+	}
+	dir := root
+	if w.fileOnly {
+		dir = filepath.Dir(root)
+	}
+	if w.rootWD, err = w.add(dir); err != nil {
+		w.close()
+		return nil, err
+	}
+	if w.recursive {
+		w.addTree(root, nil)
+	}
+	return w, nil
+}
+
+func (w *watcher) close() {
+	_ = w.f.Close()
+}
+
+func (w *watcher) add(dir string) (int32, error) {
+	wd, err := unix.InotifyAddWatch(w.fd, dir, watchMask)
+	if err != nil {
+		return 0, &fs.PathError{Op: "inotify_add_watch", Path: dir, Err: err}
+	}
+	w.dirs[int32(wd)] = dir
+	return int32(wd), nil
+}
+
+// addTree watches every directory below dir. With events non-nil, it also
+// reports what is already there as created, since entries made before their
+// directory's watch was added produce no events of their own.
+func (w *watcher) addTree(dir string, events *[]agentrpc.FSEvent) {
+	now := time.Now().UnixMilli()
+	_ = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// Gone or unreadable already; nothing to watch.
+			return nil
+		}
+		if p == dir {
+			return nil
+		}
+		if d.IsDir() {
+			if _, err := w.add(p); err != nil {
+				log.Printf("watch %s: %v", w.root, err)
+				return fs.SkipDir
+			}
+		}
+		if events != nil {
+			*events = append(*events, agentrpc.FSEvent{Type: agentrpc.FSEventCreate, Path: p, IsDir: d.IsDir(), TimeUnixMs: now})
+		}
+		return nil
+	})
+}
+
+// dropTree forgets the watches for dir and everything below it, after dir has
+// left the watched tree.
+func (w *watcher) dropTree(dir string) {
+	for wd, p := range w.dirs {
+		if p == dir || strings.HasPrefix(p, dir+"/") {
+			_, _ = unix.InotifyRmWatch(w.fd, uint32(wd))
+			delete(w.dirs, wd)
+		}
+	}
+}
+
+// moveTree updates watched paths after a directory was renamed within the tree.
+func (w *watcher) moveTree(oldDir, newDir string) {
+	for wd, p := range w.dirs {
+		if p == oldDir {
+			w.dirs[wd] = newDir
+		} else if strings.HasPrefix(p, oldDir+"/") {
+			w.dirs[wd] = newDir + p[len(oldDir):]
+		}
+	}
+}
+
+// translate decodes one read of inotify events. ended reports that the
+// watched directory itself is gone, in which case the last event says so.
+func (w *watcher) translate(buf []byte) (events []agentrpc.FSEvent, ended bool) {
+	now := time.Now().UnixMilli()
+	emit := func(ev agentrpc.FSEvent) {
+		if w.fileOnly && ev.Path != w.root && ev.OldPath != w.root {
+			return
+		}
+		// Writes arrive as a burst of IN_MODIFY; one event per burst is enough.
+		if ev.Type == agentrpc.FSEventModify && len(events) > 0 {
+			prev := events[len(events)-1]
+			if prev.Type == ev.Type && prev.Path == ev.Path {
+				return
+			}
+		}
+		events = append(events, ev)
+	}
+	flushPending := func() {
+		if w.pending == nil {
+			return
+		}
+		// Moved out of the watched tree.
+		ev := w.pending.ev
+		w.pending = nil
+		ev.Type = agentrpc.FSEventDelete
+		if ev.IsDir && w.recursive {
+			w.dropTree(ev.Path)
+		}
+		emit(ev)
+	}
+
+	for off := 0; off+unix.SizeofInotifyEvent <= len(buf); {
+		raw := (*unix.InotifyEvent)(unsafe.Pointer(&buf[off]))
+		nameBytes := buf[off+unix.SizeofInotifyEvent : off+unix.SizeofInotifyEvent+int(raw.Len)]
+		off += unix.SizeofInotifyEvent + int(raw.Len)
+		name := string(bytes.TrimRight(nameBytes, "\x00"))
+
+		if raw.Mask&unix.IN_Q_OVERFLOW != 0 {
+			flushPending()
+			events = append(events, agentrpc.FSEvent{Type: agentrpc.FSEventOverflow, TimeUnixMs: now})
+			continue
+		}
+		dir, ok := w.dirs[raw.Wd]
+		if !ok {
+			// Events still queued for a watch that was just dropped.
+			continue
+		}
+		ev := agentrpc.FSEvent{Path: dir, IsDir: raw.Mask&unix.IN_ISDIR != 0, TimeUnixMs: now}
+		if name != "" {
+			ev.Path = filepath.Join(dir, name)
+		}
+		if raw.Mask&unix.IN_IGNORED != 0 {
+			delete(w.dirs, raw.Wd)
+			if raw.Wd != w.rootWD {
+				continue
+			}
+			// The top-level watch went away without a deletion (e.g. the
+			// filesystem was unmounted); report it the same way.
+		}
+
+		switch {
+		case raw.Mask&(unix.IN_DELETE_SELF|unix.IN_MOVE_SELF|unix.IN_IGNORED) != 0:
+			// Subdirectories report their own removal through their
+			// parent; only the top-level directory matters here.
+			if raw.Wd != w.rootWD {
+				continue
+			}
+			flushPending()
+			ev.Type = agentrpc.FSEventDelete
+			ev.IsDir = !w.fileOnly
+			if w.fileOnly {
+				// The file's directory went away, and the file with it.
+				ev.Path = w.root
+				ev.IsDir = false
+			}
+			emit(ev)
+			return events, true
+		case raw.Mask&unix.IN_MOVED_FROM != 0:
+			flushPending()
+			w.pending = &pendingMove{ev: ev, cookie: raw.Cookie}
+			continue
+		case raw.Mask&unix.IN_MOVED_TO != 0:
+			if w.pending != nil && w.pending.cookie == raw.Cookie {
+				ev.Type = agentrpc.FSEventRename
+				ev.OldPath = w.pending.ev.Path
+				w.pending = nil
+				if ev.IsDir && w.recursive {
+					w.moveTree(ev.OldPath, ev.Path)
+				}
+				emit(ev)
+				continue
+			}
+			flushPending()
+			ev.Type = agentrpc.FSEventCreate
+			emit(ev)
+			if ev.IsDir && w.recursive {
+				w.addMovedIn(ev.Path, emit)
+			}
+			continue
+		}
+
+		flushPending()
+		switch {
+		case raw.Mask&unix.IN_CREATE != 0:
+			ev.Type = agentrpc.FSEventCreate
+			emit(ev)
+			if ev.IsDir && w.recursive {
+				w.addMovedIn(ev.Path, emit)
+			}
+		case raw.Mask&unix.IN_MODIFY != 0:
+			ev.Type = agentrpc.FSEventModify
+			emit(ev)
+		case raw.Mask&unix.IN_DELETE != 0:
+			ev.Type = agentrpc.FSEventDelete
+			emit(ev)
+		}
+	}
+	// A move's two halves arrive in the same read; a lone IN_MOVED_FROM at
+	// the end of one means the entry left the tree.
+	flushPending()
+	return events, false
+}
+
+// addMovedIn starts watching a directory that just appeared in the tree and
+// reports its existing contents.
+func (w *watcher) addMovedIn(dir string, emit func(agentrpc.FSEvent)) {
+	if _, err := w.add(dir); err != nil {
+		log.Printf("watch %s: %v", w.root, err)
+		return
+	}
+	var found []agentrpc.FSEvent
+	w.addTree(dir, &found)
+	for _, ev := range found {
+		emit(ev)
+	}
+}
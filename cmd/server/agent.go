@@ -4,18 +4,63 @@ import (
 	"bufio"
 	"errors"
 	"fmt"
+	"io"
 	"net"
+	"os"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"manta/internal/agentrpc"
 )
 
+// agentCallError is a failure reported by the agent itself (ok=false), as
+// opposed to a transport failure. The connection is still usable afterwards.
+type agentCallError struct {
+	msg  string
+	code string // agentrpc.Code*, if the agent classified the failure
+}
+
+func (e *agentCallError) Error() string { return e.msg }
+
+func agentResponseError(resp agentrpc.Response) error {
+	if strings.TrimSpace(resp.Error) != "" {
+		return &agentCallError{msg: resp.Error, code: resp.Code}
+	}
+	return &agentCallError{msg: "agent returned ok=false", code: resp.Code}
+}
+
+// agentSendError is a failure to send a request, so the agent never saw it.
+type agentSendError struct {
+	err error
+}
+
+func (e *agentSendError) Error() string { return e.err.Error() }
+func (e *agentSendError) Unwrap() error { return e.err }
+
+// agentWriteTimeout bounds a single frame write. A write that fails part way
+// leaves the connection unusable, so the connection is dropped.
+const agentWriteTimeout = 10 * time.Second
+
+// errAgentConnClosed is reported to calls still in flight when the connection
+// is closed locally.
+var errAgentConnClosed = errors.New("agent connection closed")
+
+// agentConn multiplexes concurrent calls over one agent connection. Each call
+// gets a connection-unique request ID, and a read loop routes response frames
+// to the call with the matching ID.
 type agentConn struct {
-	mu sync.Mutex
-	c  net.Conn
-	r  *bufio.Reader
+	c net.Conn
+	r *bufio.Reader
+
+	wmu sync.Mutex // serializes frame writes
+
+	mu      sync.Mutex
+	nextID  uint64
+	streams map[uint64]*agentStream
+	err     error         // why the connection stopped; set once
+	dead    chan struct{} // closed once err is set
 }
 
 func dialAgent(udsPath string, port int, timeout time.Duration) (*agentConn, error) {
@@ -34,7 +79,12 @@ func dialAgent(udsPath string, port int, timeout time.Duration) (*agentConn, err
 		return nil, err
 	}
 
-	ac := &agentConn{c: c, r: bufio.NewReader(c)}
+	ac := &agentConn{
+		c:       c,
+		r:       bufio.NewReader(c),
+		streams: make(map[uint64]*agentStream),
+		dead:    make(chan struct{}),
+	}
 	// Firecracker vsock device uses a simple line-based handshake:
 	// CONNECT <port>\n -> OK <id>\n
 	_ = c.SetDeadline(time.Now().Add(timeout))
@@ -52,6 +102,7 @@ func dialAgent(udsPath string, port int, timeout time.Duration) (*agentConn, err
 		return nil, fmt.Errorf("vsock CONNECT failed: %q", strings.TrimSpace(line))
 	}
 	_ = c.SetDeadline(time.Time{})
+	go ac.readLoop()
 	return ac, nil
 }
 
@@ -59,38 +110,254 @@ func (ac *agentConn) Close() error {
 	if ac == nil || ac.c == nil {
 		return nil
 	}
-	return ac.c.Close()
+	ac.fail(errAgentConnClosed)
+	return nil
 }
 
-func (ac *agentConn) Call(req agentrpc.Request, timeout time.Duration) (agentrpc.Response, error) {
+// Err returns why the connection stopped working, or nil while it is usable.
+func (ac *agentConn) Err() error {
 	ac.mu.Lock()
 	defer ac.mu.Unlock()
+	return ac.err
+}
 
-	if ac.c == nil {
-		return agentrpc.Response{}, errors.New("agent connection is nil")
+func (ac *agentConn) fail(err error) {
+	ac.mu.Lock()
+	if ac.err == nil {
+		ac.err = err
+		close(ac.dead)
 	}
+	ac.mu.Unlock()
+	_ = ac.c.Close()
+}
+
+func (ac *agentConn) readLoop() {
+	for {
+		var resp agentrpc.Response
+		if err := agentrpc.ReadMessage(ac.r, &resp); err != nil {
+			ac.fail(err)
+			return
+		}
+		ac.mu.Lock()
+		st := ac.streams[resp.ID]
+		ac.mu.Unlock()
+		if st == nil {
+			// Late frame for a call that has already given up.
+			continue
+		}
+		select {
+		case st.frames <- resp:
+		case <-st.abandoned:
+		}
+	}
+}
+
+func (ac *agentConn) write(req agentrpc.Request) error {
+	ac.wmu.Lock()
+	defer ac.wmu.Unlock()
+	if err := ac.Err(); err != nil {
+		return err
+	}
+	_ = ac.c.SetWriteDeadline(time.Now().Add(agentWriteTimeout))
+	if err := agentrpc.WriteMessage(ac.c, req); err != nil {
+		ac.fail(err)
+		return err
+	}
+	_ = ac.c.SetWriteDeadline(time.Time{})
+	return nil
+}
+
+// Call sends a single-frame request and waits for its response. On timeout
+// the request is cancelled on the agent and the connection stays usable.
+func (ac *agentConn) Call(req agentrpc.Request, timeout time.Duration) (agentrpc.Response, error) {
 	if timeout <= 0 {
 		timeout = 20 * time.Second
 	}
-	_ = ac.c.SetDeadline(time.Now().Add(timeout))
-	defer ac.c.SetDeadline(time.Time{})
+	st, err := ac.OpenStream(req, timeout)
+	if err != nil {
+		return agentrpc.Response{}, err
+	}
+	defer st.Close()
+	return st.Recv()
+}
 
-	if err := agentrpc.WriteMessage(ac.c, req); err != nil {
+// idempotentAgentCalls only read guest state, so running one twice is
+// harmless.
+var idempotentAgentCalls = map[string]bool{
+	"ping":      true,
+	"proc_list": true,
+	"proc_get":  true,
+	"proc_logs": true,
+	"proc_wait": true,
+	"fs_list":   true,
+	"fs_stat":   true,
+}
+
+// callAgent runs a request on the sandbox's shared agent connection, dialing
+// it if needed. If the connection is broken before the request goes out, or
+// breaks during an idempotent call, the call is retried once on a fresh one.
+// Anything else may already have run in the guest and is not resent.
+//
+// sb.agentCalls is held shared for the whole call, so a capture closing the
+// connection waits for the call to finish.
+func (s *server) callAgent(sb *sandbox, req agentrpc.Request, timeout time.Duration) (agentrpc.Response, error) {
+	sb.agentCalls.RLock()
+	defer sb.agentCalls.RUnlock()
+	ac, err := s.sharedAgent(sb)
+	if err != nil {
 		return agentrpc.Response{}, err
 	}
+	resp, err := ac.Call(req, timeout)
+	if err == nil || ac.Err() == nil {
+		return resp, err
+	}
+	var callErr *agentCallError
+	if errors.As(err, &callErr) {
+		return resp, err
+	}
+	var sendErr *agentSendError
+	if !errors.As(err, &sendErr) && !idempotentAgentCalls[req.Type] {
+		return resp, err
+	}
+
+	// Retry once on a broken connection.
+	newAC, derr := s.sharedAgent(sb)
+	if derr != nil {
+		return agentrpc.Response{}, fmt.Errorf("%v (original error: %v)", derr, err)
+	}
+	return newAC.Call(req, timeout)
+}
+
+// sharedAgent returns the sandbox's shared agent connection, redialing it if
+// it is missing or broken. sb.agentMu is only held while doing so; calls on
+// the connection run concurrently.
+func (s *server) sharedAgent(sb *sandbox) (*agentConn, error) {
+	sb.agentMu.Lock()
+	defer sb.agentMu.Unlock()
+	if sb.Agent != nil && sb.Agent.Err() == nil {
+		return sb.Agent, nil
+	}
+	if sb.Agent != nil {
+		_ = sb.Agent.Close()
+		sb.Agent = nil
+	}
+	ac, err := dialAgent(sb.VsockPath, s.cfg.AgentPort, s.cfg.AgentDialTimeout)
+	if err != nil {
+		return nil, fmt.Errorf("agent dial failed: %w", err)
+	}
+	sb.Agent = ac
+	return ac, nil
+}
+
+// agentStream is an in-progress call. Recv is meant for a single reader, while
+// Send and Close may be called from other goroutines.
+type agentStream struct {
+	ac        *agentConn
+	id        uint64
+	frames    chan agentrpc.Response
+	abandoned chan struct{}
+	closeOnce sync.Once
+	timer     *time.Timer
+	deadline  <-chan time.Time
+	done      atomic.Bool // final frame received
+	err       error       // sticky timeout/connection error; Recv only
+}
+
+// OpenStream sends a request whose response may span several frames. timeout
+// bounds the whole call, not individual frames; 0 disables the deadline.
+func (ac *agentConn) OpenStream(req agentrpc.Request, timeout time.Duration) (*agentStream, error) {
+	if ac == nil || ac.c == nil {
+		return nil, errors.New("agent connection is nil")
+	}
+	ac.mu.Lock()
+	if ac.err != nil {
+		err := ac.err
+		ac.mu.Unlock()
+		return nil, &agentSendError{err: err}
+	}
+	ac.nextID++
+	st := &agentStream{
+		ac:        ac,
+		id:        ac.nextID,
+		frames:    make(chan agentrpc.Response, 16),
+		abandoned: make(chan struct{}),
+	}
+	ac.streams[st.id] = st
+	ac.mu.Unlock()
+
+	if timeout > 0 {
+		st.timer = time.NewTimer(timeout)
+		st.deadline = st.timer.C
+	}
+	req.ID = st.id
+	if err := ac.write(req); err != nil {
+		// A failed write never delivers a whole frame.
+		st.Close()
+		return nil, &agentSendError{err: err}
+	}
+	return st, nil
+}
+
+// Recv returns the next frame of the stream, or io.EOF once the final frame
+// has been returned.
+func (st *agentStream) Recv() (agentrpc.Response, error) {
+	if st.done.Load() {
+		return agentrpc.Response{}, io.EOF
+	}
+	if st.err != nil {
+		return agentrpc.Response{}, st.err
+	}
 	var resp agentrpc.Response
-	if err := agentrpc.ReadMessage(ac.r, &resp); err != nil {
-		return agentrpc.Response{}, err
+	select {
+	case resp = <-st.frames:
+	case <-st.deadline:
+		st.err = fmt.Errorf("agent call timed out: %w", os.ErrDeadlineExceeded)
+		return agentrpc.Response{}, st.err
+	case <-st.ac.dead:
+		// Frames routed before the connection died are still valid.
+		select {
+		case resp = <-st.frames:
+		default:
+			st.err = st.ac.Err()
+			return agentrpc.Response{}, st.err
+		}
+	}
+	if !resp.More {
+		st.done.Store(true)
 	}
 	if !resp.OK {
-		if strings.TrimSpace(resp.Error) != "" {
-			return resp, errors.New(resp.Error)
-		}
-		return resp, fmt.Errorf("agent returned ok=false")
+		return resp, agentResponseError(resp)
 	}
 	return resp, nil
 }
 
+// Send writes a follow-up frame (e.g. terminal input) for the stream. It may
+// be called concurrently with Recv.
+func (st *agentStream) Send(req agentrpc.Request) error {
+	req.ID = st.id
+	return st.ac.write(req)
+}
+
+// Close releases the stream. If the final frame has not arrived yet, the
+// request is cancelled on the agent.
+func (st *agentStream) Close() {
+	if st == nil {
+		return
+	}
+	st.closeOnce.Do(func() {
+		close(st.abandoned)
+		if st.timer != nil {
+			st.timer.Stop()
+		}
+		st.ac.mu.Lock()
+		delete(st.ac.streams, st.id)
+		st.ac.mu.Unlock()
+		if !st.done.Load() {
+			_ = st.ac.write(agentrpc.Request{ID: st.id, Type: "cancel"})
+		}
+	})
+}
+
 func waitForAgentReady(udsPath string, port int, timeout, dialTimeout time.Duration) (*agentConn, error) {
 	deadline := time.Now().Add(timeout)
 	var lastErr error
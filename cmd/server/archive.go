@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+
+	"manta/internal/agentrpc"
+)
+
+// Archive transfers move a whole directory tree as one tar stream, over a
+// dedicated agent connection like file transfers. Extraction happens in the
+// agent, which refuses entries that would land outside the target directory.
+
+type archiveImportResponse struct {
+	Path    string `json:"path"`
+	Entries int    `json:"entries"`
+	Skipped int    `json:"skipped"`
+	Bytes   int64  `json:"bytes"`
+}
+
+var archiveContentTypes = map[string]string{
+	"none": "application/x-tar",
+	"gzip": "application/gzip",
+	"zstd": "application/zstd",
+}
+
+// compressionParam reads ?compression=. An empty value is returned as is; the
+// caller decides what it means.
+func compressionParam(r *http.Request) (string, error) {
+	c := r.URL.Query().Get("compression")
+	if c == "" {
+		return "", nil
+	}
+	if _, ok := archiveContentTypes[c]; !ok {
+		return "", fmt.Errorf("compression must be none, gzip or zstd")
+	}
+	return c, nil
+}
+
+// handleArchiveImport extracts the tar in the request body into the guest
+// directory ?path=, creating it if needed. Compression is detected from the
+// stream unless ?compression= says otherwise.
+func (s *server) handleArchiveImport(w http.ResponseWriter, r *http.Request) {
+	guestPath, err := guestPathParam(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	compression, err := compressionParam(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	sb, ok := s.acquireSandbox(w, r.PathValue("id"), "archive transfers")
+	if !ok {
+		return
+	}
+	defer sb.finishExec()
+
+	ac, err := dialAgent(sb.VsockPath, s.cfg.AgentPort, s.cfg.AgentDialTimeout)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent dial failed: %v", err)})
+		return
+	}
+	defer ac.Close()
+	stop := context.AfterFunc(r.Context(), func() { _ = ac.Close() })
+	defer stop()
+
+	st, err := ac.OpenStream(agentrpc.Request{
+		Type:    "archive_import",
+		Archive: &agentrpc.ArchiveRequest{Path: guestPath, Compression: compression},
+	}, 0)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent archive import failed: %v", err)})
+		return
+	}
+	defer st.Close()
+
+	resp, err := streamUpload(st, r.Body)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	if resp.Archive == nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "agent returned no archive summary"})
+		return
+	}
+	writeJSON(w, http.StatusOK, archiveImportResponse{
+		Path:    guestPath,
+		Entries: resp.Archive.Entries,
+		Skipped: resp.Archive.Skipped,
+		Bytes:   resp.Archive.Bytes,
+	})
+}
+
+// handleArchiveExport streams a tar of the guest path ?path= as the response
+// body, compressed per ?compression= (default none).
+func (s *server) handleArchiveExport(w http.ResponseWriter, r *http.Request) {
+	guestPath, err := guestPathParam(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	compression, err := compressionParam(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if compression == "" {
+		compression = "none"
+	}
+
+	sb, ok := s.acquireSandbox(w, r.PathValue("id"), "archive transfers")
+	if !ok {
+		return
+	}
+	defer sb.finishExec()
+
+	ac, err := dialAgent(sb.VsockPath, s.cfg.AgentPort, s.cfg.AgentDialTimeout)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent dial failed: %v", err)})
+		return
+	}
+	defer ac.Close()
+	stop := context.AfterFunc(r.Context(), func() { _ = ac.Close() })
+	defer stop()
+
+	st, err := ac.OpenStream(agentrpc.Request{
+		Type:    "archive_export",
+		Archive: &agentrpc.ArchiveRequest{Path: guestPath, Compression: compression},
+	}, 0)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent archive export failed: %v", err)})
+		return
+	}
+	defer st.Close()
+
+	resp, err := st.Recv()
+	if err != nil {
+		writeAgentError(w, err)
+		return
+	}
+	w.Header().Set("Content-Type", archiveContentTypes[compression])
+	w.WriteHeader(http.StatusOK)
+
+	for resp.More {
+		resp, err = st.Recv()
+		if err != nil {
+			// See handleFileDownload: abort rather than end a truncated
+			// archive cleanly.
+			log.Printf("archive export %s:%s failed: %v", sb.ID, guestPath, err)
+			panic(http.ErrAbortHandler)
+		}
+		if resp.Chunk != nil && len(resp.Chunk.Data) > 0 {
+			if _, err := w.Write(resp.Chunk.Data); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -0,0 +1,411 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// The base store keeps base rootfs images by lineage ID, the SHA-256 of the
+// image, in bases/<lineage_id>/rootfs.ext4 with a base.json next to it. A
+// user snapshot restores, or imports, only if the base it was taken on is the
+// current one or is in the store, so shipping a new rootfs.ext4 doesn't strand
+// snapshots of the old one as long as the old image stays stored.
+//
+// The current base is copied in at startup. Bases from before the store
+// existed, or from another host, are added with PUT /bases/{lineage_id},
+// which checks the image against its lineage ID. The snapshot GC removes
+// bases that no snapshot or sandbox uses any more, except the current one.
+
+const baseImageFile = "rootfs.ext4"
+
+// baseStoreGrace keeps a base the GC would otherwise remove for a while after
+// it was added, so a base uploaded ahead of its snapshots survives until they
+// are imported.
+const baseStoreGrace = time.Hour
+
+var lineageIDPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+var errUnknownLineage = errors.New("snapshot lineage is not available")
+
+// baseStoreMu keeps the GC from removing a base between an import's lineage
+// check and the imported snapshot appearing in the store.
+var baseStoreMu sync.RWMutex
+
+// baseLineageRecord is stored as bases/<lineage_id>/base.json.
+type baseLineageRecord struct {
+	LineageID string `json:"lineage_id"`
+	// SourcePath is the rootfs the server was configured with, for a base
+	// copied in at startup; an uploaded base has none.
+	SourcePath string `json:"source_path,omitempty"`
+	SizeBytes  int64  `json:"size_bytes"`
+	AddedAt    string `json:"added_at"`
+}
+
+func baseStoreDir(workDir string) string {
+	return filepath.Join(workDir, "bases")
+}
+
+func baseDir(workDir, lineageID string) string {
+	return filepath.Join(baseStoreDir(workDir), lineageID)
+}
+
+func baseImagePath(workDir, lineageID string) string {
+	return filepath.Join(baseDir(workDir, lineageID), baseImageFile)
+}
+
+func (s *server) loadBaseLineage(lineageID string) (baseLineageRecord, error) {
+	var rec baseLineageRecord
+	if !lineageIDPattern.MatchString(lineageID) {
+		return rec, fmt.Errorf("invalid lineage id %q", lineageID)
+	}
+	raw, err := os.ReadFile(filepath.Join(baseDir(s.cfg.WorkDir, lineageID), "base.json"))
+	if err != nil {
+		return rec, err
+	}
+	if err := json.Unmarshal(raw, &rec); err != nil {
+		return rec, fmt.Errorf("decode base record: %w", err)
+	}
+	if !fileExists(baseImagePath(s.cfg.WorkDir, lineageID)) {
+		return rec, fmt.Errorf("base %s: image missing", lineageID)
+	}
+	return rec, nil
+}
+
+// storeCurrentBase copies the configured base rootfs into the store unless
+// it is there already. It runs in the background at startup; until it is
+// done, snapshots of the current base don't need the stored copy.
+func (s *server) storeCurrentBase() {
+	lineage := s.cfg.BaseRootfsLineageID
+	if lineage == "" {
+		return
+	}
+	if _, err := s.loadBaseLineage(lineage); err == nil {
+		return
+	}
+	start := time.Now()
+	if err := s.ingestBase(lineage); err != nil {
+		log.Printf("store base rootfs %s: %v", lineage, err)
+		return
+	}
+	log.Printf("stored base rootfs %s in %s", lineage, time.Since(start))
+}
+
+func (s *server) ingestBase(lineage string) error {
+	if err := os.MkdirAll(importsDir(s.cfg.WorkDir), 0o755); err != nil {
+		return fmt.Errorf("create imports dir: %w", err)
+	}
+	stage, err := os.MkdirTemp(importsDir(s.cfg.WorkDir), "base-")
+	if err != nil {
+		return fmt.Errorf("create staging dir: %w", err)
+	}
+	defer os.RemoveAll(stage)
+
+	img := filepath.Join(stage, baseImageFile)
+	if err := materializeSandboxRootfs(s.cfg, s.cfg.BaseRootfsPath, img); err != nil {
+		return fmt.Errorf("copy base rootfs: %w", err)
+	}
+	// The lineage was computed at startup; make sure the copy is still that
+	// image rather than one replaced since.
+	got, err := computeFileSHA256(img)
+	if err != nil {
+		return err
+	}
+	if got != lineage {
+		return fmt.Errorf("base rootfs changed since startup (now %s)", got)
+	}
+	return s.publishBase(stage, baseLineageRecord{
+		LineageID:  lineage,
+		SourcePath: s.cfg.BaseRootfsPath,
+		SizeBytes:  fileSize(img),
+	})
+}
+
+// publishBase writes rec into stage, which holds the image, and renames it
+// into the store. A base that is already stored has the same contents, so
+// losing that race is not an error.
+func (s *server) publishBase(stage string, rec baseLineageRecord) error {
+	if err := syncFiles(filepath.Join(stage, baseImageFile)); err != nil {
+		return err
+	}
+	rec.AddedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	raw, err := json.MarshalIndent(rec, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode base record: %w", err)
+	}
+	if err := os.WriteFile(filepath.Join(stage, "base.json"), append(raw, '\n'), 0o644); err != nil {
+		return fmt.Errorf("write base record: %w", err)
+	}
+	if err := os.MkdirAll(baseStoreDir(s.cfg.WorkDir), 0o755); err != nil {
+		return fmt.Errorf("create base store: %w", err)
+	}
+	err = unix.Renameat2(unix.AT_FDCWD, stage, unix.AT_FDCWD, baseDir(s.cfg.WorkDir, rec.LineageID), unix.RENAME_NOREPLACE)
+	if err != nil && !errors.Is(err, unix.EEXIST) {
+		return fmt.Errorf("register base %s: %w", rec.LineageID, err)
+	}
+	return nil
+}
+
+// checkSnapshotLineage reports whether a snapshot taken on base lineage can
+// be restored here: on the current base, or on one in the base store. Without
+// snapshots enabled there is no current lineage and nothing is checked.
+func (s *server) checkSnapshotLineage(lineage string) error {
+	current := strings.TrimSpace(s.cfg.BaseRootfsLineageID)
+	lineage = strings.TrimSpace(lineage)
+	if current == "" || lineage == current {
+		return nil
+	}
+	if lineage == "" {
+		return fmt.Errorf("%w: snapshot meta missing lineage id", errUnknownLineage)
+	}
+	if _, err := s.loadBaseLineage(lineage); err != nil {
+		return fmt.Errorf("%w: base rootfs %s is not the current one (%s) and is not in the base store; add it with PUT /bases/%s", errUnknownLineage, lineage, current, lineage)
+	}
+	return nil
+}
+
+// baseUsers counts the snapshots and live sandboxes on each base lineage.
+func (s *server) baseUsers() (map[string]int, error) {
+	items, err := s.listUserSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	users := map[string]int{}
+	for _, m := range items {
+		users[m.LineageID]++
+	}
+	s.mu.Lock()
+	for _, sb := range s.sandboxes {
+		users[sb.LineageID]++
+	}
+	s.mu.Unlock()
+	return users, nil
+}
+
+// pruneBases removes stored bases that are not the current one, have no
+// snapshot or live sandbox on them, and are past baseStoreGrace.
+func (s *server) pruneBases(now time.Time) {
+	baseStoreMu.Lock()
+	defer baseStoreMu.Unlock()
+	entries, err := os.ReadDir(baseStoreDir(s.cfg.WorkDir))
+	if err != nil {
+		return
+	}
+	users, err := s.baseUsers()
+	if err != nil {
+		log.Printf("snapshot gc: prune bases: %v", err)
+		return
+	}
+	for _, e := range entries {
+		lineage := e.Name()
+		if lineage == s.cfg.BaseRootfsLineageID || users[lineage] > 0 {
+			continue
+		}
+		if rec, err := s.loadBaseLineage(lineage); err == nil {
+			if added, err := time.Parse(time.RFC3339Nano, rec.AddedAt); err == nil && now.Sub(added) < baseStoreGrace {
+				continue
+			}
+		}
+		if err := os.RemoveAll(filepath.Join(baseStoreDir(s.cfg.WorkDir), lineage)); err != nil {
+			log.Printf("snapshot gc: remove base %s: %v", lineage, err)
+			continue
+		}
+		log.Printf("snapshot gc: removed base %s (no snapshot or sandbox uses it)", lineage)
+	}
+}
+
+type baseInfo struct {
+	LineageID string `json:"lineage_id"`
+	// Current is set for the base the server runs new sandboxes on.
+	Current    bool   `json:"current"`
+	ImagePath  string `json:"image_path"`
+	SourcePath string `json:"source_path,omitempty"`
+	SizeBytes  int64  `json:"size_bytes"`
+	AddedAt    string `json:"added_at"`
+	// Users counts the snapshots and live sandboxes on this base.
+	Users int `json:"users"`
+}
+
+func (s *server) baseInfo(rec baseLineageRecord, users int) baseInfo {
+	return baseInfo{
+		LineageID:  rec.LineageID,
+		Current:    rec.LineageID == s.cfg.BaseRootfsLineageID,
+		ImagePath:  baseImagePath(s.cfg.WorkDir, rec.LineageID),
+		SourcePath: rec.SourcePath,
+		SizeBytes:  rec.SizeBytes,
+		AddedAt:    rec.AddedAt,
+		Users:      users,
+	}
+}
+
+// handleBaseList lists the base store (GET /bases), sorted by lineage ID.
+func (s *server) handleBaseList(w http.ResponseWriter, r *http.Request) {
+	users, err := s.baseUsers()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	entries, err := os.ReadDir(baseStoreDir(s.cfg.WorkDir))
+	if err != nil && !os.IsNotExist(err) {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	out := []baseInfo{}
+	for _, e := range entries {
+		rec, err := s.loadBaseLineage(e.Name())
+		if err != nil {
+			continue
+		}
+		out = append(out, s.baseInfo(rec, users[rec.LineageID]))
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].LineageID < out[j].LineageID })
+	writeJSON(w, http.StatusOK, map[string]any{"bases": out})
+}
+
+// handleBaseUpload adds the base rootfs image in the request body to the
+// store (PUT /bases/{lineage_id}). The image's SHA-256 must be the lineage ID.
+func (s *server) handleBaseUpload(w http.ResponseWriter, r *http.Request) {
+	lineage := strings.TrimSpace(r.PathValue("lineage_id"))
+	if !lineageIDPattern.MatchString(lineage) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid lineage_id (want the image's SHA-256 in lowercase hex)"})
+		return
+	}
+	users, err := s.baseUsers()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if rec, err := s.loadBaseLineage(lineage); err == nil {
+		writeJSON(w, http.StatusOK, s.baseInfo(rec, users[lineage]))
+		return
+	}
+
+	if err := os.MkdirAll(importsDir(s.cfg.WorkDir), 0o755); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("create imports dir: %v", err)})
+		return
+	}
+	stage, err := os.MkdirTemp(importsDir(s.cfg.WorkDir), "base-")
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("create staging dir: %v", err)})
+		return
+	}
+	defer os.RemoveAll(stage)
+
+	f, err := os.Create(filepath.Join(stage, baseImageFile))
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("create base image: %v", err)})
+		return
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(f, h), r.Body)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("read base image: %v", err)})
+		return
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != lineage {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("image SHA-256 is %s, not lineage_id %s", got, lineage)})
+		return
+	}
+	if err := s.publishBase(stage, baseLineageRecord{LineageID: lineage, SizeBytes: n}); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	rec, err := s.loadBaseLineage(lineage)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.baseInfo(rec, users[lineage]))
+}
+
+type snapshotLineageEntry struct {
+	SnapshotID   string `json:"snapshot_id"`
+	Name         string `json:"name,omitempty"`
+	SnapshotType string `json:"snapshot_type"`
+	ParentID     string `json:"parent_id,omitempty"`
+	CreatedAt    string `json:"created_at"`
+}
+
+type baseLineageInfo struct {
+	LineageID string `json:"lineage_id"`
+	// Current is set for the base the server runs new sandboxes on; Stored
+	// when the base store holds its image; Available when the snapshot can
+	// be restored.
+	Current   bool   `json:"current"`
+	Stored    bool   `json:"stored"`
+	Available bool   `json:"available"`
+	ImagePath string `json:"image_path,omitempty"`
+	SizeBytes int64  `json:"size_bytes,omitempty"`
+	AddedAt   string `json:"added_at,omitempty"`
+}
+
+type snapshotLineageResponse struct {
+	SnapshotID string `json:"snapshot_id"`
+	// Chain starts with the snapshot itself and follows parent_id down to
+	// the full snapshot its memory layers sit on.
+	Chain []snapshotLineageEntry `json:"chain"`
+	// Children are the diff snapshots taken on top of this one.
+	Children []string        `json:"children,omitempty"`
+	Base     baseLineageInfo `json:"base"`
+}
+
+// handleSnapshotLineage shows where a snapshot comes from
+// (GET /snapshot/{id}/lineage): its diff parents and its base rootfs.
+func (s *server) handleSnapshotLineage(w http.ResponseWriter, r *http.Request) {
+	snapshotID, err := normalizeSnapshotID(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	meta, err := s.loadUserSnapshotMeta(snapshotID)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	chain, err := s.snapshotChain(meta)
+	if err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	children, err := s.diffChildren(snapshotID)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	resp := snapshotLineageResponse{SnapshotID: snapshotID, Children: children}
+	for _, m := range chain {
+		typ := snapshotTypeFull
+		if m.isDiff() {
+			typ = snapshotTypeDiff
+		}
+		resp.Chain = append(resp.Chain, snapshotLineageEntry{SnapshotID: m.SnapshotID, Name: m.Name, SnapshotType: typ, ParentID: m.ParentID, CreatedAt: m.CreatedAt})
+	}
+	base := baseLineageInfo{LineageID: meta.LineageID, Current: meta.LineageID != "" && meta.LineageID == s.cfg.BaseRootfsLineageID}
+	base.Available = s.checkSnapshotLineage(meta.LineageID) == nil
+	if rec, err := s.loadBaseLineage(meta.LineageID); err == nil {
+		base.Stored = true
+		base.ImagePath = baseImagePath(s.cfg.WorkDir, rec.LineageID)
+		base.SizeBytes = rec.SizeBytes
+		base.AddedAt = rec.AddedAt
+	}
+	resp.Base = base
+	writeJSON(w, http.StatusOK, resp)
+}
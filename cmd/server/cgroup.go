@@ -22,14 +22,18 @@ func ensureCgroupRoot(root string) error {
 	return nil
 }
 
-func scavengeCgroups(root string) {
+// scavengeCgroups kills and removes leftover sandbox cgroups under root,
+// except those named in keep.
+func scavengeCgroups(root string, keep map[string]bool) {
 	entries, err := os.ReadDir(root)
 	if err != nil {
-		log.Printf("scavenge cgroups: read %q: %v", root, err)
+		if !os.IsNotExist(err) {
+			log.Printf("scavenge cgroups: read %q: %v", root, err)
+		}
 		return
 	}
 	for _, e := range entries {
-		if !e.IsDir() {
+		if !e.IsDir() || keep[e.Name()] {
 			continue
 		}
 		cg := filepath.Join(root, e.Name())
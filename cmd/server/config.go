@@ -46,6 +46,20 @@ func loadConfig() (config, error) {
 		),
 		DefaultMemMiB: intOr("MANTA_VM_MEM_MIB", 512),
 		DefaultVCPU:   intOr("MANTA_VM_VCPU", 1),
+		MinVCPU:       intOr("MANTA_VM_VCPU_MIN", 1),
+		MaxVCPU:       intOr("MANTA_VM_VCPU_MAX", 8),
+		MinMemMiB:     intOr("MANTA_VM_MEM_MIB_MIN", 128),
+		MaxMemMiB:     intOr("MANTA_VM_MEM_MIB_MAX", 8192),
+		MaxDiskMiB:    intOr("MANTA_VM_DISK_MIB_MAX", 16384),
+
+		DefaultTTL:         durationOr("MANTA_SANDBOX_TTL", 0),
+		DefaultIdleTimeout: durationOr("MANTA_SANDBOX_IDLE_TIMEOUT", 0),
+		ReaperInterval:     durationOr("MANTA_REAPER_INTERVAL", 5*time.Second),
+
+		EnableDiffSnapshots: intOr("MANTA_ENABLE_DIFF_SNAPSHOTS", 0) != 0,
+		VerifySnapshots:     intOr("MANTA_VERIFY_SNAPSHOTS", 0) != 0,
+		RecoverSandboxes:    intOr("MANTA_RECOVER_SANDBOXES", 0) != 0,
+		SnapshotGCInterval:  durationOr("MANTA_SNAPSHOT_GC_INTERVAL", time.Minute),
 	}
 
 	// Firecracker is started with its working directory set to a per-sandbox
@@ -72,6 +86,26 @@ func loadConfig() (config, error) {
 		return cfg, fmt.Errorf("invalid MANTA_ROOTFS_CLONE_MODE %q (expected auto or reflink-required)", cfg.RootfsCloneMode)
 	}
 
+	if cfg.MinVCPU < 1 || cfg.MaxVCPU < cfg.MinVCPU || cfg.DefaultVCPU < cfg.MinVCPU || cfg.DefaultVCPU > cfg.MaxVCPU {
+		return cfg, fmt.Errorf("invalid vCPU limits (default=%d min=%d max=%d)", cfg.DefaultVCPU, cfg.MinVCPU, cfg.MaxVCPU)
+	}
+	if cfg.MinMemMiB < 1 || cfg.MaxMemMiB < cfg.MinMemMiB || cfg.DefaultMemMiB < cfg.MinMemMiB || cfg.DefaultMemMiB > cfg.MaxMemMiB {
+		return cfg, fmt.Errorf("invalid memory limits (default=%d min=%d max=%d)", cfg.DefaultMemMiB, cfg.MinMemMiB, cfg.MaxMemMiB)
+	}
+
+	if cfg.DefaultTTL < 0 || cfg.DefaultIdleTimeout < 0 || cfg.ReaperInterval <= 0 {
+		return cfg, fmt.Errorf("sandbox TTL and idle timeout must be >= 0 and the reaper interval > 0")
+	}
+
+	policies, err := loadRetentionPolicies()
+	if err != nil {
+		return cfg, err
+	}
+	cfg.SnapshotPolicies = policies
+	if cfg.SnapshotGCInterval <= 0 {
+		return cfg, fmt.Errorf("MANTA_SNAPSHOT_GC_INTERVAL must be > 0")
+	}
+
 	if cfg.HostNATIface = strings.TrimSpace(os.Getenv("MANTA_HOST_IFACE")); cfg.HostNATIface == "" {
 		iface, err := detectDefaultInterface()
 		if err != nil {
@@ -13,6 +13,7 @@ func logStartupDiagnostics(cfg config) {
 	log.Printf("- runtime: listen_addr=%s host_iface=%s work_dir=%s", cfg.ListenAddr, cfg.HostNATIface, cfg.WorkDir)
 	log.Printf("- features: snapshots_enabled=%t netns_pool_size=%d cgroups_enabled=%t", cfg.EnableSnapshots, cfg.NetnsPoolSize, cfg.EnableCgroups)
 	log.Printf("- storage: rootfs_clone_mode=%s", cfg.RootfsCloneMode)
+	log.Printf("- machine: default=%s vcpu=[%d,%d] mem_mib=[%d,%d] disk_mib_max=%d", defaultShape(cfg).key(), cfg.MinVCPU, cfg.MaxVCPU, cfg.MinMemMiB, cfg.MaxMemMiB, cfg.MaxDiskMiB)
 	log.Printf("- diagnostics: stage_timing_logs=%t", cfg.EnableStageTimingLogs)
 	if reflinkErr != nil {
 		log.Printf("- storage: reflink_probe_error=%v", reflinkErr)
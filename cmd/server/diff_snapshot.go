@@ -0,0 +1,289 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// maxDiffChain bounds how many layers a restore will merge; it also stops a
+// corrupt meta.json with a parent cycle from looping forever.
+const maxDiffChain = 256
+
+// diffMergeMu serializes building merged memory files and compaction, which
+// both rewrite files inside snapshot dirs.
+var diffMergeMu sync.Mutex
+
+type snapshotCompactRequest struct {
+	SnapshotID string `json:"snapshot_id"`
+}
+
+type snapshotCompactResponse struct {
+	SnapshotID   string `json:"snapshot_id"`
+	SnapshotType string `json:"snapshot_type"`
+	Layers       int    `json:"layers_merged"`
+}
+
+// setDiffParent records the snapshot sb's dirty pages are relative to. The
+// caller holds pauseMu unless sb is not yet shared.
+func (sb *sandbox) setDiffParent(snapshotID string) {
+	sb.lifecycleMu.Lock()
+	sb.diffParentID = snapshotID
+	sb.lifecycleMu.Unlock()
+}
+
+func mergedMemPath(workDir, snapshotID string) string {
+	return filepath.Join(userSnapshotRootDir(workDir, snapshotID), "mem.merged.snap")
+}
+
+// snapshotChain returns meta and its ancestors, ending at the nearest full
+// snapshot.
+func (s *server) snapshotChain(meta userSnapshotMeta) ([]userSnapshotMeta, error) {
+	chain := []userSnapshotMeta{meta}
+	for cur := meta; cur.isDiff(); {
+		if len(chain) > maxDiffChain {
+			return nil, fmt.Errorf("snapshot %s: diff chain longer than %d", meta.SnapshotID, maxDiffChain)
+		}
+		parent, err := s.loadUserSnapshotMeta(cur.ParentID)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot %s: parent %s: %w", cur.SnapshotID, cur.ParentID, err)
+		}
+		chain = append(chain, parent)
+		cur = parent
+	}
+	return chain, nil
+}
+
+// userSnapshotMemFile returns a full memory file for meta. Diff snapshots are
+// merged once and the result is cached next to the layer.
+func (s *server) userSnapshotMemFile(meta userSnapshotMeta) (string, error) {
+	if !meta.isDiff() {
+		return meta.MemFile, nil
+	}
+	merged := mergedMemPath(s.cfg.WorkDir, meta.SnapshotID)
+	diffMergeMu.Lock()
+	defer diffMergeMu.Unlock()
+	if fileExists(merged) {
+		return merged, nil
+	}
+	chain, err := s.snapshotChain(meta)
+	if err != nil {
+		return "", err
+	}
+	if err := s.mergeMemLayers(chain, merged); err != nil {
+		return "", err
+	}
+	return merged, nil
+}
+
+// mergeMemLayers writes the memory of chain[0] to dst: the full memory of the
+// last entry with each diff layer above it applied in order.
+func (s *server) mergeMemLayers(chain []userSnapshotMeta, dst string) error {
+	tmp := dst + ".tmp"
+	_ = os.Remove(tmp)
+	base := chain[len(chain)-1]
+	if err := materializeSandboxRootfs(s.cfg, base.MemFile, tmp); err != nil {
+		return fmt.Errorf("copy base memory of %s: %w", base.SnapshotID, err)
+	}
+	out, err := os.OpenFile(tmp, os.O_WRONLY, 0)
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	for i := len(chain) - 2; i >= 0; i-- {
+		if err := overlayDataExtents(out, chain[i].MemFile); err != nil {
+			_ = out.Close()
+			_ = os.Remove(tmp)
+			return fmt.Errorf("apply diff layer %s: %w", chain[i].SnapshotID, err)
+		}
+	}
+	if err := out.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// overlayDataExtents copies every non-hole range of the sparse file src into
+// dst at the same offset. Firecracker writes diff snapshot memory this way:
+// dirty pages at their guest offsets, holes elsewhere.
+func overlayDataExtents(dst *os.File, src string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	st, err := in.Stat()
+	if err != nil {
+		return err
+	}
+	fd := int(in.Fd())
+	buf := make([]byte, 1<<20)
+	for off := int64(0); off < st.Size(); {
+		data, err := unix.Seek(fd, off, unix.SEEK_DATA)
+		if errors.Is(err, unix.ENXIO) {
+			return nil // no data past off
+		}
+		if err != nil {
+			return err
+		}
+		hole, err := unix.Seek(fd, data, unix.SEEK_HOLE)
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyBuffer(io.NewOffsetWriter(dst, data), io.NewSectionReader(in, data, hole-data), buf); err != nil {
+			return err
+		}
+		off = hole
+	}
+	return nil
+}
+
+// diffChildren lists the snapshots whose parent is snapshotID.
+func (s *server) diffChildren(snapshotID string) ([]string, error) {
+	all, err := s.listUserSnapshots()
+	if err != nil {
+		return nil, err
+	}
+	var children []string
+	for _, m := range all {
+		if m.isDiff() && m.ParentID == snapshotID {
+			children = append(children, m.SnapshotID)
+		}
+	}
+	return children, nil
+}
+
+// A diff capture's child has no meta.json until its artifacts are synced and
+// hashed, so diffChildren does not see it yet. The capture holds its parent
+// in pendingDiffParents from the parent check until the child's meta is
+// written or the capture fails, and removeUserSnapshot refuses held parents
+// under the same lock.
+var (
+	diffParentsMu      sync.Mutex
+	pendingDiffParents = map[string]int{}
+)
+
+var errSnapshotInUse = errors.New("snapshot in use")
+
+// holdDiffParent checks that snapshotID still exists and keeps it from being
+// deleted until releaseDiffParent.
+func (s *server) holdDiffParent(snapshotID string) error {
+	diffParentsMu.Lock()
+	defer diffParentsMu.Unlock()
+	if _, err := s.loadUserSnapshotMeta(snapshotID); err != nil {
+		return err
+	}
+	pendingDiffParents[snapshotID]++
+	return nil
+}
+
+func releaseDiffParent(snapshotID string) {
+	diffParentsMu.Lock()
+	defer diffParentsMu.Unlock()
+	if pendingDiffParents[snapshotID]--; pendingDiffParents[snapshotID] <= 0 {
+		delete(pendingDiffParents, snapshotID)
+	}
+}
+
+// removeUserSnapshot deletes a snapshot unless it is the parent of a diff
+// snapshot, finished or still being captured.
+func (s *server) removeUserSnapshot(snapshotID string) error {
+	diffParentsMu.Lock()
+	defer diffParentsMu.Unlock()
+	if pendingDiffParents[snapshotID] > 0 {
+		return fmt.Errorf("%w: snapshot %s is the parent of a diff snapshot being captured", errSnapshotInUse, snapshotID)
+	}
+	children, err := s.diffChildren(snapshotID)
+	if err != nil {
+		return err
+	}
+	if len(children) > 0 {
+		return fmt.Errorf("%w: %s", errSnapshotInUse, diffChildrenError(snapshotID, children))
+	}
+	if err := os.RemoveAll(userSnapshotRootDir(s.cfg.WorkDir, snapshotID)); err != nil {
+		return fmt.Errorf("delete snapshot: %w", err)
+	}
+	return nil
+}
+
+// handleSnapshotCompact flattens a diff snapshot's chain into a full memory
+// file of its own, so it no longer depends on its ancestors.
+func (s *server) handleSnapshotCompact(w http.ResponseWriter, r *http.Request) {
+	var req snapshotCompactRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	snapshotID, err := normalizeSnapshotID(req.SnapshotID)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	meta, err := s.loadUserSnapshotMeta(snapshotID)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	if !meta.isDiff() {
+		writeJSON(w, http.StatusOK, snapshotCompactResponse{SnapshotID: snapshotID, SnapshotType: snapshotTypeFull})
+		return
+	}
+
+	layers, err := s.compactUserSnapshot(meta)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshotCompactResponse{SnapshotID: snapshotID, SnapshotType: snapshotTypeFull, Layers: layers})
+}
+
+func (s *server) compactUserSnapshot(meta userSnapshotMeta) (int, error) {
+	diffMergeMu.Lock()
+	defer diffMergeMu.Unlock()
+
+	chain, err := s.snapshotChain(meta)
+	if err != nil {
+		return 0, err
+	}
+	// A cached merge is already the flattened memory.
+	merged := mergedMemPath(s.cfg.WorkDir, meta.SnapshotID)
+	if !fileExists(merged) {
+		if err := s.mergeMemLayers(chain, merged); err != nil {
+			return 0, err
+		}
+	}
+	memDigest, err := fileDigest(merged, nil)
+	if err != nil {
+		return 0, err
+	}
+	if err := os.Rename(merged, meta.MemFile); err != nil {
+		return 0, fmt.Errorf("replace memory layer: %w", err)
+	}
+	if _, err := s.updateUserSnapshotMeta(meta.SnapshotID, func(m *userSnapshotMeta) error {
+		m.SnapshotType = ""
+		m.ParentID = ""
+		if m.Digests != nil {
+			m.Digests[filepath.Base(m.MemFile)] = memDigest
+		}
+		return nil
+	}); err != nil {
+		return 0, err
+	}
+	return len(chain), nil
+}
+
+func diffChildrenError(snapshotID string, children []string) string {
+	return fmt.Sprintf("snapshot %s is the parent of diff snapshot(s) %s; compact or delete them first", snapshotID, strings.Join(children, ", "))
+}
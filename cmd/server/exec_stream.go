@@ -0,0 +1,386 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+
+	"manta/internal/agentrpc"
+)
+
+// stdinChunkBytes bounds the payload of a single stdin frame sent to the agent.
+const stdinChunkBytes = 32 << 10
+
+// execStreamEvent is one event of a POST /exec/stream response. The first
+// event is always "start" and carries the ExecID; output events carry Data;
+// the terminal "exit" event carries ExitCode and TimedOut; "error" is terminal
+// and reports a transport failure after the stream started.
+type execStreamEvent struct {
+	Type     string `json:"type"` // "start", "stdout", "stderr", "exit", "error"
+	ExecID   string `json:"exec_id,omitempty"`
+	Data     string `json:"data,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	TimedOut *bool  `json:"timed_out,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// execEventWriter emits stream events as Server-Sent Events when the client
+// asks for text/event-stream, and as NDJSON otherwise.
+type execEventWriter struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+	sse     bool
+}
+
+func newExecEventWriter(w http.ResponseWriter, r *http.Request) *execEventWriter {
+	ew := &execEventWriter{w: w, sse: strings.Contains(r.Header.Get("Accept"), "text/event-stream")}
+	ew.flusher, _ = w.(http.Flusher)
+	if ew.sse {
+		w.Header().Set("Content-Type", "text/event-stream")
+	} else {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	return ew
+}
+
+func (ew *execEventWriter) write(ev execStreamEvent) error {
+	raw, err := json.Marshal(ev)
+	if err != nil {
+		return err
+	}
+	if ew.sse {
+		_, err = fmt.Fprintf(ew.w, "event: %s\ndata: %s\n\n", ev.Type, raw)
+	} else {
+		raw = append(raw, '\n')
+		_, err = ew.w.Write(raw)
+	}
+	if err != nil {
+		return err
+	}
+	if ew.flusher != nil {
+		ew.flusher.Flush()
+	}
+	return nil
+}
+
+// execSession is a registered in-flight /exec or /exec/stream call.
+type execSession struct {
+	ID        string
+	SandboxID string
+
+	sb          *sandbox
+	stdinStream bool
+	stdinMu     sync.Mutex
+	stream      *agentStream // guarded by stdinMu; nil until the stream opens
+	stdinClosed bool
+}
+
+type execStdinResponse struct {
+	Bytes  int64 `json:"bytes"`
+	Closed bool  `json:"closed"`
+}
+
+type execSignalRequest struct {
+	Signal string `json:"signal"`
+}
+
+type execSignalResponse struct {
+	Status string `json:"status"`
+}
+
+// registerExecSession assigns es an ID unless the client picked one, and makes
+// it reachable under that ID. Client-chosen IDs must be unused.
+func (s *server) registerExecSession(es *execSession) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for es.ID == "" {
+		id := fmt.Sprintf("ex-%d", atomic.AddUint64(&s.nextExecID, 1))
+		if _, taken := s.execs[id]; !taken {
+			es.ID = id
+		}
+	}
+	if _, ok := s.execs[es.ID]; ok {
+		return fmt.Errorf("exec_id %q is already in use", es.ID)
+	}
+	s.execs[es.ID] = es
+	return nil
+}
+
+func (s *server) unregisterExecSession(es *execSession) {
+	s.mu.Lock()
+	delete(s.execs, es.ID)
+	s.mu.Unlock()
+}
+
+// validateExecID checks a client-chosen exec_id. Empty means "assign one".
+func validateExecID(id string) error {
+	if id == "" {
+		return nil
+	}
+	if len(id) > 128 {
+		return fmt.Errorf("exec_id is too long")
+	}
+	for _, c := range id {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return fmt.Errorf("exec_id may only contain letters, digits, '-', '_' and '.'")
+		}
+	}
+	return nil
+}
+
+// signalExec delivers sig to the process group of a running exec.
+func (s *server) signalExec(sb *sandbox, execID, sig string) error {
+	_, err := s.callAgent(sb, agentrpc.Request{
+		Type:   "signal",
+		Signal: &agentrpc.SignalRequest{ExecID: execID, Signal: sig},
+	}, s.cfg.AgentCallTimeout)
+	return err
+}
+
+func (s *server) handleExecStream(w http.ResponseWriter, r *http.Request) {
+	var req execRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if strings.TrimSpace(req.SandboxID) == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "sandbox_id is required"})
+		return
+	}
+	if err := validateExecID(req.ExecID); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	cmd, useShell, err := resolveExecCommand(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if s.cfg.ExecTransport != "agent" && s.cfg.ExecTransport != "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "exec streaming requires the agent transport"})
+		return
+	}
+	timeout := s.cfg.ExecTimeout
+	if req.TimeoutMs > 0 {
+		timeout = time.Duration(req.TimeoutMs) * time.Millisecond
+	}
+	agentReq, err := newAgentExecRequest(req, cmd, useShell, timeout)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	sb := s.sandboxes[req.SandboxID]
+	s.mu.Unlock()
+	if sb == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "sandbox not found"})
+		return
+	}
+	if !s.startExec(w, sb, req.AutoResume) {
+		return
+	}
+	defer sb.finishExec()
+
+	// Streams get their own connection so a client that reads slowly only
+	// stalls its own output, not every call multiplexed on the shared one.
+	ac, err := dialAgent(sb.VsockPath, s.cfg.AgentPort, s.cfg.AgentDialTimeout)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent dial failed: %v", err)})
+		return
+	}
+	defer ac.Close()
+	// Dropping the connection when the client goes away makes the agent
+	// cancel the command.
+	stop := context.AfterFunc(r.Context(), func() { _ = ac.Close() })
+	defer stop()
+
+	es := &execSession{
+		ID:          req.ExecID,
+		SandboxID:   sb.ID,
+		sb:          sb,
+		stdinStream: req.StdinStream,
+	}
+	if err := s.registerExecSession(es); err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	defer s.unregisterExecSession(es)
+
+	agentReq.ExecID = es.ID
+	agentReq.StdinStream = req.StdinStream
+	st, err := ac.OpenStream(agentrpc.Request{
+		Type: "exec_stream",
+		Exec: agentReq,
+	}, timeout+s.cfg.AgentCallTimeout)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent exec failed: %v", err)})
+		return
+	}
+	defer st.Close()
+	es.stdinMu.Lock()
+	es.stream = st
+	es.stdinMu.Unlock()
+
+	ew := newExecEventWriter(w, r)
+	if err := ew.write(execStreamEvent{Type: "start", ExecID: es.ID}); err != nil {
+		return
+	}
+	pending := map[string][]byte{}
+	for {
+		resp, err := st.Recv()
+		if err != nil {
+			_ = ew.write(execStreamEvent{Type: "error", Error: fmt.Sprintf("agent exec failed: %v", err)})
+			return
+		}
+		if resp.Output != nil {
+			stream := resp.Output.Stream
+			data, rest := splitUTF8(append(pending[stream], resp.Output.Data...))
+			pending[stream] = rest
+			if len(data) == 0 {
+				continue
+			}
+			if err := ew.write(execStreamEvent{Type: stream, Data: string(data)}); err != nil {
+				return
+			}
+			continue
+		}
+		if resp.More {
+			continue
+		}
+		for _, stream := range []string{"stdout", "stderr"} {
+			if len(pending[stream]) > 0 {
+				_ = ew.write(execStreamEvent{Type: stream, Data: string(pending[stream])})
+			}
+		}
+		if resp.Exec == nil {
+			_ = ew.write(execStreamEvent{Type: "error", Error: "agent stream ended without exit status"})
+			return
+		}
+		_ = ew.write(execStreamEvent{Type: "exit", ExitCode: &resp.Exec.ExitCode, TimedOut: &resp.Exec.TimedOut})
+		return
+	}
+}
+
+// handleExecStdin feeds the request body to the stdin of a running
+// /exec/stream call started with stdin_stream. With ?eof=1, stdin is closed
+// after the body has been written.
+func (s *server) handleExecStdin(w http.ResponseWriter, r *http.Request) {
+	execID := r.PathValue("exec_id")
+	closeAfter := false
+	if raw := r.URL.Query().Get("eof"); raw != "" {
+		v, err := strconv.ParseBool(raw)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid eof"})
+			return
+		}
+		closeAfter = v
+	}
+
+	s.mu.Lock()
+	es := s.execs[execID]
+	s.mu.Unlock()
+	if es == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "exec not found"})
+		return
+	}
+	if !es.stdinStream {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "exec was not started with stdin_stream"})
+		return
+	}
+
+	// Serialize writers so concurrent uploads don't interleave chunks.
+	es.stdinMu.Lock()
+	defer es.stdinMu.Unlock()
+	if es.stream == nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "exec has not started yet"})
+		return
+	}
+	if es.stdinClosed {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "stdin already closed"})
+		return
+	}
+
+	var written int64
+	buf := make([]byte, stdinChunkBytes)
+	for {
+		n, rerr := r.Body.Read(buf)
+		if n > 0 {
+			if err := es.stream.Send(agentrpc.Request{Type: "stdin", Chunk: &agentrpc.DataChunk{Data: buf[:n]}}); err != nil {
+				writeJSON(w, http.StatusBadGateway, map[string]string{"error": fmt.Sprintf("send stdin: %v", err)})
+				return
+			}
+			written += int64(n)
+		}
+		if rerr == io.EOF {
+			break
+		}
+		if rerr != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("read request body: %v", rerr)})
+			return
+		}
+	}
+	if closeAfter {
+		if err := es.stream.Send(agentrpc.Request{Type: "stdin", Chunk: &agentrpc.DataChunk{EOF: true}}); err != nil {
+			writeJSON(w, http.StatusBadGateway, map[string]string{"error": fmt.Sprintf("close stdin: %v", err)})
+			return
+		}
+		es.stdinClosed = true
+	}
+	writeJSON(w, http.StatusOK, execStdinResponse{Bytes: written, Closed: es.stdinClosed})
+}
+
+// handleExecSignal sends a signal to the process group of a running /exec or
+// /exec/stream call.
+func (s *server) handleExecSignal(w http.ResponseWriter, r *http.Request) {
+	var req execSignalRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if strings.TrimSpace(req.Signal) == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "signal is required"})
+		return
+	}
+
+	s.mu.Lock()
+	es := s.execs[r.PathValue("exec_id")]
+	s.mu.Unlock()
+	if es == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "exec not found"})
+		return
+	}
+	if err := s.signalExec(es.sb, es.ID, req.Signal); err != nil {
+		writeAgentError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, execSignalResponse{Status: "ok"})
+}
+
+// splitUTF8 returns the longest prefix of b that does not end in a truncated
+// UTF-8 sequence, plus the remainder to carry into the next chunk. Output
+// chunks are cut at arbitrary byte offsets, so a multi-byte rune can straddle
+// two frames.
+func splitUTF8(b []byte) ([]byte, []byte) {
+	for i := 1; i < utf8.UTFMax && i <= len(b); i++ {
+		c := b[len(b)-i]
+		if !utf8.RuneStart(c) {
+			continue
+		}
+		if utf8.FullRune(b[len(b)-i:]) {
+			return b, nil
+		}
+		return b[:len(b)-i], b[len(b)-i:]
+	}
+	return b, nil
+}
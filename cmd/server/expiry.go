@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// sandboxTimeouts resolves the optional lifetime limits on a create or restore
+// request against the server defaults.
+func sandboxTimeouts(cfg config, ttlSeconds, idleTimeoutSeconds int64) (ttl, idle time.Duration, err error) {
+	if ttlSeconds < 0 {
+		return 0, 0, fmt.Errorf("ttl_seconds must be >= 0")
+	}
+	if idleTimeoutSeconds < 0 {
+		return 0, 0, fmt.Errorf("idle_timeout_seconds must be >= 0")
+	}
+	ttl, idle = cfg.DefaultTTL, cfg.DefaultIdleTimeout
+	if ttlSeconds > 0 {
+		ttl = time.Duration(ttlSeconds) * time.Second
+	}
+	if idleTimeoutSeconds > 0 {
+		idle = time.Duration(idleTimeoutSeconds) * time.Second
+	}
+	return ttl, idle, nil
+}
+
+// formatExpiry renders an expiry for API responses; "" means never.
+func formatExpiry(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339Nano)
+}
+
+// startReaper destroys sandboxes that have outlived their TTL or sat idle past
+// their idle timeout, checking every cfg.ReaperInterval. The returned func
+// stops it.
+func (s *server) startReaper() (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.cfg.ReaperInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				s.reapExpired(now)
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (s *server) reapExpired(now time.Time) {
+	s.mu.Lock()
+	var expired []*sandbox
+	for id, sb := range s.sandboxes {
+		if reason := sb.expiryReason(now); reason != "" {
+			log.Printf("reaper: destroying %s (%s)", id, reason)
+			delete(s.sandboxes, id)
+			expired = append(expired, sb)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, sb := range expired {
+		go func() {
+			if err := s.destroySandbox(sb); err != nil {
+				log.Printf("reaper: destroy %s error: %v", sb.ID, err)
+			}
+		}()
+	}
+}
+
+type keepaliveRequest struct {
+	// Optional new TTL; 0 restarts the sandbox's current TTL.
+	TTLSeconds int64 `json:"ttl_seconds,omitempty"`
+}
+
+type keepaliveResponse struct {
+	SandboxID string `json:"sandbox_id"`
+	ExpiresAt string `json:"expires_at,omitempty"`
+}
+
+// handleSandboxKeepalive resets a sandbox's idle clock and restarts its TTL.
+func (s *server) handleSandboxKeepalive(w http.ResponseWriter, r *http.Request) {
+	var req keepaliveRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r.Body, &req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+			return
+		}
+	}
+	if req.TTLSeconds < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "ttl_seconds must be >= 0"})
+		return
+	}
+
+	id := r.PathValue("id")
+	s.mu.Lock()
+	sb := s.sandboxes[id]
+	s.mu.Unlock()
+	if sb == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "sandbox not found"})
+		return
+	}
+	select {
+	case <-sb.closing():
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "sandbox is closing"})
+		return
+	default:
+	}
+
+	expires := sb.keepalive(time.Duration(req.TTLSeconds) * time.Second)
+	s.persistSandbox(sb)
+	writeJSON(w, http.StatusOK, keepaliveResponse{SandboxID: sb.ID, ExpiresAt: formatExpiry(expires)})
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"manta/internal/agentrpc"
+)
+
+// File transfers run on a dedicated agent connection, like /exec/stream, and
+// move content in agentrpc.FileChunkBytes frames so neither side buffers the
+// whole file.
+
+type fileInfoResponse struct {
+	Path          string `json:"path"`
+	Size          int64  `json:"size"`
+	Mode          string `json:"mode"` // octal permission bits, e.g. "0644"
+	ModTimeUnixMs int64  `json:"mod_time_unix_ms"`
+}
+
+func newFileInfoResponse(fi agentrpc.FileInfo) fileInfoResponse {
+	return fileInfoResponse{
+		Path:          fi.Path,
+		Size:          fi.Size,
+		Mode:          fmt.Sprintf("%04o", fi.Mode),
+		ModTimeUnixMs: fi.ModTimeUnixMs,
+	}
+}
+
+// guestPathParam returns the cleaned, absolute guest path from ?path=.
+func guestPathParam(r *http.Request) (string, error) {
+	p := r.URL.Query().Get("path")
+	if p == "" {
+		return "", fmt.Errorf("path is required")
+	}
+	if !strings.HasPrefix(p, "/") {
+		return "", fmt.Errorf("path must be absolute")
+	}
+	return path.Clean(p), nil
+}
+
+func boolParam(r *http.Request, name string, fallback bool) (bool, error) {
+	raw := r.URL.Query().Get(name)
+	if raw == "" {
+		return fallback, nil
+	}
+	v, err := strconv.ParseBool(raw)
+	if err != nil {
+		return false, fmt.Errorf("invalid %s", name)
+	}
+	return v, nil
+}
+
+// handleFileUpload writes the request body to a guest file. Query parameters:
+// path (required), mode (octal; default keeps an existing file's mode, else
+// 0644), atomic (default true: write a temporary file and rename it into
+// place) and parents (create missing directories).
+func (s *server) handleFileUpload(w http.ResponseWriter, r *http.Request) {
+	guestPath, err := guestPathParam(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	fileReq := &agentrpc.FileRequest{Path: guestPath}
+	if raw := r.URL.Query().Get("mode"); raw != "" {
+		v, err := strconv.ParseUint(raw, 8, 32)
+		if err != nil || v > 0o7777 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid mode"})
+			return
+		}
+		mode := uint32(v)
+		fileReq.Mode = &mode
+	}
+	if fileReq.Atomic, err = boolParam(r, "atomic", true); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if fileReq.Parents, err = boolParam(r, "parents", false); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	sb, ok := s.acquireSandbox(w, r.PathValue("id"), "file transfers")
+	if !ok {
+		return
+	}
+	defer sb.finishExec()
+
+	ac, err := dialAgent(sb.VsockPath, s.cfg.AgentPort, s.cfg.AgentDialTimeout)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent dial failed: %v", err)})
+		return
+	}
+	defer ac.Close()
+	stop := context.AfterFunc(r.Context(), func() { _ = ac.Close() })
+	defer stop()
+
+	st, err := ac.OpenStream(agentrpc.Request{Type: "file_write", File: fileReq}, 0)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent file write failed: %v", err)})
+		return
+	}
+	// Closing before the agent answers cancels the write, which discards the
+	// partial file when writing atomically.
+	defer st.Close()
+
+	resp, err := streamUpload(st, r.Body)
+	if err != nil {
+		writeUploadError(w, err)
+		return
+	}
+	if resp.File == nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "agent returned no file info"})
+		return
+	}
+	writeJSON(w, http.StatusOK, newFileInfoResponse(*resp.File))
+}
+
+// handleFileDownload streams a guest file as the response body. The file's
+// permission bits are returned in X-File-Mode.
+func (s *server) handleFileDownload(w http.ResponseWriter, r *http.Request) {
+	guestPath, err := guestPathParam(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	sb, ok := s.acquireSandbox(w, r.PathValue("id"), "file transfers")
+	if !ok {
+		return
+	}
+	defer sb.finishExec()
+
+	ac, err := dialAgent(sb.VsockPath, s.cfg.AgentPort, s.cfg.AgentDialTimeout)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent dial failed: %v", err)})
+		return
+	}
+	defer ac.Close()
+	stop := context.AfterFunc(r.Context(), func() { _ = ac.Close() })
+	defer stop()
+
+	st, err := ac.OpenStream(agentrpc.Request{Type: "file_read", File: &agentrpc.FileRequest{Path: guestPath}}, 0)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent file read failed: %v", err)})
+		return
+	}
+	defer st.Close()
+
+	resp, err := st.Recv()
+	if err != nil {
+		writeAgentError(w, err)
+		return
+	}
+	if resp.File == nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "agent returned no file info"})
+		return
+	}
+	h := w.Header()
+	h.Set("Content-Type", "application/octet-stream")
+	h.Set("Content-Length", strconv.FormatInt(resp.File.Size, 10))
+	h.Set("Last-Modified", time.UnixMilli(resp.File.ModTimeUnixMs).UTC().Format(http.TimeFormat))
+	h.Set("X-File-Mode", fmt.Sprintf("%04o", resp.File.Mode))
+	w.WriteHeader(http.StatusOK)
+
+	for resp.More {
+		resp, err = st.Recv()
+		if err != nil {
+			// The status line is already out; abort the connection so the
+			// client sees a truncated body instead of a short success.
+			log.Printf("download %s:%s failed: %v", sb.ID, guestPath, err)
+			panic(http.ErrAbortHandler)
+		}
+		if resp.Chunk != nil && len(resp.Chunk.Data) > 0 {
+			if _, err := w.Write(resp.Chunk.Data); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// bodyReadError is a failure reading the client's upload, as opposed to one
+// reported by the agent.
+type bodyReadError struct{ err error }
+
+func (e *bodyReadError) Error() string { return fmt.Sprintf("read request body: %v", e.err) }
+
+// streamUpload sends body to st as "file_data" frames and returns the agent's
+// answer. The agent answers once, either after the last chunk or as soon as
+// it fails, so the answer is awaited alongside sending.
+func streamUpload(st *agentStream, body io.Reader) (agentrpc.Response, error) {
+	type result struct {
+		resp agentrpc.Response
+		err  error
+	}
+	resultCh := make(chan result, 1)
+	go func() {
+		resp, err := st.Recv()
+		resultCh <- result{resp: resp, err: err}
+	}()
+
+	buf := make([]byte, agentrpc.FileChunkBytes)
+	for {
+		n, rerr := io.ReadFull(body, buf)
+		eof := rerr == io.EOF || rerr == io.ErrUnexpectedEOF
+		if rerr != nil && !eof {
+			return agentrpc.Response{}, &bodyReadError{err: rerr}
+		}
+		select {
+		case res := <-resultCh:
+			// Answered before the last chunk: the agent is done with the
+			// stream, successfully or not.
+			return res.resp, res.err
+		default:
+		}
+		// A failed send breaks the connection, which Recv then reports.
+		if err := st.Send(agentrpc.Request{Type: "file_data", Chunk: &agentrpc.DataChunk{Data: buf[:n], EOF: eof}}); err != nil || eof {
+			break
+		}
+	}
+	res := <-resultCh
+	return res.resp, res.err
+}
+
+func writeUploadError(w http.ResponseWriter, err error) {
+	var bre *bodyReadError
+	if errors.As(err, &bre) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeAgentError(w, err)
+}
@@ -69,6 +69,26 @@ func (c *fcClient) doJSON(method, path string, payload any) error {
 	return nil
 }
 
+// vmState reports the VM's state as Firecracker sees it: "Not started",
+// "Running" or "Paused".
+func (c *fcClient) vmState() (string, error) {
+	resp, err := c.http.Get("http://unix/")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("firecracker GET /: status %d", resp.StatusCode)
+	}
+	var info struct {
+		State string `json:"state"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return "", fmt.Errorf("decode firecracker instance info: %w", err)
+	}
+	return info.State, nil
+}
+
 func (c *fcClient) pauseVM() error {
 	return c.doJSON(http.MethodPatch, "/vm", map[string]string{"state": "Paused"})
 }
@@ -85,13 +105,34 @@ func (c *fcClient) createFullSnapshot(statePath, memPath string) error {
 	})
 }
 
-func (c *fcClient) loadSnapshot(statePath, memPath string, resume bool) error {
+// createDiffSnapshot writes only the guest pages dirtied since the VM's last
+// snapshot (or since it booted or was restored) into a sparse memory file.
+// It requires dirty page tracking.
+func (c *fcClient) createDiffSnapshot(statePath, memPath string) error {
+	return c.doJSON(http.MethodPut, "/snapshot/create", map[string]string{
+		"snapshot_type": "Diff",
+		"snapshot_path": statePath,
+		"mem_file_path": memPath,
+	})
+}
+
+func (c *fcClient) loadSnapshot(statePath, memPath string, resume, trackDirtyPages bool) error {
 	return c.doJSON(http.MethodPut, "/snapshot/load", map[string]any{
 		"snapshot_path": statePath,
 		"mem_backend": map[string]any{
 			"backend_type": "File",
 			"backend_path": memPath,
 		},
-		"resume_vm": resume,
+		"track_dirty_pages": trackDirtyPages,
+		"resume_vm":         resume,
+	})
+}
+
+// updateDrivePath points a drive at pathOnHost again, which makes Firecracker
+// re-read the backing file's size and notify the guest of the new capacity.
+func (c *fcClient) updateDrivePath(driveID, pathOnHost string) error {
+	return c.doJSON(http.MethodPatch, "/drives/"+driveID, map[string]string{
+		"drive_id":     driveID,
+		"path_on_host": pathOnHost,
 	})
 }
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const maxForkCount = 32
+
+type forkRequest struct {
+	Count int `json:"count"`
+
+	// Applied to every fork, like the same fields on /create. Forks start with
+	// the source's labels plus these.
+	TTLSeconds         int64             `json:"ttl_seconds,omitempty"`
+	IdleTimeoutSeconds int64             `json:"idle_timeout_seconds,omitempty"`
+	Labels             map[string]string `json:"labels,omitempty"`
+}
+
+type forkResponse struct {
+	SandboxIDs []string `json:"sandbox_ids"`
+	// Errors lists forks that failed to start when at least one succeeded.
+	Errors []string `json:"errors,omitempty"`
+}
+
+func forksDir(workDir string) string {
+	return filepath.Join(workDir, "forks")
+}
+
+// forkSnapshot is a snapshot taken only to seed forks. The fork request and
+// each restore hold a reference, and the files are removed when the last one
+// is released: restored VMs no longer need them, since their disks are
+// clones and Firecracker keeps its own mapping of the memory file.
+type forkSnapshot struct {
+	dir   string
+	files capturedSandbox
+	refs  atomic.Int32
+}
+
+func (fs *forkSnapshot) acquire() {
+	fs.refs.Add(1)
+}
+
+func (fs *forkSnapshot) release() {
+	if fs.refs.Add(-1) == 0 {
+		if err := os.RemoveAll(fs.dir); err != nil {
+			log.Printf("remove fork snapshot %s: %v", fs.dir, err)
+		}
+	}
+}
+
+// handleSandboxFork snapshots a running sandbox and restores count copies of
+// it in parallel. The source is paused only while the snapshot is taken.
+func (s *server) handleSandboxFork(w http.ResponseWriter, r *http.Request) {
+	var req forkRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if req.Count < 1 || req.Count > maxForkCount {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("count must be between 1 and %d", maxForkCount)})
+		return
+	}
+	ttl, idleTimeout, err := sandboxTimeouts(s.cfg, req.TTLSeconds, req.IdleTimeoutSeconds)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := validateLabels(req.Labels); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	src := s.sandboxes[r.PathValue("id")]
+	s.mu.Unlock()
+	if src == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "sandbox not found"})
+		return
+	}
+	// Keep the source from being destroyed while it is captured.
+	if err := src.tryStartExec(); err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	start := time.Now()
+	snap, err := s.captureForkSnapshot(src)
+	src.finishExec()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	captured := time.Since(start)
+
+	spec := sandboxSpec{Shape: machineShape{VCPU: src.VCPU, MemMiB: src.MemMiB}}
+	labels := mergeLabels(src.Labels, req.Labels)
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		ids  = make([]string, req.Count)
+		errs []string
+	)
+	for i := range req.Count {
+		id := fmt.Sprintf("sb-%d", atomic.AddUint64(&s.nextSandboxID, 1))
+		snap.acquire()
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer snap.release()
+			sb, _, err := s.restoreSandboxFromArtifacts(
+				id,
+				time.Now(),
+				spec,
+				snap.files.DiskFile,
+				snap.files.StateFile,
+				snap.files.MemFile,
+				"clone fork snapshot disk",
+				false,
+				false,
+			)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				log.Printf("fork %s -> %s failed: %v", src.ID, id, err)
+				errs = append(errs, fmt.Sprintf("%s: %v", id, err))
+				return
+			}
+			sb.Source = sandboxSource{Type: sandboxSourceFork, SandboxID: src.ID}
+			sb.LineageID = src.LineageID
+			sb.Labels = labels
+			sb.setExpiry(ttl, idleTimeout)
+			s.persistSandbox(sb)
+			s.mu.Lock()
+			s.sandboxes[sb.ID] = sb
+			s.mu.Unlock()
+			ids[i] = sb.ID
+		}()
+	}
+	snap.release()
+	wg.Wait()
+	started := ids[:0]
+	for _, id := range ids {
+		if id != "" {
+			started = append(started, id)
+		}
+	}
+
+	if s.cfg.EnableStageTimingLogs {
+		log.Printf("fork timing: source=%s count=%d snapshot=%s total=%s", src.ID, req.Count, captured, time.Since(start))
+	}
+	sort.Strings(errs)
+	if len(started) == 0 {
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"error": "all forks failed", "errors": errs})
+		return
+	}
+	writeJSON(w, http.StatusOK, forkResponse{SandboxIDs: started, Errors: errs})
+}
+
+// captureForkSnapshot snapshots src into a fresh dir under forksDir. The
+// returned snapshot holds one reference for the caller.
+func (s *server) captureForkSnapshot(src *sandbox) (*forkSnapshot, error) {
+	if err := os.MkdirAll(forksDir(s.cfg.WorkDir), 0o755); err != nil {
+		return nil, fmt.Errorf("create forks dir: %w", err)
+	}
+	dir, err := os.MkdirTemp(forksDir(s.cfg.WorkDir), src.ID+"-")
+	if err != nil {
+		return nil, fmt.Errorf("create fork snapshot dir: %w", err)
+	}
+	files, err := s.captureSandbox(src, dir, "", false, nil)
+	if err != nil {
+		_ = os.RemoveAll(dir)
+		return nil, err
+	}
+	snap := &forkSnapshot{dir: dir, files: files}
+	snap.refs.Store(1)
+	return snap, nil
+}
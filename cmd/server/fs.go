@@ -0,0 +1,201 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"manta/internal/agentrpc"
+)
+
+// Filesystem metadata requests are small single-frame agent calls, so they go
+// over the shared agent connection rather than a dedicated one.
+
+type fsEntry struct {
+	Name          string `json:"name"`
+	Path          string `json:"path"`
+	Type          string `json:"type"`
+	Size          int64  `json:"size"`
+	Mode          string `json:"mode"` // octal permission bits, e.g. "0755"
+	ModTimeUnixMs int64  `json:"mod_time_unix_ms"`
+	LinkTarget    string `json:"link_target,omitempty"`
+}
+
+type fsListResponse struct {
+	Path      string    `json:"path"`
+	Entries   []fsEntry `json:"entries"`
+	Truncated bool      `json:"truncated"`
+}
+
+type fsMkdirRequest struct {
+	Path    string `json:"path"`
+	Mode    string `json:"mode,omitempty"` // octal, default "0755"
+	Parents bool   `json:"parents,omitempty"`
+}
+
+type fsRemoveRequest struct {
+	Path      string `json:"path"`
+	Recursive bool   `json:"recursive,omitempty"`
+}
+
+type fsRenameRequest struct {
+	Path      string `json:"path"`
+	NewPath   string `json:"new_path"`
+	Overwrite bool   `json:"overwrite,omitempty"`
+}
+
+func newFSEntry(fi agentrpc.FileInfo) fsEntry {
+	return fsEntry{
+		Name:          fi.Name,
+		Path:          fi.Path,
+		Type:          fi.Type,
+		Size:          fi.Size,
+		Mode:          fmt.Sprintf("%04o", fi.Mode),
+		ModTimeUnixMs: fi.ModTimeUnixMs,
+		LinkTarget:    fi.LinkTarget,
+	}
+}
+
+// cleanBodyPath validates a guest path given in a JSON body, like
+// guestPathParam does for ?path=.
+func cleanBodyPath(field, p string) (string, error) {
+	if p == "" {
+		return "", fmt.Errorf("%s is required", field)
+	}
+	if !strings.HasPrefix(p, "/") {
+		return "", fmt.Errorf("%s must be absolute", field)
+	}
+	return path.Clean(p), nil
+}
+
+func (s *server) handleFSList(w http.ResponseWriter, r *http.Request) {
+	guestPath, err := guestPathParam(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	var limit int
+	if raw := strings.TrimSpace(r.URL.Query().Get("limit")); raw != "" {
+		limit, err = strconv.Atoi(raw)
+		if err != nil || limit < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid limit"})
+			return
+		}
+	}
+
+	resp, ok := s.fsCall(w, r, "fs_list", &agentrpc.FSRequest{Path: guestPath, Limit: limit})
+	if !ok {
+		return
+	}
+	if resp.FS == nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "agent returned no listing"})
+		return
+	}
+	out := fsListResponse{Path: guestPath, Entries: []fsEntry{}, Truncated: resp.FS.Truncated}
+	for _, e := range resp.FS.Entries {
+		out.Entries = append(out.Entries, newFSEntry(e))
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *server) handleFSStat(w http.ResponseWriter, r *http.Request) {
+	guestPath, err := guestPathParam(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	s.fsEntryCall(w, r, "fs_stat", &agentrpc.FSRequest{Path: guestPath})
+}
+
+func (s *server) handleFSMkdir(w http.ResponseWriter, r *http.Request) {
+	var req fsMkdirRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	guestPath, err := cleanBodyPath("path", req.Path)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	fsReq := &agentrpc.FSRequest{Path: guestPath, Parents: req.Parents}
+	if req.Mode != "" {
+		v, err := strconv.ParseUint(req.Mode, 8, 32)
+		if err != nil || v > 0o7777 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid mode"})
+			return
+		}
+		mode := uint32(v)
+		fsReq.Mode = &mode
+	}
+	s.fsEntryCall(w, r, "fs_mkdir", fsReq)
+}
+
+func (s *server) handleFSRemove(w http.ResponseWriter, r *http.Request) {
+	var req fsRemoveRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	guestPath, err := cleanBodyPath("path", req.Path)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if _, ok := s.fsCall(w, r, "fs_remove", &agentrpc.FSRequest{Path: guestPath, Recursive: req.Recursive}); !ok {
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+func (s *server) handleFSRename(w http.ResponseWriter, r *http.Request) {
+	var req fsRenameRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	guestPath, err := cleanBodyPath("path", req.Path)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	newPath, err := cleanBodyPath("new_path", req.NewPath)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	s.fsEntryCall(w, r, "fs_rename", &agentrpc.FSRequest{Path: guestPath, NewPath: newPath, Overwrite: req.Overwrite})
+}
+
+// fsEntryCall runs a filesystem request answered by a single entry and writes
+// that entry.
+func (s *server) fsEntryCall(w http.ResponseWriter, r *http.Request, typ string, freq *agentrpc.FSRequest) {
+	resp, ok := s.fsCall(w, r, typ, freq)
+	if !ok {
+		return
+	}
+	if resp.File == nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "agent returned no file info"})
+		return
+	}
+	writeJSON(w, http.StatusOK, newFSEntry(*resp.File))
+}
+
+// fsCall runs a filesystem request against the sandbox in the path. On
+// failure it has already written the error response.
+func (s *server) fsCall(w http.ResponseWriter, r *http.Request, typ string, freq *agentrpc.FSRequest) (agentrpc.Response, bool) {
+	sb, ok := s.acquireSandbox(w, r.PathValue("id"), "filesystem requests")
+	if !ok {
+		return agentrpc.Response{}, false
+	}
+	defer sb.finishExec()
+
+	resp, err := s.callAgent(sb, agentrpc.Request{Type: typ, FS: freq}, s.cfg.AgentCallTimeout)
+	if err != nil {
+		writeAgentError(w, err)
+		return agentrpc.Response{}, false
+	}
+	return resp, true
+}
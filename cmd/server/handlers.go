@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net/http"
+	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
@@ -14,20 +18,67 @@ import (
 
 const destroyExecDrainTimeout = 2 * time.Second
 
-func (s *server) handleCreate(w http.ResponseWriter, _ *http.Request) {
+var errSandboxClosing = errors.New("sandbox is closing")
+
+// destroySandbox tears down a sandbox the caller has already removed from
+// s.sandboxes. In-flight execs get destroyExecDrainTimeout to finish first.
+func (s *server) destroySandbox(sb *sandbox) error {
+	if !sb.beginDestroy() {
+		return errSandboxClosing
+	}
+	defer sb.finishDestroy()
+	if !sb.waitForExecDrain(destroyExecDrainTimeout) {
+		log.Printf("destroy %s proceeding with %d in-flight exec(s) after %s drain timeout", sb.ID, sb.currentInFlightExec(), destroyExecDrainTimeout)
+	}
+	return s.cleanupSandbox(sb)
+}
+
+func (s *server) handleCreate(w http.ResponseWriter, r *http.Request) {
+	// The body is optional; without one the sandbox gets the default size.
+	var req createRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r.Body, &req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+			return
+		}
+	}
+	spec, err := resolveSandboxSpec(s.cfg, req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	ttl, idleTimeout, err := sandboxTimeouts(s.cfg, req.TTLSeconds, req.IdleTimeoutSeconds)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := validateLabels(req.Labels); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
 	id := fmt.Sprintf("sb-%d", atomic.AddUint64(&s.nextSandboxID, 1))
-	sb, err := s.createSandbox(id)
+	sb, err := s.createSandbox(id, spec)
 	if err != nil {
 		log.Printf("create %s failed: %v", id, err)
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		return
 	}
 
+	sb.Labels = mergeLabels(nil, req.Labels)
+	sb.setExpiry(ttl, idleTimeout)
+	s.persistSandbox(sb)
 	s.mu.Lock()
 	s.sandboxes[sb.ID] = sb
 	s.mu.Unlock()
 
-	writeJSON(w, http.StatusOK, createResponse{SandboxID: sb.ID})
+	writeJSON(w, http.StatusOK, createResponse{
+		SandboxID: sb.ID,
+		VCPU:      sb.VCPU,
+		MemMiB:    sb.MemMiB,
+		DiskMiB:   sb.DiskMiB,
+		ExpiresAt: formatExpiry(sb.expiresAt()),
+	})
 }
 
 func (s *server) handleExec(w http.ResponseWriter, r *http.Request) {
@@ -41,6 +92,10 @@ func (s *server) handleExec(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "sandbox_id is required"})
 		return
 	}
+	if err := validateExecID(req.ExecID); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
 
 	s.mu.Lock()
 	sb := s.sandboxes[req.SandboxID]
@@ -50,8 +105,7 @@ func (s *server) handleExec(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusNotFound, map[string]string{"error": "sandbox not found"})
 		return
 	}
-	if err := sb.tryStartExec(); err != nil {
-		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+	if !s.startExec(w, sb, req.AutoResume) {
 		return
 	}
 	defer sb.finishExec()
@@ -61,27 +115,18 @@ func (s *server) handleExec(w http.ResponseWriter, r *http.Request) {
 		timeout = time.Duration(req.TimeoutMs) * time.Millisecond
 	}
 
-	cmd := strings.TrimSpace(req.Cmd)
-	useShell := false
-	switch {
-	case len(req.Argv) > 0:
-		if cmd != "" {
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "provide either cmd or argv, not both"})
-			return
-		}
-		useShell = false
-		if req.UseShell != nil && *req.UseShell {
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "use_shell=true is not valid with argv"})
-			return
-		}
-	case cmd != "":
-		useShell = true
-		if req.UseShell != nil && !*req.UseShell {
-			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "use_shell=false is not valid with cmd; provide argv instead"})
-			return
-		}
-	default:
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "cmd or argv is required"})
+	cmd, useShell, err := resolveExecCommand(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if req.StdinStream {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "stdin_stream is only supported on /exec/stream"})
+		return
+	}
+	agentReq, err := newAgentExecRequest(req, cmd, useShell, timeout)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
 
@@ -91,6 +136,10 @@ func (s *server) handleExec(w http.ResponseWriter, r *http.Request) {
 			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "ssh transport only supports cmd (shell mode)"})
 			return
 		}
+		if req.Cwd != "" || len(req.Env) > 0 || req.User != "" || req.UID != nil || req.GID != nil || req.ExecID != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "ssh transport does not support cwd, env, user, uid, gid or exec_id"})
+			return
+		}
 
 		sshClient, err := waitForExecSSH(sb.GuestIP, s.cfg.SSHPrivateKey, s.cfg.SSHExecWait, s.cfg.SSHDialTimeout)
 		if err != nil {
@@ -105,6 +154,9 @@ func (s *server) handleExec(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 		defer session.Close()
+		if len(req.Stdin) > 0 {
+			session.Stdin = bytes.NewReader(req.Stdin)
+		}
 
 		var stdout, stderr bytes.Buffer
 		exitCode, err := runSSHCommand(session, cmd, &stdout, &stderr, timeout)
@@ -122,74 +174,130 @@ func (s *server) handleExec(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	sb.agentMu.Lock()
-	defer sb.agentMu.Unlock()
+	es := &execSession{ID: req.ExecID, SandboxID: sb.ID, sb: sb}
+	if err := s.registerExecSession(es); err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	defer s.unregisterExecSession(es)
 
-	// Prefer a persistent agent connection, but transparently redial if needed.
-	ac := sb.Agent
-	if ac == nil {
-		newAC, err := dialAgent(sb.VsockPath, s.cfg.AgentPort, s.cfg.AgentDialTimeout)
-		if err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent dial failed: %v", err)})
-			return
+	// Nothing is left to read the output once the client goes away, so kill
+	// the command rather than letting it run to its timeout.
+	stop := context.AfterFunc(r.Context(), func() {
+		if err := s.signalExec(sb, es.ID, "SIGKILL"); err != nil {
+			log.Printf("cancel exec %s: %v", es.ID, err)
 		}
-		sb.Agent = newAC
-		ac = newAC
-	}
-
-	resp, err := ac.Call(agentrpc.Request{
-		Type: "exec",
-		Exec: &agentrpc.ExecRequest{
-			UseShell:       useShell,
-			Cmd:            cmd,
-			Argv:           req.Argv,
-			TimeoutMs:      timeout.Milliseconds(),
-			MaxOutputBytes: s.cfg.AgentMaxOutputB,
-		},
-	}, s.cfg.AgentCallTimeout)
-	if err != nil {
-		// Retry once on likely broken connection.
-		_ = ac.Close()
-		sb.Agent = nil
+	})
+	defer stop()
 
-		newAC, derr := dialAgent(sb.VsockPath, s.cfg.AgentPort, s.cfg.AgentDialTimeout)
-		if derr != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent dial failed: %v (original error: %v)", derr, err)})
-			return
-		}
-		sb.Agent = newAC
-
-		resp, err = newAC.Call(agentrpc.Request{
-			Type: "exec",
-			Exec: &agentrpc.ExecRequest{
-				UseShell:       useShell,
-				Cmd:            cmd,
-				Argv:           req.Argv,
-				TimeoutMs:      timeout.Milliseconds(),
-				MaxOutputBytes: s.cfg.AgentMaxOutputB,
-			},
-		}, s.cfg.AgentCallTimeout)
-		if err != nil {
-			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent exec failed: %v", err)})
-			return
-		}
+	agentReq.ExecID = es.ID
+	agentReq.MaxOutputBytes = s.cfg.AgentMaxOutputB
+	resp, err := s.callAgent(sb, agentrpc.Request{Type: "exec", Exec: agentReq}, s.cfg.AgentCallTimeout)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent exec failed: %v", err)})
+		return
 	}
 
 	writeJSON(w, http.StatusOK, execResponse{
+		ExecID:   es.ID,
 		Stdout:   resp.Exec.Stdout,
 		Stderr:   resp.Exec.Stderr,
 		ExitCode: resp.Exec.ExitCode,
 	})
 }
 
+// acquireSandbox looks up the sandbox for an agent-only feature (named in
+// plural for the error message) and registers the request as in-flight work.
+// The caller must call sb.finishExec when ok.
+func (s *server) acquireSandbox(w http.ResponseWriter, id, feature string) (*sandbox, bool) {
+	if s.cfg.ExecTransport != "agent" && s.cfg.ExecTransport != "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": feature + " require the agent transport"})
+		return nil, false
+	}
+	s.mu.Lock()
+	sb := s.sandboxes[id]
+	s.mu.Unlock()
+	if sb == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "sandbox not found"})
+		return nil, false
+	}
+	if err := sb.tryStartExec(); err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return nil, false
+	}
+	return sb, true
+}
+
+// resolveExecCommand validates the cmd/argv/use_shell combination of an exec
+// request and reports whether the command runs through the shell.
+func resolveExecCommand(req execRequest) (string, bool, error) {
+	cmd := strings.TrimSpace(req.Cmd)
+	switch {
+	case len(req.Argv) > 0:
+		if cmd != "" {
+			return "", false, fmt.Errorf("provide either cmd or argv, not both")
+		}
+		if req.UseShell != nil && *req.UseShell {
+			return "", false, fmt.Errorf("use_shell=true is not valid with argv")
+		}
+		return "", false, nil
+	case cmd != "":
+		if req.UseShell != nil && !*req.UseShell {
+			return "", false, fmt.Errorf("use_shell=false is not valid with cmd; provide argv instead")
+		}
+		return cmd, true, nil
+	default:
+		return "", false, fmt.Errorf("cmd or argv is required")
+	}
+}
+
+// newAgentExecRequest validates the process options of an exec request (cwd,
+// env, identity) and builds the agent request for it.
+func newAgentExecRequest(req execRequest, cmd string, useShell bool, timeout time.Duration) (*agentrpc.ExecRequest, error) {
+	env := make([]string, 0, len(req.Env))
+	for k, v := range req.Env {
+		if k == "" || strings.ContainsAny(k, "=\x00") || strings.ContainsRune(v, 0) {
+			return nil, fmt.Errorf("invalid env entry %q", k)
+		}
+		env = append(env, k+"="+v)
+	}
+	sort.Strings(env)
+
+	user := strings.TrimSpace(req.User)
+	if user != "" && req.UID != nil {
+		return nil, fmt.Errorf("provide either user or uid, not both")
+	}
+
+	return &agentrpc.ExecRequest{
+		UseShell:  useShell,
+		Cmd:       cmd,
+		Argv:      req.Argv,
+		Cwd:       strings.TrimSpace(req.Cwd),
+		Env:       env,
+		User:      user,
+		UID:       req.UID,
+		GID:       req.GID,
+		Stdin:     req.Stdin,
+		TimeoutMs: timeout.Milliseconds(),
+	}, nil
+}
+
 func (s *server) handleDestroy(w http.ResponseWriter, r *http.Request) {
 	var req destroyRequest
 	if err := decodeJSON(r.Body, &req); err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
 		return
 	}
+	if strings.TrimSpace(req.Selector) != "" {
+		if strings.TrimSpace(req.SandboxID) != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "sandbox_id and selector are mutually exclusive"})
+			return
+		}
+		s.destroyBySelector(w, req.Selector)
+		return
+	}
 	if strings.TrimSpace(req.SandboxID) == "" {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "sandbox_id is required"})
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "sandbox_id or selector is required"})
 		return
 	}
 
@@ -202,19 +310,65 @@ func (s *server) handleDestroy(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusNotFound, map[string]string{"error": "sandbox not found"})
 		return
 	}
-	if !sb.beginDestroy() {
-		writeJSON(w, http.StatusConflict, map[string]string{"error": "sandbox is closing"})
+	if err := s.destroySandbox(sb); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errSandboxClosing) {
+			status = http.StatusConflict
+		}
+		writeJSON(w, status, map[string]string{"error": err.Error()})
 		return
 	}
-	defer sb.finishDestroy()
-	if !sb.waitForExecDrain(destroyExecDrainTimeout) {
-		log.Printf("destroy %s proceeding with %d in-flight exec(s) after %s drain timeout", sb.ID, sb.currentInFlightExec(), destroyExecDrainTimeout)
-	}
 
-	if err := s.cleanupSandbox(sb); err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+	writeJSON(w, http.StatusOK, destroyResponse{Status: "ok", Destroyed: []string{sb.ID}})
+}
+
+// destroyBySelector destroys every sandbox whose labels match raw, in
+// parallel. Sandboxes that fail to clean up are still removed from the map,
+// as with a single /destroy.
+func (s *server) destroyBySelector(w http.ResponseWriter, raw string) {
+	sel, err := parseLabelSelector(raw)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
 
-	writeJSON(w, http.StatusOK, destroyResponse{Status: "ok"})
+	s.mu.Lock()
+	var matched []*sandbox
+	for id, sb := range s.sandboxes {
+		if sel.matches(sb.Labels) {
+			matched = append(matched, sb)
+			delete(s.sandboxes, id)
+		}
+	}
+	s.mu.Unlock()
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		destroyed = []string{}
+		errs      []string
+	)
+	for _, sb := range matched {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := s.destroySandbox(sb)
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("%s: %v", sb.ID, err))
+				return
+			}
+			destroyed = append(destroyed, sb.ID)
+		}()
+	}
+	wg.Wait()
+	sort.Strings(destroyed)
+
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		writeJSON(w, http.StatusInternalServerError, map[string]any{"error": strings.Join(errs, "; "), "destroyed": destroyed})
+		return
+	}
+	writeJSON(w, http.StatusOK, destroyResponse{Status: "ok", Destroyed: destroyed})
 }
@@ -2,10 +2,14 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"time"
+
+	"manta/internal/agentrpc"
 )
 
 func decodeJSON(r io.Reader, dst any) error {
@@ -22,6 +26,27 @@ func writeJSON(w http.ResponseWriter, status int, payload any) {
 	}
 }
 
+// writeAgentError maps a failed agent call onto an HTTP status: classified
+// agent failures get a matching status, other agent-reported errors are the
+// caller's fault, and transport failures are 500.
+func writeAgentError(w http.ResponseWriter, err error) {
+	var callErr *agentCallError
+	if !errors.As(err, &callErr) {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent call failed: %v", err)})
+		return
+	}
+	status := http.StatusBadRequest
+	switch callErr.code {
+	case agentrpc.CodeNotFound:
+		status = http.StatusNotFound
+	case agentrpc.CodeExists:
+		status = http.StatusConflict
+	case agentrpc.CodePermission:
+		status = http.StatusForbidden
+	}
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
 func loggingMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
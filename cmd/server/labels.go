@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"regexp"
+	"strings"
+)
+
+const (
+	maxLabels          = 64
+	maxLabelValueBytes = 256
+)
+
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9._/-]{0,126}[A-Za-z0-9])?$`)
+
+// validateLabels checks user-supplied labels. Keys are 1-128 characters of
+// letters, digits, '.', '_', '-' and '/', starting and ending alphanumeric;
+// values are free-form up to maxLabelValueBytes without ',' so that every
+// label can be written as a selector.
+func validateLabels(labels map[string]string) error {
+	if len(labels) > maxLabels {
+		return fmt.Errorf("at most %d labels are allowed", maxLabels)
+	}
+	for k, v := range labels {
+		if !labelKeyPattern.MatchString(k) {
+			return fmt.Errorf("invalid label key %q", k)
+		}
+		if len(v) > maxLabelValueBytes || strings.ContainsAny(v, ",=!") {
+			return fmt.Errorf("invalid value for label %q", k)
+		}
+	}
+	return nil
+}
+
+// mergeLabels returns base overlaid with override, or nil if both are empty.
+func mergeLabels(base, override map[string]string) map[string]string {
+	if len(base) == 0 && len(override) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(base)+len(override))
+	maps.Copy(out, base)
+	maps.Copy(out, override)
+	return out
+}
+
+type labelRequirement struct {
+	key   string
+	op    string // "=", "!=", "exists", "!exists"
+	value string
+}
+
+// labelSelector is a comma-separated list of requirements that must all hold:
+// "key=value", "key!=value", "key" (label present) or "!key" (label absent).
+// The zero selector matches everything.
+type labelSelector []labelRequirement
+
+func parseLabelSelector(raw string) (labelSelector, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return nil, nil
+	}
+	var sel labelSelector
+	for _, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		var req labelRequirement
+		switch {
+		case strings.Contains(part, "!="):
+			k, v, _ := strings.Cut(part, "!=")
+			req = labelRequirement{key: strings.TrimSpace(k), op: "!=", value: strings.TrimSpace(v)}
+		case strings.Contains(part, "="):
+			k, v, _ := strings.Cut(part, "=")
+			req = labelRequirement{key: strings.TrimSpace(k), op: "=", value: strings.TrimSpace(strings.TrimPrefix(v, "="))}
+		case strings.HasPrefix(part, "!"):
+			req = labelRequirement{key: strings.TrimSpace(part[1:]), op: "!exists"}
+		default:
+			req = labelRequirement{key: part, op: "exists"}
+		}
+		if !labelKeyPattern.MatchString(req.key) {
+			return nil, fmt.Errorf("invalid selector %q", part)
+		}
+		sel = append(sel, req)
+	}
+	return sel, nil
+}
+
+func (sel labelSelector) matches(labels map[string]string) bool {
+	for _, req := range sel {
+		v, ok := labels[req.key]
+		switch req.op {
+		case "=":
+			if !ok || v != req.value {
+				return false
+			}
+		case "!=":
+			if ok && v == req.value {
+				return false
+			}
+		case "exists":
+			if !ok {
+				return false
+			}
+		case "!exists":
+			if ok {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"manta/internal/agentrpc"
+)
+
+const mib = 1 << 20
+
+// machineShape is the part of a sandbox's size that a Firecracker snapshot
+// fixes. Each shape gets its own golden snapshot.
+type machineShape struct {
+	VCPU   int
+	MemMiB int
+}
+
+// key names the shape's golden snapshot directory.
+func (m machineShape) key() string {
+	return fmt.Sprintf("%dvcpu-%dmib", m.VCPU, m.MemMiB)
+}
+
+func defaultShape(cfg config) machineShape {
+	return machineShape{VCPU: cfg.DefaultVCPU, MemMiB: cfg.DefaultMemMiB}
+}
+
+// sandboxSpec is the validated size of a sandbox to create.
+type sandboxSpec struct {
+	Shape machineShape
+	// DiskMiB grows the rootfs clone to this size before boot; 0 keeps the
+	// source image size.
+	DiskMiB int
+}
+
+// resolveSandboxSpec applies defaults to a /create body and checks it against
+// the configured limits.
+func resolveSandboxSpec(cfg config, req createRequest) (sandboxSpec, error) {
+	spec := sandboxSpec{Shape: defaultShape(cfg), DiskMiB: req.DiskMiB}
+	if req.VCPU != 0 {
+		if req.VCPU < cfg.MinVCPU || req.VCPU > cfg.MaxVCPU {
+			return spec, fmt.Errorf("vcpu must be between %d and %d", cfg.MinVCPU, cfg.MaxVCPU)
+		}
+		spec.Shape.VCPU = req.VCPU
+	}
+	if req.MemMiB != 0 {
+		if req.MemMiB < cfg.MinMemMiB || req.MemMiB > cfg.MaxMemMiB {
+			return spec, fmt.Errorf("mem_mib must be between %d and %d", cfg.MinMemMiB, cfg.MaxMemMiB)
+		}
+		spec.Shape.MemMiB = req.MemMiB
+	}
+	if req.DiskMiB != 0 {
+		st, err := os.Stat(cfg.BaseRootfsPath)
+		if err != nil {
+			return spec, fmt.Errorf("stat base rootfs: %w", err)
+		}
+		minDisk := int((st.Size() + mib - 1) / mib)
+		if req.DiskMiB < minDisk || req.DiskMiB > cfg.MaxDiskMiB {
+			return spec, fmt.Errorf("disk_mib must be between %d (the base image size) and %d", minDisk, cfg.MaxDiskMiB)
+		}
+	}
+	return spec, nil
+}
+
+// growRootfs extends a rootfs image file to diskMiB. The new space is sparse;
+// the guest filesystem is grown to fill it by resizeGuestRootfs after boot.
+// It reports whether the file grew.
+func growRootfs(path string, diskMiB int) (bool, error) {
+	if diskMiB <= 0 {
+		return false, nil
+	}
+	st, err := os.Stat(path)
+	if err != nil {
+		return false, err
+	}
+	size := int64(diskMiB) * mib
+	if st.Size() >= size {
+		return false, nil
+	}
+	if err := os.Truncate(path, size); err != nil {
+		return false, fmt.Errorf("grow rootfs to %d MiB: %w", diskMiB, err)
+	}
+	return true, nil
+}
+
+// diskSizeMiB reports the size of a rootfs image, rounded down to MiB.
+func diskSizeMiB(path string) int {
+	st, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return int(st.Size() / mib)
+}
+
+// resizeGuestRootfs grows the mounted root filesystem to the size of its
+// block device. ext4 supports growing online.
+func resizeGuestRootfs(ac *agentConn) error {
+	resp, err := ac.Call(agentrpc.Request{
+		Type: "exec",
+		Exec: &agentrpc.ExecRequest{Argv: []string{"resize2fs", "/dev/vda"}, TimeoutMs: 60_000},
+	}, 65*time.Second)
+	if err != nil {
+		return fmt.Errorf("resize guest rootfs: %w", err)
+	}
+	if resp.Exec != nil && resp.Exec.ExitCode != 0 {
+		return fmt.Errorf("resize guest rootfs: resize2fs exited %d: %s", resp.Exec.ExitCode, resp.Exec.Stderr)
+	}
+	return nil
+}
@@ -31,17 +31,24 @@ func main() {
 	srv := &server{
 		cfg:       cfg,
 		sandboxes: make(map[string]*sandbox),
+		execs:     make(map[string]*execSession),
 	}
+	srv.seedUserSnapshotID()
+	go srv.storeCurrentBase()
 
 	// Install one broad NAT rule once; keep it for server lifetime.
 	if err := ensureGlobalMasquerade(cfg.HostNATIface); err != nil {
 		log.Fatalf("ensure global MASQUERADE: %v", err)
 	}
 
+	// Take over sandboxes left running by a previous server process before
+	// the netns pool rebuilds its slots.
+	pooledInUse := srv.recoverSandboxes()
+
 	// Initialize netns pool if enabled.
 	if cfg.NetnsPoolSize > 0 {
 		srv.netnsPool = newNetnsPool(cfg, cfg.NetnsPoolSize)
-		if err := srv.netnsPool.Init(); err != nil {
+		if err := srv.netnsPool.Init(pooledInUse); err != nil {
 			log.Fatalf("init netns pool: %v", err)
 		}
 	}
@@ -49,11 +56,49 @@ func main() {
 	mux := http.NewServeMux()
 	mux.HandleFunc("POST /create", srv.handleCreate)
 	mux.HandleFunc("POST /exec", srv.handleExec)
+	mux.HandleFunc("POST /exec/stream", srv.handleExecStream)
+	mux.HandleFunc("POST /exec/{exec_id}/stdin", srv.handleExecStdin)
+	mux.HandleFunc("POST /exec/{exec_id}/signal", srv.handleExecSignal)
+	mux.HandleFunc("GET /sandboxes", srv.handleSandboxList)
+	mux.HandleFunc("GET /sandboxes/{id}", srv.handleSandboxGet)
+	mux.HandleFunc("POST /sandboxes/{id}/pause", srv.handleSandboxPause)
+	mux.HandleFunc("POST /sandboxes/{id}/resume", srv.handleSandboxResume)
+	mux.HandleFunc("POST /sandboxes/{id}/fork", srv.handleSandboxFork)
+	mux.HandleFunc("POST /sandboxes/{id}/keepalive", srv.handleSandboxKeepalive)
+	mux.HandleFunc("GET /sandboxes/{id}/pty", srv.handleSandboxPTY)
+	mux.HandleFunc("PUT /sandboxes/{id}/files", srv.handleFileUpload)
+	mux.HandleFunc("GET /sandboxes/{id}/files", srv.handleFileDownload)
+	mux.HandleFunc("POST /sandboxes/{id}/archive", srv.handleArchiveImport)
+	mux.HandleFunc("GET /sandboxes/{id}/archive", srv.handleArchiveExport)
+	mux.HandleFunc("GET /sandboxes/{id}/fs/list", srv.handleFSList)
+	mux.HandleFunc("GET /sandboxes/{id}/fs/stat", srv.handleFSStat)
+	mux.HandleFunc("POST /sandboxes/{id}/fs/mkdir", srv.handleFSMkdir)
+	mux.HandleFunc("POST /sandboxes/{id}/fs/remove", srv.handleFSRemove)
+	mux.HandleFunc("POST /sandboxes/{id}/fs/rename", srv.handleFSRename)
+	mux.HandleFunc("GET /sandboxes/{id}/watch", srv.handleWatch)
+	mux.HandleFunc("POST /sandboxes/{id}/processes", srv.handleProcessStart)
+	mux.HandleFunc("GET /sandboxes/{id}/processes", srv.handleProcessList)
+	mux.HandleFunc("GET /sandboxes/{id}/processes/{pid}", srv.handleProcessGet)
+	mux.HandleFunc("GET /sandboxes/{id}/processes/{pid}/logs", srv.handleProcessLogs)
+	mux.HandleFunc("POST /sandboxes/{id}/processes/{pid}/signal", srv.handleProcessSignal)
+	mux.HandleFunc("POST /sandboxes/{id}/processes/{pid}/wait", srv.handleProcessWait)
 	mux.HandleFunc("POST /destroy", srv.handleDestroy)
 	mux.HandleFunc("POST /snapshot/create", srv.handleSnapshotCreate)
 	mux.HandleFunc("POST /snapshot/restore", srv.handleSnapshotRestore)
 	mux.HandleFunc("GET /snapshot/list", srv.handleSnapshotList)
 	mux.HandleFunc("POST /snapshot/delete", srv.handleSnapshotDelete)
+	mux.HandleFunc("POST /snapshot/compact", srv.handleSnapshotCompact)
+	mux.HandleFunc("PATCH /snapshot/{id}", srv.handleSnapshotUpdate)
+	mux.HandleFunc("GET /snapshot/tags", srv.handleSnapshotTagList)
+	mux.HandleFunc("PUT /snapshot/tags/{tag}", srv.handleSnapshotTagPut)
+	mux.HandleFunc("DELETE /snapshot/tags/{tag}", srv.handleSnapshotTagDelete)
+	mux.HandleFunc("GET /snapshot/{id}/export", srv.handleSnapshotExport)
+	mux.HandleFunc("GET /snapshot/{id}/lineage", srv.handleSnapshotLineage)
+	mux.HandleFunc("POST /snapshot/{id}/verify", srv.handleSnapshotVerify)
+	mux.HandleFunc("POST /snapshot/import", srv.handleSnapshotImport)
+	mux.HandleFunc("GET /bases", srv.handleBaseList)
+	mux.HandleFunc("PUT /bases/{lineage_id}", srv.handleBaseUpload)
+	mux.HandleFunc("GET /operations/{id}", srv.handleOperationGet)
 	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, _ *http.Request) {
 		writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
 	})
@@ -64,6 +109,9 @@ func main() {
 		ReadHeaderTimeout: 5 * time.Second,
 	}
 
+	stopReaper := srv.startReaper()
+	stopSnapshotGC := srv.startSnapshotGC()
+
 	go func() {
 		log.Printf("server listening on %s", cfg.ListenAddr)
 		if err := httpServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
@@ -82,6 +130,14 @@ func main() {
 	if err := httpServer.Shutdown(ctx); err != nil {
 		log.Printf("http shutdown error: %v", err)
 	}
+	stopReaper()
+	stopSnapshotGC()
+	if cfg.RecoverSandboxes {
+		// Leave sandboxes and their netns slots in place for the next server
+		// process to adopt.
+		srv.persistAll()
+		return
+	}
 	if srv.netnsPool != nil {
 		srv.netnsPool.Destroy()
 	}
@@ -12,22 +12,22 @@ import (
 )
 
 type netnsConfig struct {
-	NetnsName string
-	Subnet    int
-	Pooled    bool
+	NetnsName string `json:"netns_name"`
+	Subnet    int    `json:"subnet"`
+	Pooled    bool   `json:"pooled,omitempty"`
 
 	// Link between root netns and per-sandbox netns.
-	VethHost   string
-	VethNS     string
-	VethCIDR   string
-	VethHostIP string
-	VethNSIP   string
+	VethHost   string `json:"veth_host"`
+	VethNS     string `json:"veth_ns"`
+	VethCIDR   string `json:"veth_cidr"`
+	VethHostIP string `json:"veth_host_ip"`
+	VethNSIP   string `json:"veth_ns_ip"`
 
 	// Guest subnet (tap<->guest) inside the sandbox netns.
-	TapName    string
-	SubnetCIDR string
-	HostIP     string
-	GuestIP    string
+	TapName    string `json:"tap_name"`
+	SubnetCIDR string `json:"subnet_cidr"`
+	HostIP     string `json:"host_ip"`
+	GuestIP    string `json:"guest_ip"`
 }
 
 func netnsNameForSandbox(id string) string {
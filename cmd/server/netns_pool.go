@@ -26,11 +26,21 @@ func newNetnsPool(cfg config, size int) *netnsPool {
 	}
 }
 
-func (p *netnsPool) Init() error {
+// Init builds the pool's slots. Slots in inUse belong to sandboxes recovered
+// from a previous run; they are kept as they are and join the pool when those
+// sandboxes are destroyed.
+func (p *netnsPool) Init(inUse map[int]*netnsConfig) error {
 	var initErr error
 	p.once.Do(func() {
 		start := time.Now()
 		for i := 1; i <= p.size; i++ {
+			if nc := inUse[i]; nc != nil {
+				p.mu.Lock()
+				p.all = append(p.all, nc)
+				p.mu.Unlock()
+				continue
+			}
+
 			// Use stable pool names; each entry owns its subnet.
 			id := fmt.Sprintf("pool-%03d", i)
 
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// Long-running requests can run as operations: the request returns an
+// operation ID at once and GET /operations/{id} reports progress and the
+// result. Operations live in memory only and are forgotten
+// operationRetention after they finish.
+const operationRetention = time.Hour
+
+const (
+	operationRunning   = "running"
+	operationSucceeded = "succeeded"
+	operationFailed    = "failed"
+)
+
+type operation struct {
+	ID        string
+	Type      string
+	CreatedAt time.Time
+
+	done  atomic.Int64
+	total atomic.Int64
+
+	mu         sync.Mutex
+	status     string
+	phase      string
+	result     any
+	err        string
+	finishedAt time.Time
+}
+
+type operationInfo struct {
+	OperationID   string `json:"operation_id"`
+	Type          string `json:"type"`
+	Status        string `json:"status"`
+	Phase         string `json:"phase,omitempty"`
+	ProgressBytes int64  `json:"progress_bytes"`
+	TotalBytes    int64  `json:"total_bytes,omitempty"`
+	Result        any    `json:"result,omitempty"`
+	Error         string `json:"error,omitempty"`
+	CreatedAt     string `json:"created_at"`
+	FinishedAt    string `json:"finished_at,omitempty"`
+}
+
+// operations is the server's registry of operations; the zero value is ready
+// to use.
+type operations struct {
+	mu   sync.Mutex
+	next uint64
+	byID map[string]*operation
+}
+
+func (ops *operations) start(typ string) *operation {
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	if ops.byID == nil {
+		ops.byID = map[string]*operation{}
+	}
+	now := time.Now()
+	for id, op := range ops.byID {
+		op.mu.Lock()
+		expired := !op.finishedAt.IsZero() && now.Sub(op.finishedAt) > operationRetention
+		op.mu.Unlock()
+		if expired {
+			delete(ops.byID, id)
+		}
+	}
+	ops.next++
+	op := &operation{ID: fmt.Sprintf("op-%d", ops.next), Type: typ, CreatedAt: now, status: operationRunning}
+	ops.byID[op.ID] = op
+	return op
+}
+
+func (ops *operations) get(id string) *operation {
+	ops.mu.Lock()
+	defer ops.mu.Unlock()
+	return ops.byID[id]
+}
+
+// The progress methods below are no-ops on a nil operation, so code shared
+// with synchronous requests can report unconditionally.
+
+// setPhase starts a new phase expected to process total bytes (0 if
+// unknown), resetting the progress counter.
+func (op *operation) setPhase(phase string, total int64) {
+	if op == nil {
+		return
+	}
+	op.mu.Lock()
+	op.phase = phase
+	op.mu.Unlock()
+	op.done.Store(0)
+	op.total.Store(total)
+}
+
+// Write counts bytes processed in the current phase; it lets an operation
+// sit in an io.MultiWriter next to a hash.
+func (op *operation) Write(p []byte) (int, error) {
+	if op != nil {
+		op.done.Add(int64(len(p)))
+	}
+	return len(p), nil
+}
+
+// trackFile reports the allocated size of path as progress until stopped,
+// for files written by another process (Firecracker, cp).
+func (op *operation) trackFile(path string) (stop func()) {
+	if op == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(250 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				var st unix.Stat_t
+				if unix.Stat(path, &st) == nil {
+					n := st.Blocks * 512
+					if total := op.total.Load(); total > 0 {
+						n = min(n, total)
+					}
+					op.done.Store(n)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+func (op *operation) finish(result any, err error) {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	op.finishedAt = time.Now()
+	if err != nil {
+		op.status = operationFailed
+		op.err = err.Error()
+		return
+	}
+	op.status = operationSucceeded
+	op.result = result
+}
+
+func (op *operation) info() operationInfo {
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	info := operationInfo{
+		OperationID:   op.ID,
+		Type:          op.Type,
+		Status:        op.status,
+		Phase:         op.phase,
+		ProgressBytes: op.done.Load(),
+		TotalBytes:    op.total.Load(),
+		Result:        op.result,
+		Error:         op.err,
+		CreatedAt:     op.CreatedAt.UTC().Format(time.RFC3339Nano),
+	}
+	if !op.finishedAt.IsZero() {
+		info.FinishedAt = op.finishedAt.UTC().Format(time.RFC3339Nano)
+	}
+	return info
+}
+
+func (s *server) handleOperationGet(w http.ResponseWriter, r *http.Request) {
+	op := s.ops.get(r.PathValue("id"))
+	if op == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "operation not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, op.info())
+}
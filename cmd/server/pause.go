@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+var (
+	errSandboxNotPaused     = errors.New("sandbox is not paused")
+	errSandboxAlreadyPaused = errors.New("sandbox is already paused")
+	errSandboxBusy          = errors.New("sandbox has requests in flight")
+)
+
+// beginPause moves a running sandbox with no work in flight to paused, so no
+// new exec can start while Firecracker is pausing it.
+func (sb *sandbox) beginPause() error {
+	sb.lifecycleMu.Lock()
+	defer sb.lifecycleMu.Unlock()
+	switch sb.state {
+	case sandboxStateRunning:
+	case sandboxStatePaused:
+		return errSandboxAlreadyPaused
+	default:
+		return errSandboxClosing
+	}
+	if sb.inFlightExec > 0 {
+		return fmt.Errorf("%w (%d)", errSandboxBusy, sb.inFlightExec)
+	}
+	sb.state = sandboxStatePaused
+	return nil
+}
+
+// setRunning marks a paused sandbox running again; it is a no-op once the
+// sandbox has started closing.
+func (sb *sandbox) setRunning() {
+	sb.lifecycleMu.Lock()
+	defer sb.lifecycleMu.Unlock()
+	if sb.state == sandboxStatePaused {
+		sb.state = sandboxStateRunning
+		sb.lastActivity = time.Now()
+	}
+}
+
+func (sb *sandbox) isPaused() bool {
+	sb.lifecycleMu.Lock()
+	defer sb.lifecycleMu.Unlock()
+	return sb.state == sandboxStatePaused
+}
+
+// pauseSandbox freezes the VM's vCPUs. Guest memory and open agent
+// connections are kept, so resuming picks up where it left off.
+func (s *server) pauseSandbox(sb *sandbox) error {
+	sb.pauseMu.Lock()
+	defer sb.pauseMu.Unlock()
+	if err := sb.beginPause(); err != nil {
+		return err
+	}
+	if err := newFCClient(sb.SocketPath, 10*time.Second).pauseVM(); err != nil {
+		sb.setRunning()
+		return fmt.Errorf("pause vm: %w", err)
+	}
+	s.persistSandbox(sb)
+	return nil
+}
+
+func (s *server) resumeSandbox(sb *sandbox) error {
+	sb.pauseMu.Lock()
+	defer sb.pauseMu.Unlock()
+	if !sb.isPaused() {
+		return errSandboxNotPaused
+	}
+	if err := newFCClient(sb.SocketPath, 10*time.Second).resumeVM(); err != nil {
+		return fmt.Errorf("resume vm: %w", err)
+	}
+	sb.setRunning()
+	s.persistSandbox(sb)
+	return nil
+}
+
+// startExec registers in-flight work like tryStartExec, first resuming the
+// sandbox if it is paused and autoResume is set. It writes the error response
+// itself and reports whether the caller may proceed.
+func (s *server) startExec(w http.ResponseWriter, sb *sandbox, autoResume bool) bool {
+	if autoResume {
+		if err := s.resumeSandbox(sb); err != nil && !errors.Is(err, errSandboxNotPaused) {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return false
+		}
+	}
+	if err := sb.tryStartExec(); err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return false
+	}
+	return true
+}
+
+func (s *server) handleSandboxPause(w http.ResponseWriter, r *http.Request) {
+	s.pauseOrResume(w, r, s.pauseSandbox)
+}
+
+func (s *server) handleSandboxResume(w http.ResponseWriter, r *http.Request) {
+	s.pauseOrResume(w, r, s.resumeSandbox)
+}
+
+func (s *server) pauseOrResume(w http.ResponseWriter, r *http.Request, op func(*sandbox) error) {
+	s.mu.Lock()
+	sb := s.sandboxes[r.PathValue("id")]
+	s.mu.Unlock()
+	if sb == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "sandbox not found"})
+		return
+	}
+	if err := op(sb); err != nil {
+		status := http.StatusInternalServerError
+		for _, conflict := range []error{errSandboxNotPaused, errSandboxAlreadyPaused, errSandboxBusy, errSandboxClosing} {
+			if errors.Is(err, conflict) {
+				status = http.StatusConflict
+			}
+		}
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, sb.info())
+}
@@ -26,6 +26,14 @@ func ensurePreflight(cfg config) error {
 	if err := os.MkdirAll(filepath.Join(cfg.WorkDir, "sandboxes"), 0o755); err != nil {
 		return fmt.Errorf("create work dir: %w", err)
 	}
+	// Fork snapshots only live for the duration of a fork request.
+	if err := os.RemoveAll(forksDir(cfg.WorkDir)); err != nil {
+		return fmt.Errorf("remove leftover fork snapshots: %w", err)
+	}
+	// Likewise for bundles whose import was interrupted.
+	if err := os.RemoveAll(importsDir(cfg.WorkDir)); err != nil {
+		return fmt.Errorf("remove leftover snapshot imports: %w", err)
+	}
 
 	if _, _, err := runCmd("sysctl", "-w", "net.ipv4.ip_forward=1"); err != nil {
 		return fmt.Errorf("enable ip_forward: %w", err)
@@ -38,15 +46,16 @@ func ensurePreflight(cfg config) error {
 	}
 
 	if cfg.EnableCgroups {
+		// Leftover cgroups are scavenged once surviving sandboxes have been
+		// recovered (see recoverSandboxes).
 		if err := ensureCgroupRoot(cfg.CgroupRoot); err != nil {
 			log.Printf("cgroups disabled (falling back to process groups only): %v", err)
-		} else {
-			scavengeCgroups(cfg.CgroupRoot)
 		}
 	}
 
 	if cfg.EnableSnapshots {
-		if _, err := ensureSnapshot(cfg); err != nil {
+		// Other shapes are built on first use.
+		if _, err := ensureSnapshot(cfg, defaultShape(cfg)); err != nil {
 			return fmt.Errorf("ensure snapshot: %w", err)
 		}
 	}
@@ -0,0 +1,246 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"manta/internal/agentrpc"
+)
+
+// defaultProcessWait is how long POST .../wait blocks when timeout_ms is 0.
+const defaultProcessWait = 30 * time.Second
+
+// Background processes live in the agent's process table, not on a host
+// connection, so they keep running after the starting request returns and can
+// be inspected from any later request.
+
+type processStartRequest struct {
+	Cmd      string            `json:"cmd,omitempty"`
+	Argv     []string          `json:"argv,omitempty"`
+	UseShell *bool             `json:"use_shell,omitempty"`
+	Cwd      string            `json:"cwd,omitempty"`
+	Env      map[string]string `json:"env,omitempty"`
+	User     string            `json:"user,omitempty"`
+	UID      *uint32           `json:"uid,omitempty"`
+	GID      *uint32           `json:"gid,omitempty"`
+}
+
+type processSignalRequest struct {
+	Signal string `json:"signal"`
+}
+
+type processWaitRequest struct {
+	TimeoutMs int64 `json:"timeout_ms,omitempty"`
+}
+
+type processInfo struct {
+	ID              string   `json:"id"`
+	PID             int      `json:"pid"`
+	Argv            []string `json:"argv"`
+	Running         bool     `json:"running"`
+	ExitCode        *int     `json:"exit_code,omitempty"`
+	Signal          string   `json:"signal,omitempty"`
+	StartedAtUnixMs int64    `json:"started_at_unix_ms"`
+	ExitedAtUnixMs  int64    `json:"exited_at_unix_ms,omitempty"`
+}
+
+type processListResponse struct {
+	Processes []processInfo `json:"processes"`
+}
+
+type processLogsResponse struct {
+	Data       string `json:"data"`
+	Offset     int64  `json:"offset"`
+	NextOffset int64  `json:"next_offset"`
+	Truncated  bool   `json:"truncated"`
+}
+
+func newProcessInfo(p agentrpc.ProcInfo) processInfo {
+	info := processInfo{
+		ID:              p.ID,
+		PID:             p.PID,
+		Argv:            p.Argv,
+		Running:         p.Running,
+		Signal:          p.Signal,
+		StartedAtUnixMs: p.StartedAtUnixMs,
+		ExitedAtUnixMs:  p.ExitedAtUnixMs,
+	}
+	if !p.Running {
+		exitCode := p.ExitCode
+		info.ExitCode = &exitCode
+	}
+	return info
+}
+
+func (s *server) handleProcessStart(w http.ResponseWriter, r *http.Request) {
+	var req processStartRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	execReq := execRequest{
+		Cmd:      req.Cmd,
+		Argv:     req.Argv,
+		UseShell: req.UseShell,
+		Cwd:      req.Cwd,
+		Env:      req.Env,
+		User:     req.User,
+		UID:      req.UID,
+		GID:      req.GID,
+	}
+	cmd, useShell, err := resolveExecCommand(execReq)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	// Background processes have no timeout; they run until they exit or are
+	// signalled.
+	agentReq, err := newAgentExecRequest(execReq, cmd, useShell, 0)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	sb, ok := s.acquireSandbox(w, r.PathValue("id"), "background processes")
+	if !ok {
+		return
+	}
+	defer sb.finishExec()
+
+	resp, err := s.callAgent(sb, agentrpc.Request{Type: "proc_start", Exec: agentReq}, s.cfg.AgentCallTimeout)
+	if err != nil {
+		writeAgentError(w, err)
+		return
+	}
+	if resp.Proc == nil || resp.Proc.Process == nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "agent returned no process"})
+		return
+	}
+	writeJSON(w, http.StatusOK, newProcessInfo(*resp.Proc.Process))
+}
+
+func (s *server) handleProcessList(w http.ResponseWriter, r *http.Request) {
+	sb, ok := s.acquireSandbox(w, r.PathValue("id"), "background processes")
+	if !ok {
+		return
+	}
+	defer sb.finishExec()
+
+	resp, err := s.callAgent(sb, agentrpc.Request{Type: "proc_list"}, s.cfg.AgentCallTimeout)
+	if err != nil {
+		writeAgentError(w, err)
+		return
+	}
+	out := processListResponse{Processes: []processInfo{}}
+	if resp.Proc != nil {
+		for _, p := range resp.Proc.Processes {
+			out.Processes = append(out.Processes, newProcessInfo(p))
+		}
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *server) handleProcessGet(w http.ResponseWriter, r *http.Request) {
+	s.processCall(w, r, "proc_get", &agentrpc.ProcRequest{ID: r.PathValue("pid")}, s.cfg.AgentCallTimeout)
+}
+
+func (s *server) handleProcessLogs(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	var offset, maxBytes int64
+	var err error
+	if raw := strings.TrimSpace(q.Get("offset")); raw != "" {
+		offset, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || offset < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid offset"})
+			return
+		}
+	}
+	if raw := strings.TrimSpace(q.Get("max_bytes")); raw != "" {
+		maxBytes, err = strconv.ParseInt(raw, 10, 64)
+		if err != nil || maxBytes < 0 {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid max_bytes"})
+			return
+		}
+	}
+	// Keep the response within one agent frame.
+	if limit := s.cfg.AgentMaxOutputB; limit > 0 && (maxBytes == 0 || maxBytes > limit) {
+		maxBytes = limit
+	}
+
+	sb, ok := s.acquireSandbox(w, r.PathValue("id"), "background processes")
+	if !ok {
+		return
+	}
+	defer sb.finishExec()
+
+	resp, err := s.callAgent(sb, agentrpc.Request{
+		Type: "proc_logs",
+		Proc: &agentrpc.ProcRequest{ID: r.PathValue("pid"), Offset: offset, MaxBytes: maxBytes},
+	}, s.cfg.AgentCallTimeout)
+	if err != nil {
+		writeAgentError(w, err)
+		return
+	}
+	if resp.Proc == nil || resp.Proc.Logs == nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "agent returned no logs"})
+		return
+	}
+	logs := resp.Proc.Logs
+	writeJSON(w, http.StatusOK, processLogsResponse{
+		Data:       string(logs.Data),
+		Offset:     logs.Offset,
+		NextOffset: logs.NextOffset,
+		Truncated:  logs.Truncated,
+	})
+}
+
+func (s *server) handleProcessSignal(w http.ResponseWriter, r *http.Request) {
+	var req processSignalRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if strings.TrimSpace(req.Signal) == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "signal is required"})
+		return
+	}
+	s.processCall(w, r, "proc_signal", &agentrpc.ProcRequest{ID: r.PathValue("pid"), Signal: req.Signal}, s.cfg.AgentCallTimeout)
+}
+
+func (s *server) handleProcessWait(w http.ResponseWriter, r *http.Request) {
+	var req processWaitRequest
+	if r.ContentLength != 0 {
+		if err := decodeJSON(r.Body, &req); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+			return
+		}
+	}
+	wait := defaultProcessWait
+	if req.TimeoutMs > 0 {
+		wait = time.Duration(req.TimeoutMs) * time.Millisecond
+	}
+	s.processCall(w, r, "proc_wait", &agentrpc.ProcRequest{ID: r.PathValue("pid"), TimeoutMs: wait.Milliseconds()}, wait+s.cfg.AgentCallTimeout)
+}
+
+// processCall runs a single-process agent request and writes the resulting
+// process state.
+func (s *server) processCall(w http.ResponseWriter, r *http.Request, typ string, preq *agentrpc.ProcRequest, timeout time.Duration) {
+	sb, ok := s.acquireSandbox(w, r.PathValue("id"), "background processes")
+	if !ok {
+		return
+	}
+	defer sb.finishExec()
+
+	resp, err := s.callAgent(sb, agentrpc.Request{Type: typ, Proc: preq}, timeout)
+	if err != nil {
+		writeAgentError(w, err)
+		return
+	}
+	if resp.Proc == nil || resp.Proc.Process == nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": "agent returned no process"})
+		return
+	}
+	writeJSON(w, http.StatusOK, newProcessInfo(*resp.Proc.Process))
+}
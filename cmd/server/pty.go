@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"golang.org/x/net/websocket"
+
+	"manta/internal/agentrpc"
+)
+
+// Terminal WebSocket protocol:
+//
+//   - client -> server binary message: raw terminal input
+//   - client -> server text message: JSON ptyControlMessage
+//   - server -> client binary message: raw terminal output
+//   - server -> client text message: JSON ptyControlMessage of type "exit" or
+//     "error", sent once before the server closes the socket
+type ptyControlMessage struct {
+	Type     string `json:"type"` // "input", "resize", "exit", "error"
+	Data     string `json:"data,omitempty"`
+	Rows     uint16 `json:"rows,omitempty"`
+	Cols     uint16 `json:"cols,omitempty"`
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// wsFrame keeps the payload type alongside the data so binary input can be
+// told apart from text control messages.
+type wsFrame struct {
+	payloadType byte
+	data        []byte
+}
+
+var wsFrameCodec = websocket.Codec{
+	Unmarshal: func(data []byte, payloadType byte, v any) error {
+		f, ok := v.(*wsFrame)
+		if !ok {
+			return fmt.Errorf("unexpected frame target %T", v)
+		}
+		f.payloadType = payloadType
+		f.data = data
+		return nil
+	},
+}
+
+func (s *server) handleSandboxPTY(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	rows, err := parseTermDimension(r.URL.Query().Get("rows"), 24)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid rows: %v", err)})
+		return
+	}
+	cols, err := parseTermDimension(r.URL.Query().Get("cols"), 80)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("invalid cols: %v", err)})
+		return
+	}
+	if s.cfg.ExecTransport != "agent" && s.cfg.ExecTransport != "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "terminal sessions require the agent transport"})
+		return
+	}
+
+	s.mu.Lock()
+	sb := s.sandboxes[id]
+	s.mu.Unlock()
+	if sb == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "sandbox not found"})
+		return
+	}
+	// Terminals count as in-flight execs so /destroy accounts for them.
+	if err := sb.tryStartExec(); err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	defer sb.finishExec()
+
+	// Like /exec/stream, sessions use their own connection for flow control.
+	ac, err := dialAgent(sb.VsockPath, s.cfg.AgentPort, s.cfg.AgentDialTimeout)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent dial failed: %v", err)})
+		return
+	}
+	defer ac.Close()
+
+	st, err := ac.OpenStream(agentrpc.Request{
+		Type: "pty",
+		PTY: &agentrpc.PTYRequest{
+			Cwd:  strings.TrimSpace(r.URL.Query().Get("cwd")),
+			User: strings.TrimSpace(r.URL.Query().Get("user")),
+			Term: strings.TrimSpace(r.URL.Query().Get("term")),
+			Rows: rows,
+			Cols: cols,
+		},
+	}, 0)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent pty failed: %v", err)})
+		return
+	}
+	defer st.Close()
+
+	// Handshake is left nil so non-browser clients without an Origin header are
+	// accepted; the API has no browser-facing auth to protect.
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		relayPTY(ws, sb, ac, st)
+	}}.ServeHTTP(w, r)
+}
+
+// relayPTY pumps bytes between the client socket and the agent session until
+// either side ends it or the sandbox is destroyed.
+func relayPTY(ws *websocket.Conn, sb *sandbox, ac *agentConn, st *agentStream) {
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		select {
+		case <-sb.closing():
+			// Dropping the agent connection hangs up the session; the output
+			// loop below then reports the error and returns.
+			_ = ac.Close()
+		case <-done:
+		}
+	}()
+
+	// Client -> agent. When the client goes away, hang up the session.
+	go func() {
+		for {
+			var f wsFrame
+			if err := wsFrameCodec.Receive(ws, &f); err != nil {
+				_ = ac.Close()
+				return
+			}
+			in := &agentrpc.PTYInput{}
+			if f.payloadType == websocket.BinaryFrame {
+				in.Data = f.data
+			} else {
+				var msg ptyControlMessage
+				if err := json.Unmarshal(f.data, &msg); err != nil {
+					log.Printf("pty %s: invalid control message: %v", sb.ID, err)
+					continue
+				}
+				switch msg.Type {
+				case "input":
+					in.Data = []byte(msg.Data)
+				case "resize":
+					in.Rows, in.Cols = msg.Rows, msg.Cols
+				default:
+					log.Printf("pty %s: unknown control message type %q", sb.ID, msg.Type)
+					continue
+				}
+			}
+			if err := st.Send(agentrpc.Request{Type: "pty_input", PTYInput: in}); err != nil {
+				return
+			}
+		}
+	}()
+
+	// Agent -> client.
+	for {
+		resp, err := st.Recv()
+		if err != nil {
+			_ = websocket.JSON.Send(ws, ptyControlMessage{Type: "error", Error: err.Error()})
+			return
+		}
+		if resp.Output != nil {
+			if err := websocket.Message.Send(ws, resp.Output.Data); err != nil {
+				_ = ac.Close()
+				return
+			}
+			continue
+		}
+		if resp.More {
+			continue
+		}
+		exitCode := 0
+		if resp.Exec != nil {
+			exitCode = resp.Exec.ExitCode
+		}
+		_ = websocket.JSON.Send(ws, ptyControlMessage{Type: "exit", ExitCode: &exitCode})
+		return
+	}
+}
+
+func parseTermDimension(raw string, fallback uint16) (uint16, error) {
+	raw = strings.TrimSpace(raw)
+	if raw == "" {
+		return fallback, nil
+	}
+	v, err := strconv.ParseUint(raw, 10, 16)
+	if err != nil {
+		return 0, err
+	}
+	if v == 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	return uint16(v), nil
+}
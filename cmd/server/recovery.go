@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+const sandboxRecordFile = "sandbox.json"
+
+// sandboxRecord is what a later server process needs to take over a running
+// sandbox. It is kept in the sandbox dir and rewritten whenever the state,
+// expiry or labels change.
+type sandboxRecord struct {
+	SandboxID string `json:"sandbox_id"`
+	PID       int    `json:"pid"`
+	// PIDStart is the process start time from /proc/<pid>/stat, so a reused
+	// PID isn't mistaken for the sandbox's Firecracker.
+	PIDStart   uint64       `json:"pid_start"`
+	Netns      *netnsConfig `json:"netns"`
+	GuestCID   uint32       `json:"guest_cid"`
+	SocketPath string       `json:"socket_path"`
+	VsockPath  string       `json:"vsock_path"`
+	ConfigPath string       `json:"config_path,omitempty"`
+	RootfsPath string       `json:"rootfs_path"`
+	LogPath    string       `json:"log_path"`
+	CgroupPath string       `json:"cgroup_path,omitempty"`
+	VCPU       int          `json:"vcpu"`
+	MemMiB     int          `json:"mem_mib"`
+	DiskMiB    int          `json:"disk_mib"`
+
+	CreatedAt time.Time         `json:"created_at"`
+	Source    sandboxSource     `json:"source"`
+	LineageID string            `json:"lineage_id,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Paused    bool              `json:"paused,omitempty"`
+
+	TrackDirty   bool   `json:"track_dirty,omitempty"`
+	DiffParentID string `json:"diff_parent_id,omitempty"`
+
+	TTL         time.Duration `json:"ttl,omitempty"`
+	Deadline    time.Time     `json:"deadline,omitzero"`
+	IdleTimeout time.Duration `json:"idle_timeout,omitempty"`
+}
+
+func (sb *sandbox) record() sandboxRecord {
+	rec := sandboxRecord{
+		SandboxID:  sb.ID,
+		Netns:      sb.Netns,
+		GuestCID:   sb.GuestCID,
+		SocketPath: sb.SocketPath,
+		VsockPath:  sb.VsockPath,
+		ConfigPath: sb.ConfigPath,
+		RootfsPath: sb.RootfsPath,
+		LogPath:    sb.LogPath,
+		CgroupPath: sb.CgroupPath,
+		VCPU:       sb.VCPU,
+		MemMiB:     sb.MemMiB,
+		DiskMiB:    sb.DiskMiB,
+		CreatedAt:  sb.CreatedAt,
+		Source:     sb.Source,
+		LineageID:  sb.LineageID,
+		Labels:     sb.Labels,
+		TrackDirty: sb.trackDirty,
+	}
+	if sb.Process != nil && sb.Process.Process != nil {
+		rec.PID = sb.Process.Process.Pid
+		rec.PIDStart, _ = procStartTime(rec.PID)
+	}
+	sb.lifecycleMu.Lock()
+	rec.Paused = sb.state == sandboxStatePaused
+	rec.TTL = sb.ttl
+	rec.Deadline = sb.deadline
+	rec.IdleTimeout = sb.idleTimeout
+	rec.DiffParentID = sb.diffParentID
+	sb.lifecycleMu.Unlock()
+	return rec
+}
+
+// persistSandbox writes the sandbox's record. Failing to write it only costs
+// the ability to recover the sandbox after a restart, so it is logged rather
+// than failing the request.
+func (s *server) persistSandbox(sb *sandbox) {
+	raw, err := json.MarshalIndent(sb.record(), "", "  ")
+	if err == nil {
+		raw = append(raw, '\n')
+		path := filepath.Join(sb.Dir, sandboxRecordFile)
+		tmp := path + ".tmp"
+		if err = os.WriteFile(tmp, raw, 0o644); err == nil {
+			err = os.Rename(tmp, path)
+		}
+	}
+	if err != nil {
+		log.Printf("persist sandbox %s: %v", sb.ID, err)
+	}
+}
+
+func (s *server) persistAll() {
+	s.mu.Lock()
+	all := make([]*sandbox, 0, len(s.sandboxes))
+	for _, sb := range s.sandboxes {
+		all = append(all, sb)
+	}
+	s.mu.Unlock()
+	for _, sb := range all {
+		s.persistSandbox(sb)
+	}
+	log.Printf("leaving %d sandbox(es) running for the next server process", len(all))
+}
+
+// procStartTime returns the start time of pid in clock ticks since boot.
+func procStartTime(pid int) (uint64, error) {
+	raw, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return 0, err
+	}
+	// The command name may contain spaces; fields resume after its ')'.
+	s := string(raw)
+	i := strings.LastIndexByte(s, ')')
+	if i < 0 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	fields := strings.Fields(s[i+1:])
+	// starttime is field 22 of stat; fields here start at field 3.
+	if len(fields) < 20 {
+		return 0, fmt.Errorf("malformed /proc/%d/stat", pid)
+	}
+	return strconv.ParseUint(fields[19], 10, 64)
+}
+
+// recoverSandboxes reads the records left in the work dir by a previous
+// server process. Sandboxes whose Firecracker is still running (and, unless
+// paused, whose agent answers) are adopted into s.sandboxes when
+// cfg.RecoverSandboxes is set; every other recorded sandbox is torn down.
+// Sandbox dirs without a record are left alone.
+//
+// It must run before the netns pool is initialized; the returned netns slots
+// are in use by adopted sandboxes and must not be rebuilt.
+func (s *server) recoverSandboxes() map[int]*netnsConfig {
+	pooledInUse := make(map[int]*netnsConfig)
+	root := filepath.Join(s.cfg.WorkDir, "sandboxes")
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		log.Printf("recover sandboxes: read %q: %v", root, err)
+		return pooledInUse
+	}
+
+	keepCgroups := make(map[string]bool)
+	var adopted, discarded int
+	for _, e := range entries {
+		if !e.IsDir() {
+			continue
+		}
+		dir := filepath.Join(root, e.Name())
+		raw, err := os.ReadFile(filepath.Join(dir, sandboxRecordFile))
+		if err != nil {
+			continue
+		}
+		var rec sandboxRecord
+		if err := json.Unmarshal(raw, &rec); err != nil || rec.SandboxID != e.Name() {
+			log.Printf("recover sandboxes: ignoring %s: unreadable record", dir)
+			continue
+		}
+
+		sb, err := s.adoptSandbox(dir, rec)
+		if err != nil {
+			log.Printf("recover sandboxes: discarding %s: %v", rec.SandboxID, err)
+			s.discardSandbox(dir, rec)
+			discarded++
+			continue
+		}
+
+		if nc := sb.Netns; nc != nil && nc.Pooled {
+			if nc.Subnet >= 1 && nc.Subnet <= s.cfg.NetnsPoolSize {
+				pooledInUse[nc.Subnet] = nc
+			} else {
+				// The pool shrank or is disabled; this slot is no longer
+				// pool-managed and is torn down with its sandbox.
+				nc.Pooled = false
+			}
+		}
+		if sb.CgroupPath != "" {
+			keepCgroups[filepath.Base(sb.CgroupPath)] = true
+		}
+		s.registerRecovered(sb)
+		adopted++
+	}
+
+	if s.cfg.EnableCgroups {
+		scavengeCgroups(s.cfg.CgroupRoot, keepCgroups)
+	}
+	if adopted > 0 || discarded > 0 {
+		log.Printf("recover sandboxes: adopted=%d discarded=%d", adopted, discarded)
+	}
+	return pooledInUse
+}
+
+func (s *server) adoptSandbox(dir string, rec sandboxRecord) (*sandbox, error) {
+	if !s.cfg.RecoverSandboxes {
+		return nil, fmt.Errorf("recovery disabled")
+	}
+	if rec.Netns == nil {
+		return nil, fmt.Errorf("record has no netns")
+	}
+	if err := checkFirecrackerProcess(rec.PID, rec.PIDStart, dir); err != nil {
+		return nil, err
+	}
+
+	sb := &sandbox{
+		ID:         rec.SandboxID,
+		Subnet:     rec.Netns.Subnet,
+		TapDevice:  rec.Netns.TapName,
+		HostIP:     rec.Netns.HostIP,
+		GuestIP:    rec.Netns.GuestIP,
+		GuestCID:   rec.GuestCID,
+		Netns:      rec.Netns,
+		Dir:        dir,
+		SocketPath: rec.SocketPath,
+		VsockPath:  rec.VsockPath,
+		ConfigPath: rec.ConfigPath,
+		RootfsPath: rec.RootfsPath,
+		LogPath:    rec.LogPath,
+		CgroupPath: rec.CgroupPath,
+		VCPU:       rec.VCPU,
+		MemMiB:     rec.MemMiB,
+		DiskMiB:    rec.DiskMiB,
+		CreatedAt:  rec.CreatedAt,
+		Source:     rec.Source,
+		LineageID:  rec.LineageID,
+		Labels:     rec.Labels,
+		trackDirty: rec.TrackDirty,
+		adopted:    true,
+		state:      sandboxStateRunning,
+	}
+	if sb.LineageID == "" {
+		// Records written before sandboxes kept their lineage: their
+		// snapshots were all attributed to the current base.
+		sb.LineageID = s.cfg.BaseRootfsLineageID
+	}
+
+	// Firecracker's own view decides whether the VM is paused; the record can
+	// lag if the previous server died mid pause or resume.
+	vmState, err := newFCClient(sb.SocketPath, 2*time.Second).vmState()
+	if err != nil {
+		return nil, fmt.Errorf("firecracker api: %w", err)
+	}
+	switch vmState {
+	case "Running":
+		ac, err := waitForAgentReady(sb.VsockPath, s.cfg.AgentPort, 5*time.Second, s.cfg.AgentDialTimeout)
+		if err != nil {
+			return nil, err
+		}
+		sb.Agent = ac
+	case "Paused":
+		// The agent can't answer until the VM resumes; it is dialed on first use.
+		sb.state = sandboxStatePaused
+	default:
+		return nil, fmt.Errorf("unexpected vm state %q", vmState)
+	}
+
+	p, err := os.FindProcess(rec.PID)
+	if err != nil {
+		if sb.Agent != nil {
+			_ = sb.Agent.Close()
+		}
+		return nil, err
+	}
+	sb.Process = &exec.Cmd{Process: p}
+
+	sb.setDiffParent(rec.DiffParentID)
+	sb.ttl = rec.TTL
+	sb.deadline = rec.Deadline
+	sb.idleTimeout = rec.IdleTimeout
+	sb.lastActivity = time.Now()
+	return sb, nil
+}
+
+// checkFirecrackerProcess verifies that pid is still the Firecracker process
+// started for the sandbox in dir.
+func checkFirecrackerProcess(pid int, start uint64, dir string) error {
+	if pid <= 0 {
+		return fmt.Errorf("record has no pid")
+	}
+	got, err := procStartTime(pid)
+	if err != nil {
+		return fmt.Errorf("firecracker (pid %d) is gone", pid)
+	}
+	if got != start {
+		return fmt.Errorf("pid %d was reused", pid)
+	}
+	if cwd, err := os.Readlink(fmt.Sprintf("/proc/%d/cwd", pid)); err != nil || filepath.Clean(cwd) != filepath.Clean(dir) {
+		return fmt.Errorf("pid %d is not this sandbox's firecracker", pid)
+	}
+	return nil
+}
+
+func (s *server) registerRecovered(sb *sandbox) {
+	s.mu.Lock()
+	s.sandboxes[sb.ID] = sb
+	s.mu.Unlock()
+
+	// New IDs and on-demand subnets must not collide with adopted ones.
+	if n, err := strconv.ParseUint(strings.TrimPrefix(sb.ID, "sb-"), 10, 64); err == nil {
+		for {
+			cur := atomic.LoadUint64(&s.nextSandboxID)
+			if cur >= n || atomic.CompareAndSwapUint64(&s.nextSandboxID, cur, n) {
+				break
+			}
+		}
+	}
+	if sb.Netns != nil && !sb.Netns.Pooled {
+		subnet := uint32(sb.Netns.Subnet)
+		for {
+			cur := atomic.LoadUint32(&s.nextSubnet)
+			if cur >= subnet || atomic.CompareAndSwapUint32(&s.nextSubnet, cur, subnet) {
+				break
+			}
+		}
+	}
+	log.Printf("recover sandboxes: adopted %s (pid %d, %s)", sb.ID, sb.Process.Process.Pid, sb.info().State)
+}
+
+// discardSandbox tears down what is left of a recorded sandbox that can't be
+// adopted. Pooled netns slots are rebuilt by the pool itself.
+func (s *server) discardSandbox(dir string, rec sandboxRecord) {
+	if checkFirecrackerProcess(rec.PID, rec.PIDStart, dir) == nil {
+		if err := syscall.Kill(-rec.PID, syscall.SIGKILL); err != nil {
+			_ = syscall.Kill(rec.PID, syscall.SIGKILL)
+		}
+	}
+	if rec.CgroupPath != "" {
+		_ = killCgroup(rec.CgroupPath)
+		_ = removeCgroupDir(rec.CgroupPath, 1500*time.Millisecond)
+	}
+	if nc := rec.Netns; nc != nil && (!nc.Pooled || nc.Subnet > s.cfg.NetnsPoolSize) {
+		_ = cleanupSandboxNetnsAndRouting(s.cfg, nc)
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		log.Printf("recover sandboxes: remove %s: %v", dir, err)
+	}
+}
+
+// waitForPidExit polls until pid is gone. Adopted Firecracker processes are
+// not children of this server, so they can't be waited for directly; once
+// killed they are reaped by init.
+func waitForPidExit(pid int, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := syscall.Kill(pid, 0); err == syscall.ESRCH {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("pid %d still running after %s", pid, timeout)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
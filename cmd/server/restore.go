@@ -24,6 +24,7 @@ type restoreTimings struct {
 func (s *server) restoreSandboxFromArtifacts(
 	id string,
 	start time.Time,
+	spec sandboxSpec,
 	diskSrcPath string,
 	stateFile string,
 	memFile string,
@@ -51,6 +52,7 @@ func (s *server) restoreSandboxFromArtifacts(
 	// Clone disk and acquire netns in parallel; these are independent setup
 	// steps and overlapping them shortens /create critical path.
 	rootfsCopy := filepath.Join(sbDir, "rootfs.ext4")
+	diskGrown := false
 	cloneCh := make(chan struct {
 		err error
 		dur time.Duration
@@ -69,10 +71,12 @@ func (s *server) restoreSandboxFromArtifacts(
 			}{err: fmt.Errorf("%s: %w", cloneErrLabel, err), dur: time.Since(cstart)}
 			return
 		}
+		var err error
+		diskGrown, err = growRootfs(rootfsCopy, spec.DiskMiB)
 		cloneCh <- struct {
 			err error
 			dur time.Duration
-		}{err: nil, dur: time.Since(cstart)}
+		}{err: err, dur: time.Since(cstart)}
 	}()
 	go func() {
 		nstart := time.Now()
@@ -141,7 +145,7 @@ func (s *server) restoreSandboxFromArtifacts(
 	// Load snapshot and resume.
 	fc := newFCClient(socketPath, 10*time.Second)
 	loadStart := time.Now()
-	if err := loadSnapshotWithRetry(fc, stateFile, memFile, true, 1500*time.Millisecond); err != nil {
+	if err := loadSnapshotWithRetry(fc, stateFile, memFile, true, s.cfg.EnableDiffSnapshots, 1500*time.Millisecond); err != nil {
 		_ = killProcessGroup(fcCmd)
 		_ = killCgroup(cgroupPath)
 		_ = logFile.Close()
@@ -171,6 +175,24 @@ func (s *server) restoreSandboxFromArtifacts(
 	}
 	timings.GuestNet = time.Since(guestNetStart)
 
+	// The snapshot captured the guest's view of the disk size; have
+	// Firecracker announce the new capacity, then grow the filesystem.
+	if diskGrown {
+		err := fc.updateDrivePath("rootfs", "rootfs.ext4")
+		if err == nil {
+			err = resizeGuestRootfs(ac)
+		} else {
+			err = fmt.Errorf("rescan grown rootfs: %w", err)
+		}
+		if err != nil {
+			_ = ac.Close()
+			_ = killProcessGroup(fcCmd)
+			_ = killCgroup(cgroupPath)
+			_ = logFile.Close()
+			return nil, timings, err
+		}
+	}
+
 	_ = logFile.Close()
 	cleanupNet = false
 	cleanupDir = false
@@ -190,21 +212,27 @@ func (s *server) restoreSandboxFromArtifacts(
 		RootfsPath: rootfsCopy,
 		LogPath:    logPath,
 		CgroupPath: cgroupPath,
+		VCPU:       spec.Shape.VCPU,
+		MemMiB:     spec.Shape.MemMiB,
+		DiskMiB:    diskSizeMiB(rootfsCopy),
+		CreatedAt:  time.Now(),
 		Process:    fcCmd,
 		Agent:      ac,
+		trackDirty: s.cfg.EnableDiffSnapshots,
 		state:      sandboxStateRunning,
 	}, timings, nil
 }
 
-func (s *server) createSandboxFromSnapshot(id string) (*sandbox, error) {
+func (s *server) createSandboxFromSnapshot(id string, spec sandboxSpec) (*sandbox, error) {
 	createStart := time.Now()
-	sp, err := ensureSnapshot(s.cfg)
+	sp, err := ensureSnapshot(s.cfg, spec.Shape)
 	if err != nil {
 		return nil, err
 	}
 	sb, timings, err := s.restoreSandboxFromArtifacts(
 		id,
 		createStart,
+		spec,
 		sp.BaseDisk,
 		sp.StateFile,
 		sp.MemFile,
@@ -215,6 +243,8 @@ func (s *server) createSandboxFromSnapshot(id string) (*sandbox, error) {
 	if err != nil {
 		return nil, err
 	}
+	sb.Source = sandboxSource{Type: sandboxSourceGoldenSnapshot}
+	sb.LineageID = s.cfg.BaseRootfsLineageID
 	if s.cfg.EnableStageTimingLogs {
 		log.Printf("create snapshot timing: sandbox_id=%s disk_materialize=%s netns_acquire=%s prep_overlap=%s socket_ready=%s snapshot_load=%s agent_ready=%s guest_net=%s total=%s", id, timings.DiskMaterialize, timings.NetnsAcquire, timings.PrepOverlap, timings.SocketReady, timings.SnapshotLoad, timings.AgentReady, timings.GuestNet, timings.Total)
 	}
@@ -228,12 +258,23 @@ func (s *server) createSandboxFromUserSnapshot(id string, meta userSnapshotMeta)
 			return nil, fmt.Errorf("snapshot artifact missing: %s", p)
 		}
 	}
+	memFile, err := s.userSnapshotMemFile(meta)
+	if err != nil {
+		return nil, fmt.Errorf("merge diff snapshot memory: %w", err)
+	}
+	// The snapshot fixes the machine shape; the disk keeps its size. Snapshots
+	// taken before the shape was recorded ran on the default one.
+	spec := sandboxSpec{Shape: machineShape{VCPU: meta.VCPU, MemMiB: meta.MemMiB}}
+	if spec.Shape.VCPU == 0 || spec.Shape.MemMiB == 0 {
+		spec.Shape = defaultShape(s.cfg)
+	}
 	sb, timings, err := s.restoreSandboxFromArtifacts(
 		id,
 		restoreStart,
+		spec,
 		meta.DiskFile,
 		meta.StateFile,
-		meta.MemFile,
+		memFile,
 		"clone user snapshot disk",
 		false,
 		false,
@@ -241,6 +282,12 @@ func (s *server) createSandboxFromUserSnapshot(id string, meta userSnapshotMeta)
 	if err != nil {
 		return nil, err
 	}
+	sb.Source = sandboxSource{Type: sandboxSourceUserSnapshot, SnapshotID: meta.SnapshotID}
+	sb.LineageID = meta.LineageID
+	if sb.trackDirty {
+		// Pages dirtied from here on are relative to this snapshot.
+		sb.setDiffParent(meta.SnapshotID)
+	}
 	if s.cfg.EnableStageTimingLogs {
 		log.Printf("snapshot restore timing: snapshot_id=%s sandbox_id=%s disk_materialize=%s netns_acquire=%s prep_overlap=%s socket_ready=%s snapshot_load=%s agent_ready=%s guest_net=%s total=%s", meta.SnapshotID, id, timings.DiskMaterialize, timings.NetnsAcquire, timings.PrepOverlap, timings.SocketReady, timings.SnapshotLoad, timings.AgentReady, timings.GuestNet, timings.Total)
 	}
@@ -14,9 +14,9 @@ import (
 	"manta/internal/agentrpc"
 )
 
-func (s *server) createSandbox(id string) (*sandbox, error) {
+func (s *server) createSandbox(id string, spec sandboxSpec) (*sandbox, error) {
 	if s.cfg.EnableSnapshots {
-		return s.createSandboxFromSnapshot(id)
+		return s.createSandboxFromSnapshot(id, spec)
 	}
 
 	sbDir := filepath.Join(s.cfg.WorkDir, "sandboxes", id)
@@ -32,6 +32,7 @@ func (s *server) createSandbox(id string) (*sandbox, error) {
 
 	// Acquire netns and clone rootfs in parallel to reduce /create critical path.
 	rootfsCopy := filepath.Join(sbDir, "rootfs.ext4")
+	diskGrown := false
 	copyErrCh := make(chan error, 1)
 	netnsCh := make(chan struct {
 		nc  *netnsConfig
@@ -42,7 +43,9 @@ func (s *server) createSandbox(id string) (*sandbox, error) {
 			copyErrCh <- fmt.Errorf("copy rootfs: %w", err)
 			return
 		}
-		copyErrCh <- nil
+		var err error
+		diskGrown, err = growRootfs(rootfsCopy, spec.DiskMiB)
+		copyErrCh <- err
 	}()
 	go func() {
 		nc, err := s.acquireNetns(id)
@@ -73,7 +76,7 @@ func (s *server) createSandbox(id string) (*sandbox, error) {
 
 	configPath := filepath.Join(sbDir, "vm-config.json")
 	// Use stable, relative paths inside the per-sandbox jail dir.
-	if err := writeVMConfig(configPath, s.cfg, nc.TapName, "rootfs.ext4", nc.Subnet, "vsock.sock", uint32(1000+nc.Subnet)); err != nil {
+	if err := writeVMConfig(configPath, s.cfg, spec.Shape, nc.TapName, "rootfs.ext4", nc.Subnet, "vsock.sock", uint32(1000+nc.Subnet)); err != nil {
 		return nil, fmt.Errorf("write vm config: %w", err)
 	}
 	socketPath, vsockPath, logPath := prepareSandboxRuntimePaths(sbDir)
@@ -119,6 +122,20 @@ func (s *server) createSandbox(id string) (*sandbox, error) {
 		return nil, err
 	}
 
+	// The kernel booted with the grown disk, but the filesystem on it still
+	// has the base image's size.
+	if diskGrown {
+		if err := resizeGuestRootfs(ac); err != nil {
+			_ = ac.Close()
+			_ = killProcessGroup(fcCmd)
+			_ = killCgroup(cgroupPath)
+			_ = cleanupSandboxNetnsAndRouting(s.cfg, nc)
+			cleanupNet = false
+			_ = logFile.Close()
+			return nil, err
+		}
+	}
+
 	_ = logFile.Close()
 	cleanupNet = false
 	cleanupDir = false
@@ -138,8 +155,15 @@ func (s *server) createSandbox(id string) (*sandbox, error) {
 		RootfsPath: rootfsCopy,
 		LogPath:    logPath,
 		CgroupPath: cgroupPath,
+		VCPU:       spec.Shape.VCPU,
+		MemMiB:     spec.Shape.MemMiB,
+		DiskMiB:    diskSizeMiB(rootfsCopy),
+		CreatedAt:  time.Now(),
+		Source:     sandboxSource{Type: sandboxSourceBoot},
+		LineageID:  s.cfg.BaseRootfsLineageID,
 		Process:    fcCmd,
 		Agent:      ac,
+		trackDirty: s.cfg.EnableDiffSnapshots,
 		state:      sandboxStateRunning,
 	}
 	return sb, nil
@@ -229,7 +253,13 @@ func (s *server) cleanupSandbox(sb *sandbox) error {
 	if sb.Process != nil && sb.Process.Process != nil {
 		_ = killProcessGroup(sb.Process)
 		done := make(chan error, 1)
-		go func() { done <- sb.Process.Wait() }()
+		go func() {
+			if sb.adopted {
+				done <- waitForPidExit(sb.Process.Process.Pid, 5*time.Second)
+				return
+			}
+			done <- sb.Process.Wait()
+		}()
 		select {
 		case <-time.After(5 * time.Second):
 			errs = append(errs, "timed out waiting for firecracker process exit")
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"errors"
 	"fmt"
 	"time"
 )
@@ -11,15 +12,46 @@ const (
 	sandboxStateRunning sandboxState = iota
 	sandboxStateClosing
 	sandboxStateClosed
+	sandboxStatePaused
 )
 
+var errSandboxPaused = errors.New("sandbox is paused; resume it first")
+
+func (st sandboxState) String() string {
+	switch st {
+	case sandboxStateRunning:
+		return "running"
+	case sandboxStateClosing:
+		return "closing"
+	case sandboxStateClosed:
+		return "closed"
+	case sandboxStatePaused:
+		return "paused"
+	}
+	return fmt.Sprintf("sandboxState(%d)", uint8(st))
+}
+
+func parseSandboxState(raw string) (sandboxState, error) {
+	for _, st := range []sandboxState{sandboxStateRunning, sandboxStatePaused, sandboxStateClosing, sandboxStateClosed} {
+		if raw == st.String() {
+			return st, nil
+		}
+	}
+	return 0, fmt.Errorf("invalid state %q", raw)
+}
+
 func (sb *sandbox) tryStartExec() error {
 	sb.lifecycleMu.Lock()
 	defer sb.lifecycleMu.Unlock()
-	if sb.state != sandboxStateRunning {
+	switch sb.state {
+	case sandboxStateRunning:
+	case sandboxStatePaused:
+		return errSandboxPaused
+	default:
 		return fmt.Errorf("sandbox is closing")
 	}
 	sb.inFlightExec++
+	sb.lastActivity = time.Now()
 	return nil
 }
 
@@ -29,18 +61,102 @@ func (sb *sandbox) finishExec() {
 	if sb.inFlightExec > 0 {
 		sb.inFlightExec--
 	}
+	sb.lastActivity = time.Now()
+}
+
+// setExpiry starts the sandbox's TTL and idle clocks; 0 disables either.
+func (sb *sandbox) setExpiry(ttl, idleTimeout time.Duration) {
+	sb.lifecycleMu.Lock()
+	defer sb.lifecycleMu.Unlock()
+	now := time.Now()
+	sb.ttl = ttl
+	sb.deadline = time.Time{}
+	if ttl > 0 {
+		sb.deadline = now.Add(ttl)
+	}
+	sb.idleTimeout = idleTimeout
+	sb.lastActivity = now
+}
+
+// keepalive counts as activity and restarts the TTL clock, with a new TTL if
+// ttl > 0. It returns the new expiry.
+func (sb *sandbox) keepalive(ttl time.Duration) time.Time {
+	sb.lifecycleMu.Lock()
+	defer sb.lifecycleMu.Unlock()
+	now := time.Now()
+	sb.lastActivity = now
+	if ttl > 0 {
+		sb.ttl = ttl
+	}
+	if sb.ttl > 0 {
+		sb.deadline = now.Add(sb.ttl)
+	}
+	return sb.expiresAtLocked()
+}
+
+// expiresAt reports when the sandbox will be reaped if nothing else happens,
+// or the zero time if it never will.
+func (sb *sandbox) expiresAt() time.Time {
+	sb.lifecycleMu.Lock()
+	defer sb.lifecycleMu.Unlock()
+	return sb.expiresAtLocked()
+}
+
+func (sb *sandbox) expiresAtLocked() time.Time {
+	t := sb.deadline
+	if sb.idleTimeout > 0 && sb.state != sandboxStatePaused {
+		if idle := sb.lastActivity.Add(sb.idleTimeout); t.IsZero() || idle.Before(t) {
+			t = idle
+		}
+	}
+	return t
+}
+
+// expiryReason reports why the sandbox is due for reaping at now, or "" if it
+// isn't. Work in flight keeps a sandbox from going idle but not past its TTL.
+// A paused sandbox is already idle by choice: its idle clock stops until it
+// is resumed, while its TTL keeps running.
+func (sb *sandbox) expiryReason(now time.Time) string {
+	sb.lifecycleMu.Lock()
+	defer sb.lifecycleMu.Unlock()
+	if sb.state != sandboxStateRunning && sb.state != sandboxStatePaused {
+		return ""
+	}
+	if !sb.deadline.IsZero() && now.After(sb.deadline) {
+		return "ttl expired"
+	}
+	if sb.state == sandboxStateRunning && sb.idleTimeout > 0 && sb.inFlightExec == 0 && now.Sub(sb.lastActivity) > sb.idleTimeout {
+		return "idle timeout"
+	}
+	return ""
 }
 
 func (sb *sandbox) beginDestroy() bool {
 	sb.lifecycleMu.Lock()
 	defer sb.lifecycleMu.Unlock()
-	if sb.state != sandboxStateRunning {
+	if sb.state != sandboxStateRunning && sb.state != sandboxStatePaused {
 		return false
 	}
 	sb.state = sandboxStateClosing
+	close(sb.closingChLocked())
 	return true
 }
 
+// closing returns a channel that is closed once teardown begins. Long-lived
+// sessions (e.g. terminals) watch it so /destroy doesn't have to wait them out.
+func (sb *sandbox) closing() <-chan struct{} {
+	sb.lifecycleMu.Lock()
+	defer sb.lifecycleMu.Unlock()
+	return sb.closingChLocked()
+}
+
+func (sb *sandbox) closingChLocked() chan struct{} {
+	if sb.closeCh == nil {
+		sb.closeCh = make(chan struct{})
+	}
+	return sb.closeCh
+}
+
 func (sb *sandbox) waitForExecDrain(timeout time.Duration) bool {
 	deadline := time.Now().Add(timeout)
 	for {
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sandboxSourceBoot           = "boot"
+	sandboxSourceGoldenSnapshot = "golden_snapshot"
+	sandboxSourceUserSnapshot   = "user_snapshot"
+	sandboxSourceFork           = "fork"
+)
+
+// sandboxSource records how a sandbox was created: a fresh boot, a restore of
+// the golden snapshot, a restore of the user snapshot SnapshotID, or a fork of
+// the sandbox SandboxID.
+type sandboxSource struct {
+	Type       string `json:"type"`
+	SnapshotID string `json:"snapshot_id,omitempty"`
+	SandboxID  string `json:"sandbox_id,omitempty"`
+}
+
+type sandboxInfo struct {
+	SandboxID     string        `json:"sandbox_id"`
+	State         string        `json:"state"`
+	GuestIP       string        `json:"guest_ip"`
+	HostIP        string        `json:"host_ip"`
+	Subnet        int           `json:"subnet"`
+	Source        sandboxSource `json:"source"`
+	LineageID     string        `json:"lineage_id,omitempty"`
+	CreatedAt     string        `json:"created_at"`
+	ExpiresAt     string        `json:"expires_at,omitempty"`
+	InFlightExecs int           `json:"in_flight_execs"`
+	VCPU          int           `json:"vcpu"`
+	MemMiB        int           `json:"mem_mib"`
+	DiskMiB       int           `json:"disk_mib"`
+	CgroupPath    string        `json:"cgroup_path,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+type sandboxListResponse struct {
+	Sandboxes []sandboxInfo `json:"sandboxes"`
+}
+
+func (sb *sandbox) info() sandboxInfo {
+	sb.lifecycleMu.Lock()
+	state := sb.state
+	inFlight := sb.inFlightExec
+	expires := sb.expiresAtLocked()
+	sb.lifecycleMu.Unlock()
+
+	return sandboxInfo{
+		SandboxID:     sb.ID,
+		State:         state.String(),
+		GuestIP:       sb.GuestIP,
+		HostIP:        sb.HostIP,
+		Subnet:        sb.Subnet,
+		Source:        sb.Source,
+		LineageID:     sb.LineageID,
+		CreatedAt:     sb.CreatedAt.UTC().Format(time.RFC3339Nano),
+		ExpiresAt:     formatExpiry(expires),
+		InFlightExecs: inFlight,
+		VCPU:          sb.VCPU,
+		MemMiB:        sb.MemMiB,
+		DiskMiB:       sb.DiskMiB,
+		CgroupPath:    sb.CgroupPath,
+		Labels:        sb.Labels,
+	}
+}
+
+// handleSandboxList lists live sandboxes, oldest first. ?state= keeps only
+// sandboxes in that state and ?selector= those whose labels match.
+func (s *server) handleSandboxList(w http.ResponseWriter, r *http.Request) {
+	var want *sandboxState
+	if raw := strings.TrimSpace(r.URL.Query().Get("state")); raw != "" {
+		st, err := parseSandboxState(raw)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		want = &st
+	}
+	sel, err := parseLabelSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	s.mu.Lock()
+	all := make([]*sandbox, 0, len(s.sandboxes))
+	for _, sb := range s.sandboxes {
+		all = append(all, sb)
+	}
+	s.mu.Unlock()
+	sort.Slice(all, func(i, j int) bool {
+		if !all[i].CreatedAt.Equal(all[j].CreatedAt) {
+			return all[i].CreatedAt.Before(all[j].CreatedAt)
+		}
+		return all[i].ID < all[j].ID
+	})
+
+	out := sandboxListResponse{Sandboxes: []sandboxInfo{}}
+	for _, sb := range all {
+		if !sel.matches(sb.Labels) {
+			continue
+		}
+		info := sb.info()
+		if want != nil && info.State != want.String() {
+			continue
+		}
+		out.Sandboxes = append(out.Sandboxes, info)
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+func (s *server) handleSandboxGet(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	sb := s.sandboxes[r.PathValue("id")]
+	s.mu.Unlock()
+	if sb == nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": "sandbox not found"})
+		return
+	}
+	writeJSON(w, http.StatusOK, sb.info())
+}
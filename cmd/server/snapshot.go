@@ -13,6 +13,7 @@ import (
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 )
@@ -30,11 +31,32 @@ type snapshotMeta struct {
 	Version        int    `json:"version"`
 	LineageID      string `json:"lineage_id"`
 	BaseRootfsPath string `json:"base_rootfs_path"`
+	VCPU           int    `json:"vcpu"`
+	MemMiB         int    `json:"mem_mib"`
 	CreatedAt      string `json:"created_at"`
+
+	// Digests of state.snap, mem.snap and base/rootfs.ext4 (see
+	// artifactDigest).
+	Digests map[string]artifactDigest `json:"digests,omitempty"`
 }
 
-func snapshotLayout(workDir string) snapshotPaths {
-	dir := filepath.Join(workDir, "snapshot")
+// goldenSnapshotMu serializes golden snapshot checks and builds. Builds reuse
+// a fixed netns and subnet, and concurrent first creates for one shape would
+// otherwise race to build the same snapshot.
+var goldenSnapshotMu sync.Mutex
+
+// goldenVerified holds the shapes whose golden snapshot digests have been
+// checked by this process under cfg.VerifySnapshots. Guarded by
+// goldenSnapshotMu.
+var goldenVerified = map[string]bool{}
+
+func goldenSnapshotsDir(workDir string) string {
+	return filepath.Join(workDir, "snapshot")
+}
+
+// snapshotLayout returns the golden snapshot paths for a machine shape.
+func snapshotLayout(workDir string, shape machineShape) snapshotPaths {
+	dir := filepath.Join(goldenSnapshotsDir(workDir), shape.key())
 	base := filepath.Join(dir, "base")
 	return snapshotPaths{
 		Dir:       dir,
@@ -46,13 +68,20 @@ func snapshotLayout(workDir string) snapshotPaths {
 	}
 }
 
-func ensureSnapshot(cfg config) (snapshotPaths, error) {
-	sp := snapshotLayout(cfg.WorkDir)
+// ensureSnapshot returns the golden snapshot for shape, building it first if
+// it is missing or stale.
+func ensureSnapshot(cfg config, shape machineShape) (snapshotPaths, error) {
+	goldenSnapshotMu.Lock()
+	defer goldenSnapshotMu.Unlock()
+	sp := snapshotLayout(cfg.WorkDir, shape)
 
 	// If snapshot files exist, validate lineage metadata to ensure restore
-	// compatibility with the currently configured base rootfs.
+	// compatibility with the currently configured base rootfs, and the files
+	// against their digests (hashed once per process when verifying).
 	if fileExists(sp.StateFile) && fileExists(sp.MemFile) && fileExists(sp.BaseDisk) {
-		if err := validateSnapshotMeta(sp, cfg); err == nil {
+		full := cfg.VerifySnapshots && !goldenVerified[shape.key()]
+		if err := validateSnapshotMeta(sp, cfg, shape, full); err == nil {
+			goldenVerified[shape.key()] = true
 			return sp, nil
 		} else {
 			log.Printf("snapshot metadata mismatch; rebuilding snapshot: %v", err)
@@ -62,6 +91,7 @@ func ensureSnapshot(cfg config) (snapshotPaths, error) {
 		}
 	}
 
+	removeLegacyGoldenSnapshot(cfg.WorkDir)
 	if err := os.MkdirAll(sp.BaseDir, 0o755); err != nil {
 		return sp, fmt.Errorf("create snapshot dir: %w", err)
 	}
@@ -87,7 +117,7 @@ func ensureSnapshot(cfg config) (snapshotPaths, error) {
 	// Create a minimal Firecracker config that uses relative paths and stable
 	// device names.
 	configPath := filepath.Join(sp.BaseDir, "vm-config.json")
-	if err := writeVMConfig(configPath, cfg, nc.TapName, "rootfs.ext4", snapSubnet, "vsock.sock", 3); err != nil {
+	if err := writeVMConfig(configPath, cfg, shape, nc.TapName, "rootfs.ext4", snapSubnet, "vsock.sock", 3); err != nil {
 		return sp, fmt.Errorf("write snapshot vm config: %w", err)
 	}
 
@@ -143,19 +173,60 @@ func ensureSnapshot(cfg config) (snapshotPaths, error) {
 	_ = killProcessGroup(fcCmd)
 	_, _ = fcCmd.Process.Wait()
 
-	if err := writeSnapshotMeta(sp, cfg); err != nil {
+	if err := writeSnapshotMeta(sp, cfg, shape); err != nil {
 		return sp, err
 	}
+	goldenVerified[shape.key()] = true
 
-	log.Printf("snapshot ready: state=%s mem=%s base_disk=%s", sp.StateFile, sp.MemFile, sp.BaseDisk)
+	log.Printf("snapshot ready: shape=%s state=%s mem=%s base_disk=%s", shape.key(), sp.StateFile, sp.MemFile, sp.BaseDisk)
 	return sp, nil
 }
 
+// removeLegacyGoldenSnapshot deletes the single golden snapshot kept directly
+// under the snapshot dir before snapshots were kept per machine shape.
+func removeLegacyGoldenSnapshot(workDir string) {
+	dir := goldenSnapshotsDir(workDir)
+	for _, name := range []string{"state.snap", "mem.snap", "meta.json", "base"} {
+		p := filepath.Join(dir, name)
+		if !fileExists(p) {
+			continue
+		}
+		if err := os.RemoveAll(p); err != nil {
+			log.Printf("remove legacy golden snapshot file %s: %v", p, err)
+		}
+	}
+}
+
 func fileExists(p string) bool {
 	_, err := os.Stat(p)
 	return err == nil
 }
 
+// fileSize returns the size of p, or 0 if it can't be read.
+func fileSize(p string) int64 {
+	st, err := os.Stat(p)
+	if err != nil {
+		return 0
+	}
+	return st.Size()
+}
+
+// syncFiles flushes each file's data to stable storage.
+func syncFiles(paths ...string) error {
+	for _, p := range paths {
+		f, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		err = f.Sync()
+		_ = f.Close()
+		if err != nil {
+			return fmt.Errorf("sync %s: %w", p, err)
+		}
+	}
+	return nil
+}
+
 func waitForUnixSocketReady(socketPath string, timeout time.Duration) error {
 	if strings.TrimSpace(socketPath) == "" {
 		return fmt.Errorf("socket path is empty")
@@ -185,14 +256,14 @@ func waitForUnixSocketReady(socketPath string, timeout time.Duration) error {
 	return fmt.Errorf("%q not ready after %s", socketPath, timeout)
 }
 
-func loadSnapshotWithRetry(fc *fcClient, statePath, memPath string, resume bool, timeout time.Duration) error {
+func loadSnapshotWithRetry(fc *fcClient, statePath, memPath string, resume, trackDirtyPages bool, timeout time.Duration) error {
 	if timeout <= 0 {
 		timeout = 1500 * time.Millisecond
 	}
 
 	deadline := time.Now().Add(timeout)
 	for {
-		err := fc.loadSnapshot(statePath, memPath, resume)
+		err := fc.loadSnapshot(statePath, memPath, resume, trackDirtyPages)
 		if err == nil {
 			return nil
 		}
@@ -227,7 +298,7 @@ func materializeSandboxRootfs(cfg config, srcPath, dstPath string) error {
 	return err
 }
 
-func validateSnapshotMeta(sp snapshotPaths, cfg config) error {
+func validateSnapshotMeta(sp snapshotPaths, cfg config, shape machineShape, full bool) error {
 	raw, err := os.ReadFile(sp.MetaFile)
 	if err != nil {
 		return fmt.Errorf("read snapshot meta: %w", err)
@@ -239,6 +310,12 @@ func validateSnapshotMeta(sp snapshotPaths, cfg config) error {
 	if meta.Version != 1 {
 		return fmt.Errorf("unsupported snapshot meta version %d", meta.Version)
 	}
+	if meta.VCPU != shape.VCPU || meta.MemMiB != shape.MemMiB {
+		return fmt.Errorf("snapshot shape mismatch (meta=%dvcpu-%dmib want=%s)", meta.VCPU, meta.MemMiB, shape.key())
+	}
+	if err := checkDigests(meta.Digests, full, sp.StateFile, sp.MemFile, sp.BaseDisk); err != nil {
+		return err
+	}
 	if strings.TrimSpace(cfg.BaseRootfsLineageID) == "" {
 		return nil
 	}
@@ -251,12 +328,19 @@ func validateSnapshotMeta(sp snapshotPaths, cfg config) error {
 	return nil
 }
 
-func writeSnapshotMeta(sp snapshotPaths, cfg config) error {
+func writeSnapshotMeta(sp snapshotPaths, cfg config, shape machineShape) error {
+	digests, err := digestFiles(nil, sp.StateFile, sp.MemFile, sp.BaseDisk)
+	if err != nil {
+		return fmt.Errorf("digest snapshot artifacts: %w", err)
+	}
 	meta := snapshotMeta{
 		Version:        1,
 		LineageID:      cfg.BaseRootfsLineageID,
 		BaseRootfsPath: cfg.BaseRootfsPath,
+		VCPU:           shape.VCPU,
+		MemMiB:         shape.MemMiB,
 		CreatedAt:      time.Now().UTC().Format(time.RFC3339Nano),
+		Digests:        digests,
 	}
 	raw, err := json.MarshalIndent(meta, "", "  ")
 	if err != nil {
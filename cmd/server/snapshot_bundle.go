@@ -0,0 +1,390 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// A snapshot bundle is an uncompressed tar of one user snapshot's artifacts
+// followed by bundleManifestName. The manifest comes last so export can hash
+// the artifacts while streaming them. Diff snapshots are exported flattened,
+// so a bundle never depends on snapshots outside it.
+const (
+	bundleFormatVersion = 1
+	bundleManifestName  = "manifest.json"
+	maxBundleManifest   = 1 << 20
+)
+
+// bundleArtifacts are the files a bundle carries, in export order.
+var bundleArtifacts = []string{"state.snap", "mem.snap", "disk.ext4"}
+
+type bundleManifest struct {
+	FormatVersion int    `json:"format_version"`
+	ExportedAt    string `json:"exported_at"`
+
+	// Snapshot is the exported meta.json with artifact paths relative to the
+	// bundle. LineageID in it names the base rootfs the snapshot was taken on.
+	Snapshot userSnapshotMeta `json:"snapshot"`
+	Files    []bundleFile     `json:"files"`
+}
+
+type bundleFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+type snapshotImportResponse struct {
+	SnapshotID string `json:"snapshot_id"`
+	LineageID  string `json:"lineage_id"`
+	Bytes      int64  `json:"bytes"`
+}
+
+func importsDir(workDir string) string {
+	return filepath.Join(workDir, "imports")
+}
+
+// handleSnapshotExport streams GET /snapshot/{id}/export as a bundle.
+func (s *server) handleSnapshotExport(w http.ResponseWriter, r *http.Request) {
+	snapshotID, err := normalizeSnapshotID(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	meta, err := s.loadUserSnapshotMeta(snapshotID)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	if meta.Corrupt {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("snapshot %s is marked corrupt (%s)", snapshotID, meta.VerifyError)})
+		return
+	}
+	memFile, err := s.userSnapshotMemFile(meta)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("merge diff snapshot memory: %v", err)})
+		return
+	}
+	// Open everything up front: a concurrent delete then can't cut the
+	// stream short, and a missing artifact is still a clean error response.
+	files := make([]*os.File, 0, len(bundleArtifacts))
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+	for _, p := range []string{meta.StateFile, memFile, meta.DiskFile} {
+		f, err := os.Open(p)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("snapshot artifact missing: %v", err)})
+			return
+		}
+		files = append(files, f)
+	}
+
+	manifest := bundleManifest{
+		FormatVersion: bundleFormatVersion,
+		ExportedAt:    time.Now().UTC().Format(time.RFC3339Nano),
+		Snapshot:      meta,
+	}
+	manifest.Snapshot.StateFile = bundleArtifacts[0]
+	manifest.Snapshot.MemFile = bundleArtifacts[1]
+	manifest.Snapshot.DiskFile = bundleArtifacts[2]
+	manifest.Snapshot.SnapshotType = ""
+	manifest.Snapshot.ParentID = ""
+	manifest.Snapshot.VerifiedAt = ""
+
+	w.Header().Set("Content-Type", "application/x-tar")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", snapshotID+".tar"))
+	w.WriteHeader(http.StatusOK)
+
+	tw := tar.NewWriter(w)
+	for i, f := range files {
+		bf, err := writeBundleFile(tw, bundleArtifacts[i], f)
+		if err != nil {
+			// As with file downloads, abort rather than end a truncated
+			// bundle cleanly.
+			log.Printf("snapshot export %s failed: %v", snapshotID, err)
+			panic(http.ErrAbortHandler)
+		}
+		manifest.Files = append(manifest.Files, bf)
+	}
+	// The flattened memory of a diff snapshot has its own digest.
+	manifest.Snapshot.Digests = map[string]artifactDigest{}
+	for _, bf := range manifest.Files {
+		manifest.Snapshot.Digests[bf.Name] = artifactDigest{Size: bf.Size, SHA256: bf.SHA256}
+	}
+	raw, err := json.MarshalIndent(manifest, "", "  ")
+	if err == nil {
+		raw = append(raw, '\n')
+		err = tw.WriteHeader(&tar.Header{Name: bundleManifestName, Mode: 0o644, Size: int64(len(raw)), ModTime: time.Now()})
+	}
+	if err == nil {
+		_, err = tw.Write(raw)
+	}
+	if err == nil {
+		err = tw.Close()
+	}
+	if err != nil {
+		log.Printf("snapshot export %s failed: %v", snapshotID, err)
+		panic(http.ErrAbortHandler)
+	}
+}
+
+func writeBundleFile(tw *tar.Writer, name string, f *os.File) (bundleFile, error) {
+	st, err := f.Stat()
+	if err != nil {
+		return bundleFile{}, err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: st.Size(), ModTime: st.ModTime()}); err != nil {
+		return bundleFile{}, err
+	}
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tw, h), f)
+	if err != nil {
+		return bundleFile{}, fmt.Errorf("write %s: %w", name, err)
+	}
+	if n != st.Size() {
+		return bundleFile{}, fmt.Errorf("write %s: size changed during export", name)
+	}
+	return bundleFile{Name: name, Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// handleSnapshotImport registers the bundle in the request body as a user
+// snapshot, under the ID it was exported with or ?snapshot_id=. Every artifact
+// must match the manifest's size and digest, and the snapshot's base rootfs
+// must be the current one or in the base store.
+func (s *server) handleSnapshotImport(w http.ResponseWriter, r *http.Request) {
+	var overrideID string
+	if raw := r.URL.Query().Get("snapshot_id"); raw != "" {
+		id, err := normalizeSnapshotID(raw)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		overrideID = id
+	}
+
+	if err := os.MkdirAll(importsDir(s.cfg.WorkDir), 0o755); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("create imports dir: %v", err)})
+		return
+	}
+	stage, err := os.MkdirTemp(importsDir(s.cfg.WorkDir), "bundle-")
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("create import dir: %v", err)})
+		return
+	}
+	defer os.RemoveAll(stage)
+
+	manifest, got, err := extractBundle(r.Body, stage)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := verifyBundle(manifest, got); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	meta := manifest.Snapshot
+	// Until the snapshot is in the store, nothing keeps the GC from removing
+	// its base.
+	baseStoreMu.RLock()
+	defer baseStoreMu.RUnlock()
+	if err := s.checkSnapshotLineage(meta.LineageID); err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	snapshotID := overrideID
+	if snapshotID == "" {
+		if snapshotID, err = normalizeSnapshotID(meta.SnapshotID); err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("bundle: %v", err)})
+			return
+		}
+	}
+	rootDir := userSnapshotRootDir(s.cfg.WorkDir, snapshotID)
+
+	meta.SnapshotID = snapshotID
+	meta.StateFile = bundleArtifacts[0]
+	meta.MemFile = bundleArtifacts[1]
+	meta.DiskFile = bundleArtifacts[2]
+	meta.SnapshotType = ""
+	meta.ParentID = ""
+	meta.Digests = map[string]artifactDigest{}
+	for name, bf := range got {
+		meta.Digests[name] = artifactDigest{Size: bf.Size, SHA256: bf.SHA256}
+	}
+	meta.Corrupt = false
+	meta.VerifyError = ""
+	meta.VerifiedAt = time.Now().UTC().Format(time.RFC3339Nano)
+	if err := validateLabels(meta.Labels); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("bundle: %v", err)})
+		return
+	}
+	// meta.json is written in the staging dir with paths relative to it, so
+	// renaming the dir into place publishes a complete snapshot at once. The
+	// rename must not replace an existing dir: rename(2) would silently
+	// replace an empty one, such as an ID just reserved by a create.
+	if err := writeUserSnapshotMetaIn(stage, meta); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := os.MkdirAll(userSnapshotsDir(s.cfg.WorkDir), 0o755); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("create snapshot dir: %v", err)})
+		return
+	}
+	if err := unix.Renameat2(unix.AT_FDCWD, stage, unix.AT_FDCWD, rootDir, unix.RENAME_NOREPLACE); err != nil {
+		if errors.Is(err, unix.EEXIST) {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("snapshot %s already exists; pass ?snapshot_id= to import it under another id", snapshotID)})
+			return
+		}
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("register snapshot %s: %v", snapshotID, err)})
+		return
+	}
+	s.noteImportedSnapshotID(snapshotID)
+
+	var total int64
+	for _, f := range got {
+		total += f.Size
+	}
+	writeJSON(w, http.StatusOK, snapshotImportResponse{SnapshotID: snapshotID, LineageID: meta.LineageID, Bytes: total})
+}
+
+// extractBundle reads a bundle into dir, hashing each artifact as it is
+// written. Only the expected regular files are accepted.
+func extractBundle(body io.Reader, dir string) (bundleManifest, map[string]bundleFile, error) {
+	var (
+		manifest     bundleManifest
+		haveManifest bool
+		got          = map[string]bundleFile{}
+	)
+	allowed := map[string]bool{bundleManifestName: true}
+	for _, name := range bundleArtifacts {
+		allowed[name] = true
+	}
+	tr := tar.NewReader(body)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return manifest, nil, fmt.Errorf("read bundle: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg || !allowed[hdr.Name] {
+			return manifest, nil, fmt.Errorf("bundle: unexpected entry %q", hdr.Name)
+		}
+		allowed[hdr.Name] = false // each entry once
+
+		if hdr.Name == bundleManifestName {
+			if hdr.Size > maxBundleManifest {
+				return manifest, nil, fmt.Errorf("bundle: manifest too large")
+			}
+			raw, err := io.ReadAll(tr)
+			if err != nil {
+				return manifest, nil, fmt.Errorf("read bundle: %w", err)
+			}
+			if err := json.Unmarshal(raw, &manifest); err != nil {
+				return manifest, nil, fmt.Errorf("bundle: decode manifest: %w", err)
+			}
+			haveManifest = true
+			continue
+		}
+		bf, err := extractBundleFile(tr, filepath.Join(dir, hdr.Name))
+		if err != nil {
+			return manifest, nil, fmt.Errorf("read bundle entry %s: %w", hdr.Name, err)
+		}
+		bf.Name = hdr.Name
+		got[hdr.Name] = bf
+	}
+	if !haveManifest {
+		return manifest, nil, fmt.Errorf("bundle: missing %s", bundleManifestName)
+	}
+	return manifest, got, nil
+}
+
+// extractBundleFile copies r to path, leaving all-zero blocks as holes so
+// sparse disk and memory images stay sparse.
+func extractBundleFile(r io.Reader, path string) (bundleFile, error) {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return bundleFile{}, err
+	}
+	defer f.Close()
+
+	const block = 4096
+	var (
+		h    = sha256.New()
+		buf  = make([]byte, 1<<20)
+		zero = make([]byte, block)
+		off  int64
+	)
+	for {
+		n, rerr := io.ReadFull(r, buf)
+		h.Write(buf[:n])
+		for i := 0; i < n; i += block {
+			end := min(i+block, n)
+			if bytes.Equal(buf[i:end], zero[:end-i]) {
+				continue
+			}
+			if _, err := f.WriteAt(buf[i:end], off+int64(i)); err != nil {
+				return bundleFile{}, err
+			}
+		}
+		off += int64(n)
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			return bundleFile{}, rerr
+		}
+	}
+	if err := f.Truncate(off); err != nil {
+		return bundleFile{}, err
+	}
+	if err := f.Close(); err != nil {
+		return bundleFile{}, err
+	}
+	return bundleFile{Size: off, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+func verifyBundle(manifest bundleManifest, got map[string]bundleFile) error {
+	if manifest.FormatVersion != bundleFormatVersion {
+		return fmt.Errorf("bundle: unsupported format_version %d (want %d)", manifest.FormatVersion, bundleFormatVersion)
+	}
+	want := map[string]bundleFile{}
+	for _, f := range manifest.Files {
+		want[f.Name] = f
+	}
+	for _, name := range bundleArtifacts {
+		w, ok := want[name]
+		if !ok {
+			return fmt.Errorf("bundle: manifest has no entry for %s", name)
+		}
+		g, ok := got[name]
+		if !ok {
+			return fmt.Errorf("bundle: missing %s", name)
+		}
+		if g.Size != w.Size {
+			return fmt.Errorf("bundle: %s is %d bytes, manifest says %d", name, g.Size, w.Size)
+		}
+		if !strings.EqualFold(g.SHA256, w.SHA256) {
+			return fmt.Errorf("bundle: %s checksum mismatch", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// retentionPolicy bounds the user snapshots matching Selector (all of them
+// when empty). The snapshot GC deletes the oldest unpinned matches until every
+// limit holds; 0 disables a limit.
+type retentionPolicy struct {
+	Selector string `json:"selector,omitempty"`
+	MaxCount int    `json:"max_count,omitempty"`
+	MaxBytes int64  `json:"max_bytes,omitempty"`
+	MaxAge   string `json:"max_age,omitempty"`
+
+	sel    labelSelector
+	maxAge time.Duration
+}
+
+func (p retentionPolicy) String() string {
+	sel := p.Selector
+	if sel == "" {
+		sel = "*"
+	}
+	return fmt.Sprintf("policy %q", sel)
+}
+
+// loadRetentionPolicies builds the policy list from MANTA_SNAPSHOT_MAX_COUNT,
+// MANTA_SNAPSHOT_MAX_BYTES and MANTA_SNAPSHOT_MAX_AGE (one global policy) and
+// MANTA_SNAPSHOT_RETENTION_POLICIES, a JSON array of per-selector policies.
+func loadRetentionPolicies() ([]retentionPolicy, error) {
+	var policies []retentionPolicy
+	global := retentionPolicy{
+		MaxCount: intOr("MANTA_SNAPSHOT_MAX_COUNT", 0),
+		MaxBytes: int64(intOr("MANTA_SNAPSHOT_MAX_BYTES", 0)),
+		MaxAge:   envOr("MANTA_SNAPSHOT_MAX_AGE", ""),
+	}
+	if global.MaxCount != 0 || global.MaxBytes != 0 || global.MaxAge != "" {
+		policies = append(policies, global)
+	}
+	if raw := strings.TrimSpace(os.Getenv("MANTA_SNAPSHOT_RETENTION_POLICIES")); raw != "" {
+		var more []retentionPolicy
+		dec := json.NewDecoder(strings.NewReader(raw))
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&more); err != nil {
+			return nil, fmt.Errorf("invalid MANTA_SNAPSHOT_RETENTION_POLICIES: %w", err)
+		}
+		policies = append(policies, more...)
+	}
+	for i := range policies {
+		p := &policies[i]
+		if p.MaxCount < 0 || p.MaxBytes < 0 {
+			return nil, fmt.Errorf("snapshot retention %s: limits must be >= 0", p)
+		}
+		sel, err := parseLabelSelector(p.Selector)
+		if err != nil {
+			return nil, fmt.Errorf("snapshot retention %s: %w", p, err)
+		}
+		p.sel = sel
+		if p.MaxAge != "" {
+			if p.maxAge, err = time.ParseDuration(p.MaxAge); err != nil || p.maxAge <= 0 {
+				return nil, fmt.Errorf("snapshot retention %s: invalid max_age %q", p, p.MaxAge)
+			}
+		}
+	}
+	return policies, nil
+}
+
+// startSnapshotGC enforces snapshot expiry and the retention policies every
+// cfg.SnapshotGCInterval. The returned func stops it.
+func (s *server) startSnapshotGC() (stop func()) {
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(s.cfg.SnapshotGCInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case now := <-ticker.C:
+				if err := s.collectSnapshots(now); err != nil {
+					log.Printf("snapshot gc: %v", err)
+				}
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// snapshotGC is one collection pass over the store.
+type snapshotGC struct {
+	s        *server
+	children map[string]int // diff children per parent
+	deleted  map[string]bool
+	usage    map[string]snapshotUsage
+}
+
+func (s *server) collectSnapshots(now time.Time) error {
+	items, err := s.listUserSnapshots()
+	if err != nil {
+		return err
+	}
+	gc := &snapshotGC{s: s, children: map[string]int{}, deleted: map[string]bool{}, usage: map[string]snapshotUsage{}}
+	for _, m := range items {
+		if m.isDiff() {
+			gc.children[m.ParentID]++
+		}
+	}
+
+	// items is newest first. Expired diff children go before their parents.
+	for _, m := range items {
+		if exp, err := time.Parse(time.RFC3339Nano, m.ExpiresAt); err == nil && now.After(exp) {
+			gc.delete(m, "expired")
+		}
+	}
+	for _, p := range s.cfg.SnapshotPolicies {
+		var matched []userSnapshotMeta
+		for _, m := range gc.live(items) {
+			if p.sel.matches(m.Labels) {
+				matched = append(matched, m)
+			}
+		}
+		if p.maxAge > 0 {
+			cutoff := now.Add(-p.maxAge)
+			for _, m := range matched {
+				if created, err := time.Parse(time.RFC3339Nano, m.CreatedAt); err == nil && created.Before(cutoff) {
+					gc.delete(m, fmt.Sprintf("%s: older than %s", p, p.MaxAge))
+				}
+			}
+			matched = gc.live(matched)
+		}
+		if p.MaxCount > 0 {
+			matched = gc.evict(matched, fmt.Sprintf("%s: over %d snapshots", p, p.MaxCount), func(set []userSnapshotMeta) bool {
+				return len(set) > p.MaxCount
+			})
+		}
+		if p.MaxBytes > 0 {
+			gc.evict(matched, fmt.Sprintf("%s: over %d bytes", p, p.MaxBytes), func(set []userSnapshotMeta) bool {
+				return gc.bytes(set) > p.MaxBytes
+			})
+		}
+	}
+	s.pruneBases(now)
+	return nil
+}
+
+// evict deletes the oldest deletable snapshot in set (newest first) while
+// over reports the set over its limit, and returns what is left.
+func (gc *snapshotGC) evict(set []userSnapshotMeta, reason string, over func([]userSnapshotMeta) bool) []userSnapshotMeta {
+	for over(set) {
+		i := len(set) - 1
+		for i >= 0 && !gc.deletable(set[i]) {
+			i--
+		}
+		if i < 0 || !gc.delete(set[i], reason) {
+			log.Printf("snapshot gc: %s, but no remaining snapshot can be deleted (pinned or parent of a diff snapshot)", reason)
+			return set
+		}
+		set = slices.Delete(set, i, i+1)
+	}
+	return set
+}
+
+func (gc *snapshotGC) live(set []userSnapshotMeta) []userSnapshotMeta {
+	var out []userSnapshotMeta
+	for _, m := range set {
+		if !gc.deleted[m.SnapshotID] {
+			out = append(out, m)
+		}
+	}
+	return out
+}
+
+func (gc *snapshotGC) bytes(set []userSnapshotMeta) int64 {
+	usages := make([]snapshotUsage, 0, len(set))
+	for _, m := range set {
+		u, ok := gc.usage[m.SnapshotID]
+		if !ok {
+			u, _ = measureSnapshotDir(userSnapshotRootDir(gc.s.cfg.WorkDir, m.SnapshotID))
+			gc.usage[m.SnapshotID] = u
+		}
+		usages = append(usages, u)
+	}
+	return combinedUsage(usages)
+}
+
+func (gc *snapshotGC) deletable(m userSnapshotMeta) bool {
+	return !gc.deleted[m.SnapshotID] && !m.Pinned && gc.children[m.SnapshotID] == 0
+}
+
+func (gc *snapshotGC) delete(m userSnapshotMeta, reason string) bool {
+	if !gc.deletable(m) {
+		return false
+	}
+	// The children counted at the start of the pass miss diff captures
+	// finished or still running since; removeUserSnapshot checks again.
+	if err := gc.s.removeUserSnapshot(m.SnapshotID); err != nil {
+		log.Printf("snapshot gc: delete %s: %v", m.SnapshotID, err)
+		return false
+	}
+	log.Printf("snapshot gc: deleted %s (%s)", m.SnapshotID, reason)
+	gc.s.untagSnapshot(m.SnapshotID)
+	gc.deleted[m.SnapshotID] = true
+	if m.isDiff() {
+		gc.children[m.ParentID]--
+	}
+	return true
+}
+
+type snapshotUpdateRequest struct {
+	// Pinned, when set, pins or unpins the snapshot.
+	Pinned *bool `json:"pinned,omitempty"`
+	// TTLSeconds, when set, moves the snapshot's expiry to that long from
+	// now; 0 clears it.
+	TTLSeconds *int64 `json:"ttl_seconds,omitempty"`
+}
+
+// handleSnapshotUpdate changes a snapshot's retention settings
+// (PATCH /snapshot/{id}) and returns the updated snapshot.
+func (s *server) handleSnapshotUpdate(w http.ResponseWriter, r *http.Request) {
+	snapshotID, err := normalizeSnapshotID(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	var req snapshotUpdateRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	if req.TTLSeconds != nil && *req.TTLSeconds < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "ttl_seconds must be >= 0"})
+		return
+	}
+	if _, err := s.loadUserSnapshotMeta(snapshotID); err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	meta, err := s.updateUserSnapshotMeta(snapshotID, func(m *userSnapshotMeta) error {
+		if req.Pinned != nil {
+			m.Pinned = *req.Pinned
+		}
+		if req.TTLSeconds != nil {
+			m.ExpiresAt = ""
+			if *req.TTLSeconds > 0 {
+				m.ExpiresAt = formatExpiry(time.Now().Add(time.Duration(*req.TTLSeconds) * time.Second))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, s.userSnapshotInfo(meta))
+}
+
+// userSnapshotInfo is a snapshot as listed by the API: its metadata plus the
+// tags pointing at it and its current footprint on disk.
+type userSnapshotInfo struct {
+	userSnapshotMeta
+	Tags        []string `json:"tags,omitempty"`
+	SizeBytes   int64    `json:"size_bytes"`
+	SharedBytes int64    `json:"shared_bytes"`
+}
+
+func (s *server) userSnapshotInfo(meta userSnapshotMeta) userSnapshotInfo {
+	u, err := measureSnapshotDir(userSnapshotRootDir(s.cfg.WorkDir, meta.SnapshotID))
+	if err != nil {
+		log.Printf("measure snapshot %s: %v", meta.SnapshotID, err)
+	}
+	info := userSnapshotInfo{userSnapshotMeta: meta, SizeBytes: u.Allocated, SharedBytes: u.Shared}
+	if tags, err := s.loadSnapshotTags(); err == nil {
+		info.Tags = tagsBySnapshot(tags)[meta.SnapshotID]
+	}
+	return info
+}
@@ -0,0 +1,340 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// Snapshot IDs are immutable: the server never hands out an ID it has handed
+// out before, even after the snapshot is deleted and the server restarted.
+// Tags are the mutable names on top, "name:tag" pointing at a snapshot ID, so
+// a client can restore "python-env:latest" while the tag moves from snapshot
+// to snapshot. They are kept in one file next to the snapshot dirs; the
+// leading dot keeps it clear of snapshot IDs.
+const snapshotTagsFile = ".tags.json"
+
+// snapshotIDMarkFile records the highest us-N ever reserved or imported, so
+// the counter survives the deletion of that snapshot.
+const snapshotIDMarkFile = ".last-id"
+
+const defaultSnapshotTag = "latest"
+
+var snapshotTagPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}:[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+var errTagNotFound = errors.New("snapshot tag not found")
+
+// normalizeSnapshotTag validates raw as name:tag; a bare name means
+// name:latest.
+func normalizeSnapshotTag(raw string) (string, error) {
+	tag := strings.TrimSpace(raw)
+	if tag == "" {
+		return "", fmt.Errorf("tag is required")
+	}
+	if !strings.Contains(tag, ":") {
+		tag += ":" + defaultSnapshotTag
+	}
+	if !snapshotTagPattern.MatchString(tag) {
+		return "", fmt.Errorf("invalid tag %q (want name:tag)", raw)
+	}
+	return tag, nil
+}
+
+// snapshotIDMu serializes ID reservations, so the high-water mark is written
+// in order.
+var snapshotIDMu sync.Mutex
+
+// newUserSnapshotID reserves the next free us-N ID by creating its dir, so an
+// ID already on disk (imported, say) is skipped rather than overwritten, and
+// persists it as the high-water mark before handing it out.
+func (s *server) newUserSnapshotID() (string, error) {
+	snapshotIDMu.Lock()
+	defer snapshotIDMu.Unlock()
+	if err := os.MkdirAll(userSnapshotsDir(s.cfg.WorkDir), 0o755); err != nil {
+		return "", fmt.Errorf("create snapshot dir: %w", err)
+	}
+	for {
+		n := atomic.AddUint64(&s.nextSnapshotID, 1)
+		id := fmt.Sprintf("us-%d", n)
+		dir := userSnapshotRootDir(s.cfg.WorkDir, id)
+		err := os.Mkdir(dir, 0o755)
+		if errors.Is(err, unix.EEXIST) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("create snapshot dir: %w", err)
+		}
+		if err := s.writeSnapshotIDMark(n); err != nil {
+			_ = os.Remove(dir)
+			return "", err
+		}
+		return id, nil
+	}
+}
+
+// noteImportedSnapshotID moves the high-water mark past an imported us-N, so
+// that its ID is not handed out again once it is deleted.
+func (s *server) noteImportedSnapshotID(id string) {
+	num, ok := strings.CutPrefix(id, "us-")
+	if !ok {
+		return
+	}
+	n, err := strconv.ParseUint(num, 10, 64)
+	if err != nil {
+		return
+	}
+	snapshotIDMu.Lock()
+	defer snapshotIDMu.Unlock()
+	if n <= atomic.LoadUint64(&s.nextSnapshotID) {
+		return
+	}
+	atomic.StoreUint64(&s.nextSnapshotID, n)
+	if err := s.writeSnapshotIDMark(n); err != nil {
+		log.Printf("import snapshot %s: %v", id, err)
+	}
+}
+
+func (s *server) snapshotIDMarkPath() string {
+	return filepath.Join(userSnapshotsDir(s.cfg.WorkDir), snapshotIDMarkFile)
+}
+
+// writeSnapshotIDMark atomically records n as the high-water mark. Callers
+// hold snapshotIDMu.
+func (s *server) writeSnapshotIDMark(n uint64) error {
+	path := s.snapshotIDMarkPath()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(strconv.FormatUint(n, 10)+"\n"), 0o644); err != nil {
+		return fmt.Errorf("write snapshot id mark: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("persist snapshot id mark: %w", err)
+	}
+	return nil
+}
+
+// seedUserSnapshotID moves the ID counter past the high-water mark and the
+// highest us-N in the store; the latter covers stores from before the mark
+// was kept.
+func (s *server) seedUserSnapshotID() {
+	if raw, err := os.ReadFile(s.snapshotIDMarkPath()); err == nil {
+		n, err := strconv.ParseUint(strings.TrimSpace(string(raw)), 10, 64)
+		if err != nil {
+			log.Printf("seed snapshot id: invalid %s: %v", snapshotIDMarkFile, err)
+		} else if n > atomic.LoadUint64(&s.nextSnapshotID) {
+			atomic.StoreUint64(&s.nextSnapshotID, n)
+		}
+	}
+	entries, err := os.ReadDir(userSnapshotsDir(s.cfg.WorkDir))
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		num, ok := strings.CutPrefix(e.Name(), "us-")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseUint(num, 10, 64)
+		if err == nil && n > atomic.LoadUint64(&s.nextSnapshotID) {
+			atomic.StoreUint64(&s.nextSnapshotID, n)
+		}
+	}
+}
+
+func (s *server) snapshotTagsPath() string {
+	return filepath.Join(userSnapshotsDir(s.cfg.WorkDir), snapshotTagsFile)
+}
+
+// loadSnapshotTags returns the tag -> snapshot ID map.
+func (s *server) loadSnapshotTags() (map[string]string, error) {
+	tags := map[string]string{}
+	raw, err := os.ReadFile(s.snapshotTagsPath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return tags, nil
+		}
+		return nil, fmt.Errorf("read snapshot tags: %w", err)
+	}
+	if err := json.Unmarshal(raw, &tags); err != nil {
+		return nil, fmt.Errorf("decode snapshot tags: %w", err)
+	}
+	return tags, nil
+}
+
+// updateSnapshotTags applies update to the current tags and atomically
+// writes them back. It shares snapshotMetaMu with meta.json updates.
+func (s *server) updateSnapshotTags(update func(tags map[string]string) error) error {
+	snapshotMetaMu.Lock()
+	defer snapshotMetaMu.Unlock()
+	tags, err := s.loadSnapshotTags()
+	if err != nil {
+		return err
+	}
+	if err := update(tags); err != nil {
+		return err
+	}
+	raw, err := json.MarshalIndent(tags, "", "  ")
+	if err != nil {
+		return fmt.Errorf("encode snapshot tags: %w", err)
+	}
+	raw = append(raw, '\n')
+	if err := os.MkdirAll(userSnapshotsDir(s.cfg.WorkDir), 0o755); err != nil {
+		return fmt.Errorf("create snapshot dir: %w", err)
+	}
+	path := s.snapshotTagsPath()
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return fmt.Errorf("write snapshot tags: %w", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		return fmt.Errorf("persist snapshot tags: %w", err)
+	}
+	return nil
+}
+
+// tagSnapshot points tag at snapshotID, which must exist.
+func (s *server) tagSnapshot(tag, snapshotID string) error {
+	return s.updateSnapshotTags(func(tags map[string]string) error {
+		if _, err := s.loadUserSnapshotMeta(snapshotID); err != nil {
+			return err
+		}
+		tags[tag] = snapshotID
+		return nil
+	})
+}
+
+// untagSnapshot removes the tags pointing at a deleted snapshot.
+func (s *server) untagSnapshot(snapshotID string) {
+	err := s.updateSnapshotTags(func(tags map[string]string) error {
+		for tag, id := range tags {
+			if id == snapshotID {
+				delete(tags, tag)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("untag snapshot %s: %v", snapshotID, err)
+	}
+}
+
+func (s *server) resolveSnapshotTag(raw string) (string, error) {
+	tag, err := normalizeSnapshotTag(raw)
+	if err != nil {
+		return "", err
+	}
+	tags, err := s.loadSnapshotTags()
+	if err != nil {
+		return "", err
+	}
+	id, ok := tags[tag]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", errTagNotFound, tag)
+	}
+	return id, nil
+}
+
+// tagsBySnapshot inverts tags to snapshot ID -> sorted tags.
+func tagsBySnapshot(tags map[string]string) map[string][]string {
+	out := map[string][]string{}
+	for tag, id := range tags {
+		out[id] = append(out[id], tag)
+	}
+	for _, t := range out {
+		sort.Strings(t)
+	}
+	return out
+}
+
+type snapshotTagRequest struct {
+	SnapshotID string `json:"snapshot_id"`
+}
+
+type snapshotTag struct {
+	Tag        string `json:"tag"`
+	SnapshotID string `json:"snapshot_id"`
+}
+
+// handleSnapshotTagPut points a tag at a snapshot (PUT /snapshot/tags/{tag}),
+// creating the tag or moving it.
+func (s *server) handleSnapshotTagPut(w http.ResponseWriter, r *http.Request) {
+	tag, err := normalizeSnapshotTag(r.PathValue("tag"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	var req snapshotTagRequest
+	if err := decodeJSON(r.Body, &req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
+		return
+	}
+	snapshotID, err := normalizeSnapshotID(req.SnapshotID)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if _, err := s.loadUserSnapshotMeta(snapshotID); err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := s.tagSnapshot(tag, snapshotID); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshotTag{Tag: tag, SnapshotID: snapshotID})
+}
+
+// handleSnapshotTagDelete removes a tag (DELETE /snapshot/tags/{tag}); the
+// snapshot itself is kept.
+func (s *server) handleSnapshotTagDelete(w http.ResponseWriter, r *http.Request) {
+	tag, err := normalizeSnapshotTag(r.PathValue("tag"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	var snapshotID string
+	err = s.updateSnapshotTags(func(tags map[string]string) error {
+		id, ok := tags[tag]
+		if !ok {
+			return fmt.Errorf("%w: %s", errTagNotFound, tag)
+		}
+		snapshotID = id
+		delete(tags, tag)
+		return nil
+	})
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errTagNotFound) {
+			status = http.StatusNotFound
+		}
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, snapshotTag{Tag: tag, SnapshotID: snapshotID})
+}
+
+// handleSnapshotTagList lists all tags (GET /snapshot/tags), sorted by tag.
+func (s *server) handleSnapshotTagList(w http.ResponseWriter, r *http.Request) {
+	tags, err := s.loadSnapshotTags()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	out := make([]snapshotTag, 0, len(tags))
+	for tag, id := range tags {
+		out = append(out, snapshotTag{Tag: tag, SnapshotID: id})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Tag < out[j].Tag })
+	writeJSON(w, http.StatusOK, map[string]any{"tags": out})
+}
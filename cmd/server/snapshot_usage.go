@@ -0,0 +1,134 @@
+package main
+
+import (
+	"cmp"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"slices"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// Snapshot artifacts are often reflink clones of each other (and of sandbox
+// disks), so summing file sizes overstates what the store costs. Usage is
+// measured from allocated blocks instead, with shared extents located through
+// FIEMAP so that blocks shared between snapshots are only counted once. On
+// filesystems without FIEMAP, everything counts as exclusive.
+
+const (
+	fsIocFiemap        = 0xC020660B // _IOWR('f', 11, struct fiemap)
+	fiemapExtentLast   = 0x1
+	fiemapExtentShared = 0x2000
+	fiemapHeaderSize   = 32
+	fiemapExtentSize   = 56
+	fiemapBatch        = 256
+)
+
+type physExtent struct {
+	start, end uint64
+}
+
+// snapshotUsage is the on-disk footprint of one snapshot dir.
+type snapshotUsage struct {
+	// Allocated is the bytes of blocks allocated to the dir's files; Shared
+	// is the part of that in extents also referenced by other files.
+	Allocated int64
+	Shared    int64
+	shared    []physExtent
+}
+
+func measureSnapshotDir(dir string) (snapshotUsage, error) {
+	var u snapshotUsage
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return u, err
+	}
+	for _, e := range entries {
+		if !e.Type().IsRegular() {
+			continue
+		}
+		p := filepath.Join(dir, e.Name())
+		var st unix.Stat_t
+		if err := unix.Stat(p, &st); err != nil {
+			continue // removed meanwhile
+		}
+		u.Allocated += st.Blocks * 512
+		extents, err := sharedExtents(p)
+		if err != nil {
+			continue
+		}
+		for _, x := range extents {
+			u.Shared += int64(x.end - x.start)
+		}
+		u.shared = append(u.shared, extents...)
+	}
+	return u, nil
+}
+
+// sharedExtents returns the physical ranges of path that FIEMAP reports as
+// shared.
+func sharedExtents(path string) ([]physExtent, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	// struct fiemap followed by fiemapBatch struct fiemap_extent. Backed by
+	// uint64s so the ioctl sees an 8-byte aligned buffer.
+	words := make([]uint64, (fiemapHeaderSize+fiemapBatch*fiemapExtentSize)/8)
+	buf := unsafe.Slice((*byte)(unsafe.Pointer(&words[0])), len(words)*8)
+	le := binary.NativeEndian
+	var out []physExtent
+	for start := uint64(0); ; {
+		clear(buf)
+		le.PutUint64(buf[0:], start)        // fm_start
+		le.PutUint64(buf[8:], ^uint64(0))   // fm_length
+		le.PutUint32(buf[24:], fiemapBatch) // fm_extent_count
+		_, _, errno := unix.Syscall(unix.SYS_IOCTL, f.Fd(), fsIocFiemap, uintptr(unsafe.Pointer(&buf[0])))
+		if errno != 0 {
+			return nil, errno
+		}
+		mapped := le.Uint32(buf[20:]) // fm_mapped_extents
+		if mapped == 0 {
+			return out, nil
+		}
+		for i := range int(mapped) {
+			x := buf[fiemapHeaderSize+i*fiemapExtentSize:]
+			logical, physical, length := le.Uint64(x[0:]), le.Uint64(x[8:]), le.Uint64(x[16:])
+			flags := le.Uint32(x[40:])
+			if flags&fiemapExtentShared != 0 {
+				out = append(out, physExtent{physical, physical + length})
+			}
+			if flags&fiemapExtentLast != 0 {
+				return out, nil
+			}
+			start = logical + length
+		}
+	}
+}
+
+// combinedUsage is the bytes used by a set of snapshots together: each one's
+// exclusive blocks plus the union of their shared extents.
+func combinedUsage(usages []snapshotUsage) int64 {
+	var total int64
+	var shared []physExtent
+	for _, u := range usages {
+		total += u.Allocated - u.Shared
+		shared = append(shared, u.shared...)
+	}
+	slices.SortFunc(shared, func(a, b physExtent) int { return cmp.Compare(a.start, b.start) })
+	var cur physExtent
+	for _, x := range shared {
+		if x.start > cur.end {
+			total += int64(cur.end - cur.start)
+			cur = x
+			continue
+		}
+		cur.end = max(cur.end, x.end)
+	}
+	total += int64(cur.end - cur.start)
+	return total
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// artifactDigest is the size and SHA-256 of a snapshot artifact, recorded
+// when the snapshot is written. Sizes are checked on every restore; digests
+// only when verification is asked for, since hashing reads the whole file.
+type artifactDigest struct {
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+var errSnapshotCorrupt = errors.New("snapshot is corrupt")
+
+// fileDigest hashes path, also writing what it reads to progress if that is
+// non-nil.
+func fileDigest(path string, progress io.Writer) (artifactDigest, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return artifactDigest{}, err
+	}
+	defer f.Close()
+	h := sha256.New()
+	var w io.Writer = h
+	if progress != nil {
+		w = io.MultiWriter(h, progress)
+	}
+	n, err := io.Copy(w, f)
+	if err != nil {
+		return artifactDigest{}, fmt.Errorf("hash %s: %w", path, err)
+	}
+	return artifactDigest{Size: n, SHA256: hex.EncodeToString(h.Sum(nil))}, nil
+}
+
+// digestFiles records a digest for each path, keyed by file name.
+func digestFiles(progress io.Writer, paths ...string) (map[string]artifactDigest, error) {
+	out := make(map[string]artifactDigest, len(paths))
+	for _, p := range paths {
+		d, err := fileDigest(p, progress)
+		if err != nil {
+			return nil, err
+		}
+		out[filepath.Base(p)] = d
+	}
+	return out, nil
+}
+
+// checkDigests compares each path against its recorded digest: the size
+// always, the content too if full is set. Files without a recorded digest
+// (snapshots written before digests were kept) are skipped.
+func checkDigests(recorded map[string]artifactDigest, full bool, paths ...string) error {
+	for _, p := range paths {
+		want, ok := recorded[filepath.Base(p)]
+		if !ok {
+			continue
+		}
+		st, err := os.Stat(p)
+		if err != nil {
+			return fmt.Errorf("%w: %v", errSnapshotCorrupt, err)
+		}
+		if st.Size() != want.Size {
+			return fmt.Errorf("%w: %s is %d bytes, expected %d", errSnapshotCorrupt, filepath.Base(p), st.Size(), want.Size)
+		}
+		if !full {
+			continue
+		}
+		got, err := fileDigest(p, nil)
+		if err != nil {
+			return err
+		}
+		if !strings.EqualFold(got.SHA256, want.SHA256) {
+			return fmt.Errorf("%w: %s checksum mismatch", errSnapshotCorrupt, filepath.Base(p))
+		}
+	}
+	return nil
+}
+
+// verifyUserSnapshot checks meta's artifacts and, for a diff snapshot, the
+// memory layers of its ancestors, which a restore merges in.
+func (s *server) verifyUserSnapshot(meta userSnapshotMeta, full bool) error {
+	if err := checkDigests(meta.Digests, full, meta.StateFile, meta.MemFile, meta.DiskFile); err != nil {
+		return err
+	}
+	if !meta.isDiff() {
+		return nil
+	}
+	chain, err := s.snapshotChain(meta)
+	if err != nil {
+		return fmt.Errorf("%w: %v", errSnapshotCorrupt, err)
+	}
+	for _, parent := range chain[1:] {
+		if err := checkDigests(parent.Digests, full, parent.MemFile); err != nil {
+			return fmt.Errorf("parent %s: %w", parent.SnapshotID, err)
+		}
+	}
+	return nil
+}
+
+// recordVerifyResult marks the snapshot corrupt or clears the mark. Only
+// corruption errors mark it; an I/O failure while reading says nothing about
+// the contents.
+func (s *server) recordVerifyResult(snapshotID string, verr error) (userSnapshotMeta, error) {
+	return s.updateUserSnapshotMeta(snapshotID, func(m *userSnapshotMeta) error {
+		switch {
+		case verr == nil:
+			m.Corrupt = false
+			m.VerifyError = ""
+			m.VerifiedAt = time.Now().UTC().Format(time.RFC3339Nano)
+		case errors.Is(verr, errSnapshotCorrupt):
+			m.Corrupt = true
+			m.VerifyError = verr.Error()
+			m.VerifiedAt = time.Now().UTC().Format(time.RFC3339Nano)
+		}
+		return nil
+	})
+}
+
+type snapshotVerifyResponse struct {
+	SnapshotID string `json:"snapshot_id"`
+	Status     string `json:"status"` // "ok" or "corrupt"
+	Error      string `json:"error,omitempty"`
+	VerifiedAt string `json:"verified_at"`
+}
+
+// handleSnapshotVerify hashes every artifact of a snapshot against its
+// recorded digests (POST /snapshot/{id}/verify). A snapshot without recorded
+// digests gets them recorded now.
+func (s *server) handleSnapshotVerify(w http.ResponseWriter, r *http.Request) {
+	snapshotID, err := normalizeSnapshotID(r.PathValue("id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	meta, err := s.loadUserSnapshotMeta(snapshotID)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	if len(meta.Digests) == 0 {
+		digests, err := digestFiles(nil, meta.StateFile, meta.MemFile, meta.DiskFile)
+		if err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		if _, err := s.updateUserSnapshotMeta(snapshotID, func(m *userSnapshotMeta) error {
+			m.Digests = digests
+			return nil
+		}); err != nil {
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		meta.Digests = digests
+	}
+
+	verr := s.verifyUserSnapshot(meta, true)
+	if verr != nil && !errors.Is(verr, errSnapshotCorrupt) {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": verr.Error()})
+		return
+	}
+	meta, err = s.recordVerifyResult(snapshotID, verr)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	resp := snapshotVerifyResponse{SnapshotID: snapshotID, Status: "ok", VerifiedAt: meta.VerifiedAt}
+	if verr != nil {
+		resp.Status = "corrupt"
+		resp.Error = verr.Error()
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
@@ -52,6 +52,39 @@ type config struct {
 	BootArgs         string
 	DefaultMemMiB    int
 	DefaultVCPU      int
+
+	// Bounds for the per-sandbox machine size requested on /create. Disk size
+	// can only grow the base image, up to MaxDiskMiB.
+	MinVCPU    int
+	MaxVCPU    int
+	MinMemMiB  int
+	MaxMemMiB  int
+	MaxDiskMiB int
+
+	// Default lifetime limits for sandboxes that don't set their own; 0
+	// disables them. The reaper checks for expired sandboxes every
+	// ReaperInterval.
+	DefaultTTL         time.Duration
+	DefaultIdleTimeout time.Duration
+	ReaperInterval     time.Duration
+
+	// EnableDiffSnapshots turns on dirty page tracking in every VM, so user
+	// snapshots can store only the memory changed since the previous one.
+	EnableDiffSnapshots bool
+
+	// VerifySnapshots hashes user snapshot artifacts before every restore, and
+	// golden snapshot artifacts once per server process, against the digests
+	// recorded when they were written. Sizes are always checked.
+	VerifySnapshots bool
+
+	// RecoverSandboxes leaves sandboxes running when the server shuts down and
+	// adopts them again on the next start, instead of destroying them.
+	RecoverSandboxes bool
+
+	// The snapshot GC deletes expired user snapshots and enforces the
+	// retention policies every SnapshotGCInterval.
+	SnapshotPolicies   []retentionPolicy
+	SnapshotGCInterval time.Duration
 }
 
 type sandbox struct {
@@ -69,14 +102,50 @@ type sandbox struct {
 	RootfsPath string
 	LogPath    string
 	CgroupPath string
-	Process    *exec.Cmd
-	SSHClient  *ssh.Client // debug-only; exec path no longer depends on SSH
-	Agent      *agentConn
-	agentMu    sync.Mutex
+	VCPU       int
+	MemMiB     int
+	DiskMiB    int
+	CreatedAt  time.Time
+	Source     sandboxSource
+	// LineageID is the base rootfs the sandbox's disk descends from.
+	LineageID string
+	Labels    map[string]string // set at creation, read-only afterwards
+	Process   *exec.Cmd
+	// adopted marks a sandbox taken over from a previous server process; its
+	// Firecracker is not our child, so it can't be waited for.
+	adopted   bool
+	SSHClient *ssh.Client // debug-only; exec path no longer depends on SSH
+	Agent     *agentConn
+	agentMu   sync.Mutex
+	// agentCalls is held shared by calls on Agent and exclusively by a
+	// capture, which closes Agent only once they have finished.
+	agentCalls sync.RWMutex
+
+	// pauseMu serializes Firecracker pause/resume: the pause and resume
+	// endpoints, and snapshot creation, which pauses the VM around the capture.
+	pauseMu sync.Mutex
+
+	// trackDirty is set when the VM tracks dirty pages. diffParentID names
+	// the user snapshot the VM's dirty pages are relative to: the last one
+	// taken of it, or the one it was restored from. A diff snapshot is only
+	// possible while it is set. It is changed under pauseMu and lifecycleMu,
+	// so holding either is enough to read it.
+	trackDirty   bool
+	diffParentID string
 
 	lifecycleMu  sync.Mutex
 	state        sandboxState
 	inFlightExec int
+	closeCh      chan struct{}
+
+	// Expiry, guarded by lifecycleMu. deadline is the TTL expiry (zero for
+	// none); ttl is what keepalive extends it by. A sandbox with an idle
+	// timeout expires once that long has passed since lastActivity with no
+	// exec in flight.
+	ttl          time.Duration
+	deadline     time.Time
+	idleTimeout  time.Duration
+	lastActivity time.Time
 }
 
 type server struct {
@@ -85,16 +154,43 @@ type server struct {
 	nextSandboxID  uint64
 	nextSnapshotID uint64
 	nextSubnet     uint32
+	nextExecID     uint64
 	sandboxes      map[string]*sandbox
+	execs          map[string]*execSession
 	netnsPool      *netnsPool
+	ops            operations
+}
+
+// createRequest is the optional body of POST /create. Zero fields use the
+// server defaults; DiskMiB 0 keeps the base image size.
+type createRequest struct {
+	VCPU    int `json:"vcpu,omitempty"`
+	MemMiB  int `json:"mem_mib,omitempty"`
+	DiskMiB int `json:"disk_mib,omitempty"`
+
+	// Optional lifetime limits; 0 uses the server default.
+	TTLSeconds         int64 `json:"ttl_seconds,omitempty"`
+	IdleTimeoutSeconds int64 `json:"idle_timeout_seconds,omitempty"`
+
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 type createResponse struct {
 	SandboxID string `json:"sandbox_id"`
+	VCPU      int    `json:"vcpu"`
+	MemMiB    int    `json:"mem_mib"`
+	DiskMiB   int    `json:"disk_mib"`
+	ExpiresAt string `json:"expires_at,omitempty"`
 }
 
 type execRequest struct {
 	SandboxID string `json:"sandbox_id"`
+
+	// Optional client-chosen handle for POST /exec/{exec_id}/signal, useful
+	// for signalling a blocking /exec from another request. Must be unused;
+	// default: server-assigned "ex-N".
+	ExecID string `json:"exec_id,omitempty"`
+
 	// Shell mode (default for backward compatibility): run /bin/sh -lc <cmd>.
 	Cmd string `json:"cmd,omitempty"`
 
@@ -108,18 +204,44 @@ type execRequest struct {
 
 	// Optional per-request timeout override. 0 uses server default.
 	TimeoutMs int64 `json:"timeout_ms,omitempty"`
+
+	// Optional working directory and extra environment for the process.
+	Cwd string            `json:"cwd,omitempty"`
+	Env map[string]string `json:"env,omitempty"`
+
+	// Optional identity to run as. User is a guest account name; UID/GID select
+	// numeric ids directly (GID may also override User's primary group).
+	// Default: the agent's identity (root).
+	User string  `json:"user,omitempty"`
+	UID  *uint32 `json:"uid,omitempty"`
+	GID  *uint32 `json:"gid,omitempty"`
+
+	// Optional stdin for the process (base64 in JSON).
+	Stdin []byte `json:"stdin,omitempty"`
+
+	// Resume the sandbox first if it is paused, instead of failing.
+	AutoResume bool `json:"auto_resume,omitempty"`
+
+	// /exec/stream only: keep stdin open after Stdin is written so more input
+	// can be sent via POST /exec/{exec_id}/stdin.
+	StdinStream bool `json:"stdin_stream,omitempty"`
 }
 
 type execResponse struct {
+	ExecID   string `json:"exec_id,omitempty"`
 	Stdout   string `json:"stdout"`
 	Stderr   string `json:"stderr"`
 	ExitCode int    `json:"exit_code"`
 }
 
+// destroyRequest names one sandbox by ID, or every sandbox whose labels match
+// Selector.
 type destroyRequest struct {
-	SandboxID string `json:"sandbox_id"`
+	SandboxID string `json:"sandbox_id,omitempty"`
+	Selector  string `json:"selector,omitempty"`
 }
 
 type destroyResponse struct {
-	Status string `json:"status"`
+	Status    string   `json:"status"`
+	Destroyed []string `json:"destroyed"`
 }
@@ -2,32 +2,78 @@ package main
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"log"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
 	"sort"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 )
 
 type snapshotCreateRequest struct {
-	SandboxID string `json:"sandbox_id"`
-	Name      string `json:"name,omitempty"`
+	SandboxID string            `json:"sandbox_id"`
+	Name      string            `json:"name,omitempty"`
+	Labels    map[string]string `json:"labels,omitempty"`
+
+	// Diff stores only the memory changed since the sandbox's previous
+	// snapshot (or the snapshot it was restored from), which becomes the new
+	// snapshot's parent. Requires MANTA_ENABLE_DIFF_SNAPSHOTS.
+	Diff bool `json:"diff,omitempty"`
+
+	// TTLSeconds has the snapshot deleted by the snapshot GC that long after
+	// creation. Pinned snapshots are never deleted by the GC.
+	TTLSeconds int64 `json:"ttl_seconds,omitempty"`
+	Pinned     bool  `json:"pinned,omitempty"`
+
+	// Tag (name:tag) is pointed at the new snapshot once it is written.
+	Tag string `json:"tag,omitempty"`
+
+	// Async returns 202 with an operation ID right away instead of waiting
+	// for the snapshot; GET /operations/{id} reports progress and, once it
+	// succeeds, the snapshotCreateResponse as its result.
+	Async bool `json:"async,omitempty"`
+}
+
+type snapshotCreateAsyncResponse struct {
+	OperationID string `json:"operation_id"`
+	SnapshotID  string `json:"snapshot_id"`
 }
 
 type snapshotCreateResponse struct {
-	SnapshotID string `json:"snapshot_id"`
+	SnapshotID   string `json:"snapshot_id"`
+	SnapshotType string `json:"snapshot_type"`
+	ParentID     string `json:"parent_id,omitempty"`
+	ExpiresAt    string `json:"expires_at,omitempty"`
 }
 
 type snapshotRestoreRequest struct {
+	// Either SnapshotID or Tag (name:tag, resolved to the snapshot it
+	// currently points at).
 	SnapshotID string `json:"snapshot_id"`
+	Tag        string `json:"tag,omitempty"`
+
+	// Optional lifetime limits for the restored sandbox; 0 uses the server
+	// default.
+	TTLSeconds         int64 `json:"ttl_seconds,omitempty"`
+	IdleTimeoutSeconds int64 `json:"idle_timeout_seconds,omitempty"`
+
+	// Labels for the restored sandbox, on top of the snapshot's own labels.
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Verify hashes the snapshot's artifacts against their recorded digests
+	// before restoring, as MANTA_VERIFY_SNAPSHOTS does for every restore.
+	Verify bool `json:"verify,omitempty"`
 }
 
 type snapshotRestoreResponse struct {
 	SandboxID string `json:"sandbox_id"`
+	ExpiresAt string `json:"expires_at,omitempty"`
 }
 
 type snapshotDeleteRequest struct {
@@ -38,6 +84,9 @@ type snapshotDeleteResponse struct {
 	Status string `json:"status"`
 }
 
+// userSnapshotMeta is stored as meta.json in the snapshot's dir. The artifact
+// paths are written relative to that dir, so the dir can be moved or bundled;
+// loadUserSnapshotMeta resolves them (older metas may hold absolute paths).
 type userSnapshotMeta struct {
 	SnapshotID       string `json:"snapshot_id"`
 	Name             string `json:"name,omitempty"`
@@ -46,8 +95,41 @@ type userSnapshotMeta struct {
 	MemFile          string `json:"mem_file"`
 	DiskFile         string `json:"disk_file"`
 	LineageID        string `json:"lineage_id"`
+	VCPU             int    `json:"vcpu,omitempty"`
+	MemMiB           int    `json:"mem_mib,omitempty"`
+	DiskMiB          int    `json:"disk_mib,omitempty"`
 	SourceSandboxID  string `json:"source_sandbox_id"`
 	SourceRootfsPath string `json:"source_rootfs_path"`
+
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// A diff snapshot's MemFile is a sparse layer holding only the pages
+	// dirtied since ParentID; restoring it merges the chain down to the
+	// nearest full snapshot. Empty means full.
+	SnapshotType string `json:"snapshot_type,omitempty"`
+	ParentID     string `json:"parent_id,omitempty"`
+
+	// Retention: the snapshot GC deletes the snapshot after ExpiresAt, and
+	// never deletes a pinned one.
+	ExpiresAt string `json:"expires_at,omitempty"`
+	Pinned    bool   `json:"pinned,omitempty"`
+
+	// Digests of the artifacts, keyed by file name. Corrupt is set when a
+	// verification found an artifact that no longer matches; such a snapshot
+	// is not restored until a later verification passes.
+	Digests     map[string]artifactDigest `json:"digests,omitempty"`
+	Corrupt     bool                      `json:"corrupt,omitempty"`
+	VerifyError string                    `json:"verify_error,omitempty"`
+	VerifiedAt  string                    `json:"verified_at,omitempty"`
+}
+
+const (
+	snapshotTypeFull = "full"
+	snapshotTypeDiff = "diff"
+)
+
+func (m userSnapshotMeta) isDiff() bool {
+	return m.SnapshotType == snapshotTypeDiff
 }
 
 var snapshotIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
@@ -85,6 +167,26 @@ func (s *server) handleSnapshotCreate(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "sandbox_id is required"})
 		return
 	}
+	if err := validateLabels(req.Labels); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if req.TTLSeconds < 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "ttl_seconds must be >= 0"})
+		return
+	}
+	if req.Tag != "" {
+		tag, err := normalizeSnapshotTag(req.Tag)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		req.Tag = tag
+	}
+	if req.Diff && !s.cfg.EnableDiffSnapshots {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "diff snapshots are disabled (set MANTA_ENABLE_DIFF_SNAPSHOTS=1)"})
+		return
+	}
 
 	s.mu.Lock()
 	sb := s.sandboxes[req.SandboxID]
@@ -94,13 +196,57 @@ func (s *server) handleSnapshotCreate(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	snapshotID := fmt.Sprintf("us-%d", atomic.AddUint64(&s.nextSnapshotID, 1))
-	meta, err := s.createUserSnapshotFromSandbox(sb, snapshotID, req.Name)
+	if req.Async {
+		// Keep the sandbox from being destroyed or reaped while it is
+		// captured in the background.
+		if err := sb.tryStartExec(); err != nil {
+			writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+			return
+		}
+		snapshotID, err := s.newUserSnapshotID()
+		if err != nil {
+			sb.finishExec()
+			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+			return
+		}
+		op := s.ops.start("snapshot_create")
+		go func() {
+			defer sb.finishExec()
+			meta, err := s.createUserSnapshotFromSandbox(sb, snapshotID, req, op)
+			if err != nil {
+				log.Printf("snapshot create %s (%s) failed: %v", snapshotID, op.ID, err)
+				op.finish(nil, err)
+				return
+			}
+			op.finish(newSnapshotCreateResponse(meta), nil)
+		}()
+		writeJSON(w, http.StatusAccepted, snapshotCreateAsyncResponse{OperationID: op.ID, SnapshotID: snapshotID})
+		return
+	}
+
+	snapshotID, err := s.newUserSnapshotID()
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		return
 	}
-	writeJSON(w, http.StatusOK, snapshotCreateResponse{SnapshotID: meta.SnapshotID})
+	meta, err := s.createUserSnapshotFromSandbox(sb, snapshotID, req, nil)
+	if err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errNoDiffParent) {
+			status = http.StatusConflict
+		}
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, newSnapshotCreateResponse(meta))
+}
+
+func newSnapshotCreateResponse(meta userSnapshotMeta) snapshotCreateResponse {
+	resp := snapshotCreateResponse{SnapshotID: meta.SnapshotID, SnapshotType: snapshotTypeFull, ParentID: meta.ParentID, ExpiresAt: meta.ExpiresAt}
+	if meta.isDiff() {
+		resp.SnapshotType = snapshotTypeDiff
+	}
+	return resp
 }
 
 func (s *server) handleSnapshotRestore(w http.ResponseWriter, r *http.Request) {
@@ -109,28 +255,65 @@ func (s *server) handleSnapshotRestore(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "invalid request body"})
 		return
 	}
+	if req.Tag != "" {
+		if req.SnapshotID != "" {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "set snapshot_id or tag, not both"})
+			return
+		}
+		tag, err := normalizeSnapshotTag(req.Tag)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		id, err := s.resolveSnapshotTag(tag)
+		if err != nil {
+			status := http.StatusInternalServerError
+			if errors.Is(err, errTagNotFound) {
+				status = http.StatusNotFound
+			}
+			writeJSON(w, status, map[string]string{"error": err.Error()})
+			return
+		}
+		req.SnapshotID = id
+	}
 	snapshotID, err := normalizeSnapshotID(req.SnapshotID)
 	if err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
+	ttl, idleTimeout, err := sandboxTimeouts(s.cfg, req.TTLSeconds, req.IdleTimeoutSeconds)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := validateLabels(req.Labels); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
 
 	meta, err := s.loadUserSnapshotMeta(snapshotID)
 	if err != nil {
 		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
 		return
 	}
-	currentLineage := strings.TrimSpace(s.cfg.BaseRootfsLineageID)
-	metaLineage := strings.TrimSpace(meta.LineageID)
-	if currentLineage != "" {
-		if metaLineage == "" {
-			writeJSON(w, http.StatusConflict, map[string]string{"error": "snapshot meta missing lineage id"})
-			return
-		}
-		if metaLineage != currentLineage {
-			writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("snapshot lineage mismatch (snapshot=%s current=%s)", metaLineage, currentLineage)})
-			return
+	if err := s.checkSnapshotLineage(meta.LineageID); err != nil {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": err.Error()})
+		return
+	}
+	if meta.Corrupt {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("snapshot %s is marked corrupt (%s); POST /snapshot/%s/verify to recheck it", snapshotID, meta.VerifyError, snapshotID)})
+		return
+	}
+	if err := s.verifyUserSnapshot(meta, req.Verify || s.cfg.VerifySnapshots); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errSnapshotCorrupt) {
+			status = http.StatusConflict
+			if _, merr := s.recordVerifyResult(snapshotID, err); merr != nil {
+				log.Printf("mark snapshot %s corrupt: %v", snapshotID, merr)
+			}
 		}
+		writeJSON(w, status, map[string]string{"error": err.Error()})
+		return
 	}
 
 	id := fmt.Sprintf("sb-%d", atomic.AddUint64(&s.nextSandboxID, 1))
@@ -140,19 +323,44 @@ func (s *server) handleSnapshotRestore(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	sb.Labels = mergeLabels(meta.Labels, req.Labels)
+	sb.setExpiry(ttl, idleTimeout)
+	s.persistSandbox(sb)
 	s.mu.Lock()
 	s.sandboxes[sb.ID] = sb
 	s.mu.Unlock()
-	writeJSON(w, http.StatusOK, snapshotRestoreResponse{SandboxID: sb.ID})
+	writeJSON(w, http.StatusOK, snapshotRestoreResponse{SandboxID: sb.ID, ExpiresAt: formatExpiry(sb.expiresAt())})
 }
 
-func (s *server) handleSnapshotList(w http.ResponseWriter, _ *http.Request) {
+func (s *server) handleSnapshotList(w http.ResponseWriter, r *http.Request) {
+	sel, err := parseLabelSelector(r.URL.Query().Get("selector"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
 	items, err := s.listUserSnapshots()
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		return
 	}
-	writeJSON(w, http.StatusOK, map[string]any{"snapshots": items})
+	// total_bytes covers the whole store, with blocks shared between
+	// snapshots counted once.
+	tags, err := s.loadSnapshotTags()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	byID := tagsBySnapshot(tags)
+	matched := []userSnapshotInfo{}
+	usages := make([]snapshotUsage, 0, len(items))
+	for _, meta := range items {
+		u, _ := measureSnapshotDir(userSnapshotRootDir(s.cfg.WorkDir, meta.SnapshotID))
+		usages = append(usages, u)
+		if sel.matches(meta.Labels) {
+			matched = append(matched, userSnapshotInfo{userSnapshotMeta: meta, Tags: byID[meta.SnapshotID], SizeBytes: u.Allocated, SharedBytes: u.Shared})
+		}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"snapshots": matched, "total_bytes": combinedUsage(usages)})
 }
 
 func (s *server) handleSnapshotDelete(w http.ResponseWriter, r *http.Request) {
@@ -166,19 +374,118 @@ func (s *server) handleSnapshotDelete(w http.ResponseWriter, r *http.Request) {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
-	if err := os.RemoveAll(userSnapshotRootDir(s.cfg.WorkDir, snapshotID)); err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("delete snapshot: %v", err)})
+	if err := s.removeUserSnapshot(snapshotID); err != nil {
+		status := http.StatusInternalServerError
+		if errors.Is(err, errSnapshotInUse) {
+			status = http.StatusConflict
+		}
+		writeJSON(w, status, map[string]string{"error": err.Error()})
 		return
 	}
+	s.untagSnapshot(snapshotID)
 	writeJSON(w, http.StatusOK, snapshotDeleteResponse{Status: "ok"})
 }
 
-func (s *server) createUserSnapshotFromSandbox(sb *sandbox, snapshotID, name string) (userSnapshotMeta, error) {
+// createUserSnapshotFromSandbox captures sb as snapshot snapshotID, reporting
+// progress to op (which may be nil).
+func (s *server) createUserSnapshotFromSandbox(sb *sandbox, snapshotID string, req snapshotCreateRequest, op *operation) (userSnapshotMeta, error) {
 	if sb == nil {
 		return userSnapshotMeta{}, fmt.Errorf("sandbox is nil")
 	}
+	rootDir := userSnapshotRootDir(s.cfg.WorkDir, snapshotID)
+	if err := os.MkdirAll(rootDir, 0o755); err != nil {
+		return userSnapshotMeta{}, fmt.Errorf("create snapshot dir: %w", err)
+	}
+	files, err := s.captureSandbox(sb, rootDir, snapshotID, req.Diff, op)
+	if err != nil {
+		_ = os.RemoveAll(rootDir)
+		return userSnapshotMeta{}, err
+	}
+	if files.ParentID != "" {
+		// Once meta.json is written, diffChildren protects the parent.
+		defer releaseDiffParent(files.ParentID)
+	}
+
+	now := time.Now()
+	meta := userSnapshotMeta{
+		SnapshotID:       snapshotID,
+		Name:             strings.TrimSpace(req.Name),
+		CreatedAt:        now.UTC().Format(time.RFC3339Nano),
+		StateFile:        files.StateFile,
+		MemFile:          files.MemFile,
+		DiskFile:         files.DiskFile,
+		LineageID:        sb.LineageID,
+		VCPU:             sb.VCPU,
+		MemMiB:           sb.MemMiB,
+		DiskMiB:          diskSizeMiB(files.DiskFile),
+		SourceSandboxID:  sb.ID,
+		SourceRootfsPath: sb.RootfsPath,
+		Labels:           mergeLabels(nil, req.Labels),
+		ParentID:         files.ParentID,
+		Pinned:           req.Pinned,
+	}
+	if req.TTLSeconds > 0 {
+		meta.ExpiresAt = formatExpiry(now.Add(time.Duration(req.TTLSeconds) * time.Second))
+	}
+	// The VM is already running again: flushing the artifacts to disk and
+	// hashing them only holds up this request.
+	artifacts := []string{files.StateFile, files.MemFile, files.DiskFile}
+	var total int64
+	for _, p := range artifacts {
+		total += fileSize(p)
+	}
+	op.setPhase("writing_meta", total)
+	if err := syncFiles(artifacts...); err != nil {
+		_ = os.RemoveAll(rootDir)
+		return userSnapshotMeta{}, fmt.Errorf("sync snapshot artifacts: %w", err)
+	}
+	if meta.Digests, err = digestFiles(op, artifacts...); err != nil {
+		_ = os.RemoveAll(rootDir)
+		return userSnapshotMeta{}, fmt.Errorf("digest snapshot artifacts: %w", err)
+	}
+	if files.ParentID != "" {
+		meta.SnapshotType = snapshotTypeDiff
+	}
+	if err := s.writeUserSnapshotMeta(meta); err != nil {
+		_ = os.RemoveAll(rootDir)
+		return userSnapshotMeta{}, err
+	}
+	if req.Tag != "" {
+		if err := s.tagSnapshot(req.Tag, snapshotID); err != nil {
+			return meta, fmt.Errorf("snapshot %s created, but tagging it failed: %w", snapshotID, err)
+		}
+	}
+	return meta, nil
+}
+
+// capturedSandbox is the set of files a sandbox snapshot consists of. For a
+// diff capture, ParentID names the snapshot MemFile is a layer on top of; it
+// is held (see holdDiffParent) until the caller releases it.
+type capturedSandbox struct {
+	StateFile string
+	MemFile   string
+	DiskFile  string
+	ParentID  string
+}
+
+var errNoDiffParent = errors.New("no parent for a diff snapshot: the sandbox has no earlier snapshot since it was created or forked, or that snapshot was deleted; take a full snapshot first")
+
+// captureSandbox pauses sb, writes a Firecracker snapshot and a copy of its
+// disk into dir, and resumes it. A sandbox paused through the API stays
+// paused. snapshotID becomes the parent for the sandbox's next diff capture;
+// pass "" for a snapshot that won't be kept. Progress goes to op, if any.
+//
+// The disk has to be copied before the VM resumes, or it would not match the
+// memory; with reflink clones that costs next to nothing, so the VM runs
+// again as soon as Firecracker has written the state and memory.
+func (s *server) captureSandbox(sb *sandbox, dir, snapshotID string, diff bool, op *operation) (capturedSandbox, error) {
+	op.setPhase("pausing", 0)
 	// Avoid snapshotting an active host<->guest agent stream. A stale captured
-	// vsock session can delay agent re-readiness after restore.
+	// vsock session can delay agent re-readiness after restore. Calls on the
+	// shared connection are let finish first, and new ones wait until the
+	// capture is done.
+	sb.agentCalls.Lock()
+	defer sb.agentCalls.Unlock()
 	sb.agentMu.Lock()
 	if sb.Agent != nil {
 		_ = sb.Agent.Close()
@@ -186,64 +493,100 @@ func (s *server) createUserSnapshotFromSandbox(sb *sandbox, snapshotID, name str
 	}
 	sb.agentMu.Unlock()
 
-	rootDir := userSnapshotRootDir(s.cfg.WorkDir, snapshotID)
-	if err := os.MkdirAll(rootDir, 0o755); err != nil {
-		return userSnapshotMeta{}, fmt.Errorf("create snapshot dir: %w", err)
+	files := capturedSandbox{
+		StateFile: filepath.Join(dir, "state.snap"),
+		MemFile:   filepath.Join(dir, "mem.snap"),
+		DiskFile:  filepath.Join(dir, "disk.ext4"),
 	}
-	stateFile := filepath.Join(rootDir, "state.snap")
-	memFile := filepath.Join(rootDir, "mem.snap")
-	diskFile := filepath.Join(rootDir, "disk.ext4")
 
+	sb.pauseMu.Lock()
+	defer sb.pauseMu.Unlock()
+	if diff {
+		if !sb.trackDirty || sb.diffParentID == "" {
+			return files, errNoDiffParent
+		}
+		if err := s.holdDiffParent(sb.diffParentID); err != nil {
+			return files, errNoDiffParent
+		}
+		files.ParentID = sb.diffParentID
+	}
+	captured := false
+	defer func() {
+		if !captured && files.ParentID != "" {
+			releaseDiffParent(files.ParentID)
+		}
+	}()
 	fc := newFCClient(sb.SocketPath, 10*time.Second)
 	if err := fc.pauseVM(); err != nil {
-		return userSnapshotMeta{}, fmt.Errorf("pause vm: %w", err)
+		return files, fmt.Errorf("pause vm: %w", err)
 	}
-	resumeNeeded := true
+	resumeNeeded := !sb.isPaused()
 	defer func() {
 		if resumeNeeded {
 			_ = fc.resumeVM()
 		}
 	}()
 
-	_ = os.Remove(stateFile)
-	_ = os.Remove(memFile)
-	_ = os.Remove(diskFile)
+	_ = os.Remove(files.StateFile)
+	_ = os.Remove(files.MemFile)
+	_ = os.Remove(files.DiskFile)
 
-	if err := fc.createFullSnapshot(stateFile, memFile); err != nil {
-		return userSnapshotMeta{}, fmt.Errorf("create user snapshot: %w", err)
+	create := fc.createFullSnapshot
+	if diff {
+		create = fc.createDiffSnapshot
+	}
+	// Any snapshot attempt resets dirty page tracking, so the old parent is
+	// no longer valid whatever happens next.
+	sb.setDiffParent("")
+	if sb.trackDirty {
+		defer s.persistSandbox(sb)
+	}
+	op.setPhase("writing_memory", int64(sb.MemMiB)<<20)
+	stopTracking := op.trackFile(files.MemFile)
+	err := create(files.StateFile, files.MemFile)
+	stopTracking()
+	if err != nil {
+		return files, fmt.Errorf("create user snapshot: %w", err)
 	}
-	if err := materializeSandboxRootfs(s.cfg, sb.RootfsPath, diskFile); err != nil {
-		return userSnapshotMeta{}, fmt.Errorf("persist snapshot disk: %w", err)
+	op.setPhase("copying_disk", fileSize(sb.RootfsPath))
+	stopTracking = op.trackFile(files.DiskFile)
+	err = materializeSandboxRootfs(s.cfg, sb.RootfsPath, files.DiskFile)
+	stopTracking()
+	if err != nil {
+		return files, fmt.Errorf("persist snapshot disk: %w", err)
 	}
 
-	meta := userSnapshotMeta{
-		SnapshotID:       snapshotID,
-		Name:             strings.TrimSpace(name),
-		CreatedAt:        time.Now().UTC().Format(time.RFC3339Nano),
-		StateFile:        stateFile,
-		MemFile:          memFile,
-		DiskFile:         diskFile,
-		LineageID:        s.cfg.BaseRootfsLineageID,
-		SourceSandboxID:  sb.ID,
-		SourceRootfsPath: sb.RootfsPath,
-	}
-	if err := s.writeUserSnapshotMeta(meta); err != nil {
-		return userSnapshotMeta{}, err
+	if resumeNeeded {
+		if err := fc.resumeVM(); err != nil {
+			return files, fmt.Errorf("resume vm after snapshot: %w", err)
+		}
+		resumeNeeded = false
 	}
-	if err := fc.resumeVM(); err != nil {
-		return userSnapshotMeta{}, fmt.Errorf("resume vm after snapshot: %w", err)
+	if sb.trackDirty {
+		sb.setDiffParent(snapshotID)
 	}
-	resumeNeeded = false
-	return meta, nil
+	captured = true
+	return files, nil
 }
 
 func (s *server) writeUserSnapshotMeta(meta userSnapshotMeta) error {
+	return writeUserSnapshotMetaIn(userSnapshotRootDir(s.cfg.WorkDir, meta.SnapshotID), meta)
+}
+
+// writeUserSnapshotMetaIn atomically writes meta.json into dir, with artifact
+// paths under dir made relative to it.
+func writeUserSnapshotMetaIn(dir string, meta userSnapshotMeta) error {
+	for _, p := range []*string{&meta.StateFile, &meta.MemFile, &meta.DiskFile} {
+		if rel, err := filepath.Rel(dir, *p); err == nil && filepath.IsAbs(*p) && filepath.IsLocal(rel) {
+			*p = rel
+		}
+	}
 	raw, err := json.MarshalIndent(meta, "", "  ")
 	if err != nil {
 		return fmt.Errorf("encode snapshot meta: %w", err)
 	}
 	raw = append(raw, '\n')
-	metaPath := userSnapshotMetaPath(s.cfg.WorkDir, meta.SnapshotID)
+	metaPath := filepath.Join(dir, "meta.json")
 	tmp := metaPath + ".tmp"
 	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
 		return fmt.Errorf("write snapshot meta: %w", err)
@@ -254,6 +597,25 @@ func (s *server) writeUserSnapshotMeta(meta userSnapshotMeta) error {
 	return nil
 }
 
+// snapshotMetaMu serializes read-modify-write updates of existing meta.json
+// files.
+var snapshotMetaMu sync.Mutex
+
+// updateUserSnapshotMeta applies update to the snapshot's current meta and
+// writes it back.
+func (s *server) updateUserSnapshotMeta(snapshotID string, update func(*userSnapshotMeta) error) (userSnapshotMeta, error) {
+	snapshotMetaMu.Lock()
+	defer snapshotMetaMu.Unlock()
+	meta, err := s.loadUserSnapshotMeta(snapshotID)
+	if err != nil {
+		return meta, err
+	}
+	if err := update(&meta); err != nil {
+		return meta, err
+	}
+	return meta, s.writeUserSnapshotMeta(meta)
+}
+
 func (s *server) loadUserSnapshotMeta(snapshotID string) (userSnapshotMeta, error) {
 	snapshotID, err := normalizeSnapshotID(snapshotID)
 	if err != nil {
@@ -271,6 +633,12 @@ func (s *server) loadUserSnapshotMeta(snapshotID string) (userSnapshotMeta, erro
 	if strings.TrimSpace(meta.SnapshotID) == "" {
 		meta.SnapshotID = snapshotID
 	}
+	rootDir := userSnapshotRootDir(s.cfg.WorkDir, snapshotID)
+	for _, p := range []*string{&meta.StateFile, &meta.MemFile, &meta.DiskFile} {
+		if *p != "" && !filepath.IsAbs(*p) {
+			*p = filepath.Join(rootDir, *p)
+		}
+	}
 	return meta, nil
 }
 
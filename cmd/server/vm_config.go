@@ -6,7 +6,7 @@ import (
 	"os"
 )
 
-func writeVMConfig(configPath string, cfg config, tapDevice, rootfsPath string, subnet int, vsockPath string, guestCID uint32) error {
+func writeVMConfig(configPath string, cfg config, shape machineShape, tapDevice, rootfsPath string, subnet int, vsockPath string, guestCID uint32) error {
 	type bootSource struct {
 		KernelImagePath string `json:"kernel_image_path"`
 		BootArgs        string `json:"boot_args"`
@@ -23,8 +23,9 @@ func writeVMConfig(configPath string, cfg config, tapDevice, rootfsPath string,
 		HostDevName string `json:"host_dev_name"`
 	}
 	type machineConfig struct {
-		VCPUCount  int `json:"vcpu_count"`
-		MemSizeMiB int `json:"mem_size_mib"`
+		VCPUCount       int  `json:"vcpu_count"`
+		MemSizeMiB      int  `json:"mem_size_mib"`
+		TrackDirtyPages bool `json:"track_dirty_pages,omitempty"`
 	}
 	type vsockConfig struct {
 		GuestCID uint32 `json:"guest_cid"`
@@ -54,8 +55,9 @@ func writeVMConfig(configPath string, cfg config, tapDevice, rootfsPath string,
 			},
 		},
 		"machine-config": machineConfig{
-			VCPUCount:  cfg.DefaultVCPU,
-			MemSizeMiB: cfg.DefaultMemMiB,
+			VCPUCount:       shape.VCPU,
+			MemSizeMiB:      shape.MemMiB,
+			TrackDirtyPages: cfg.EnableDiffSnapshots,
 		},
 		"vsock": vsockConfig{
 			GuestCID: guestCID,
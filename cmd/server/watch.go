@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"manta/internal/agentrpc"
+)
+
+// watchEvent is one NDJSON line of a GET /sandboxes/{id}/watch response. The
+// first line is always "ready", sent once the watch is in place; "error" is
+// terminal. The other types mirror agentrpc.FSEvent.
+type watchEvent struct {
+	Type       string `json:"type"` // "ready", "create", "modify", "delete", "rename", "overflow", "error"
+	Path       string `json:"path,omitempty"`
+	OldPath    string `json:"old_path,omitempty"`
+	IsDir      bool   `json:"is_dir,omitempty"`
+	TimeUnixMs int64  `json:"time_unix_ms,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// handleWatch streams filesystem changes under ?path= as NDJSON until the
+// client disconnects, the watched directory is removed, or the sandbox is
+// destroyed. With recursive=1, subdirectories (including ones created later)
+// are watched too.
+func (s *server) handleWatch(w http.ResponseWriter, r *http.Request) {
+	guestPath, err := guestPathParam(r)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	recursive, err := boolParam(r, "recursive", false)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	// Watches count as in-flight execs, like terminals, and end when the
+	// sandbox starts closing so /destroy doesn't wait them out.
+	sb, ok := s.acquireSandbox(w, r.PathValue("id"), "filesystem watches")
+	if !ok {
+		return
+	}
+	defer sb.finishExec()
+
+	// Events are pushed for as long as the watch lives, so it gets its own
+	// connection rather than occupying the shared one.
+	ac, err := dialAgent(sb.VsockPath, s.cfg.AgentPort, s.cfg.AgentDialTimeout)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent dial failed: %v", err)})
+		return
+	}
+	defer ac.Close()
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	go func() {
+		// Either the client left or the sandbox is going away; dropping the
+		// connection makes the agent remove its inotify watches.
+		select {
+		case <-sb.closing():
+		case <-ctx.Done():
+		}
+		_ = ac.Close()
+	}()
+
+	st, err := ac.OpenStream(agentrpc.Request{
+		Type:  "watch",
+		Watch: &agentrpc.WatchRequest{Path: guestPath, Recursive: recursive},
+	}, 0)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": fmt.Sprintf("agent watch failed: %v", err)})
+		return
+	}
+	defer st.Close()
+
+	// The first frame confirms the watch, or reports why it couldn't start.
+	resp, err := st.Recv()
+	if err != nil {
+		writeAgentError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	write := func(ev watchEvent) error {
+		if err := enc.Encode(ev); err != nil {
+			return err
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		return nil
+	}
+
+	if err := write(watchEvent{Type: "ready", Path: guestPath}); err != nil {
+		return
+	}
+	for resp.More {
+		resp, err = st.Recv()
+		if err != nil {
+			msg := err.Error()
+			select {
+			case <-sb.closing():
+				msg = "sandbox destroyed"
+			default:
+			}
+			_ = write(watchEvent{Type: "error", Error: msg})
+			return
+		}
+		for _, ev := range resp.Events {
+			if err := write(watchEvent{
+				Type:       ev.Type,
+				Path:       ev.Path,
+				OldPath:    ev.OldPath,
+				IsDir:      ev.IsDir,
+				TimeUnixMs: ev.TimeUnixMs,
+			}); err != nil {
+				return
+			}
+		}
+	}
+}
@@ -7,11 +7,11 @@ require (
 	github.com/vishvananda/netlink v1.3.1
 	github.com/vishvananda/netns v0.0.5
 	golang.org/x/crypto v0.39.0
+	golang.org/x/net v0.21.0
+	golang.org/x/sys v0.33.0
 )
 
 require (
 	github.com/mdlayher/socket v0.4.1 // indirect
-	golang.org/x/net v0.21.0 // indirect
 	golang.org/x/sync v0.1.0 // indirect
-	golang.org/x/sys v0.33.0 // indirect
 )
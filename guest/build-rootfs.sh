@@ -92,7 +92,7 @@ trap cleanup EXIT
 chroot "${STAGING}" /bin/sh -c '
   set -eux
   apk add --no-cache \
-    alpine-base openrc openssh-server iproute2 python3 nodejs npm curl git bash
+    alpine-base openrc openssh-server iproute2 python3 nodejs npm curl git bash zstd e2fsprogs-extra
 '
 
 mkdir -p "${STAGING}/root/.ssh"
@@ -110,6 +110,11 @@ if ! grep -q '^PasswordAuthentication no' "${STAGING}/etc/ssh/sshd_config"; then
 fi
 
 chroot "${STAGING}" /usr/bin/ssh-keygen -A
+
+# Unprivileged account for running untrusted workloads (/exec "user":"sandbox").
+if ! grep -q '^sandbox:' "${STAGING}/etc/passwd"; then
+  chroot "${STAGING}" /usr/sbin/adduser -D -h /home/sandbox -s /bin/sh sandbox
+fi
 echo "sandbox" > "${STAGING}/etc/hostname"
 
 # Install manta-agent and enable it at boot.
@@ -16,7 +16,19 @@ import (
 //   uint32_be payload_len
 //   payload_len bytes of UTF-8 JSON
 //
-// A single connection can carry multiple request/response pairs.
+// A single connection multiplexes any number of in-flight requests. The host
+// gives each request an ID that is unique on the connection, and the agent
+// stamps that ID on every response frame it sends for it, so frames for
+// different requests may interleave. Most requests are answered by exactly
+// one response frame; streaming requests ("exec_stream", "pty", "file_read",
+// "archive_export", "watch") are answered by any number of frames with More set,
+// followed by one final frame with More unset.
+//
+// While a request is in flight the host may send follow-up frames carrying the
+// same ID: input for it ("pty_input" for "pty", "stdin" for "exec_stream" with
+// StdinStream set, "file_data" for "file_write" and "archive_import") or
+// "cancel", which stops it. Requests still in flight when their connection
+// closes are cancelled.
 
 const (
 	// DefaultPort is the AF_VSOCK port the agent listens on in the guest.
@@ -24,22 +36,66 @@ const (
 
 	// MaxMessageBytes caps a single framed JSON payload to avoid OOM.
 	MaxMessageBytes = 8 << 20 // 8 MiB
+
+	// FileChunkBytes is the data payload size of file transfer frames. Files
+	// of any size are moved as a sequence of such frames.
+	FileChunkBytes = 256 << 10
+)
+
+// Error codes classify failed responses (Response.Code) so the host can map
+// them without parsing messages.
+const (
+	CodeNotFound   = "not_found"
+	CodeExists     = "exists"
+	CodePermission = "permission"
 )
 
 type Request struct {
-	Type string `json:"type"` // "ping", "exec", "net"
+	ID uint64 `json:"id,omitempty"`
+
+	// "ping", "exec", "exec_stream", "net", "pty", "pty_input", "stdin",
+	// "proc_start", "proc_list", "proc_get", "proc_logs", "proc_signal",
+	// "proc_wait", "signal", "cancel", "file_write", "file_data", "file_read",
+	// "archive_import", "archive_export", "fs_list", "fs_stat", "fs_mkdir",
+	// "fs_remove", "fs_rename", "watch"
+	Type string `json:"type"`
 
-	Exec *ExecRequest `json:"exec,omitempty"`
-	Net  *NetRequest  `json:"net,omitempty"`
+	// Exec is also the payload of "proc_start"; its timeout and stdin fields
+	// are ignored there.
+	Exec     *ExecRequest    `json:"exec,omitempty"`
+	Net      *NetRequest     `json:"net,omitempty"`
+	PTY      *PTYRequest     `json:"pty,omitempty"`
+	PTYInput *PTYInput       `json:"pty_input,omitempty"`
+	Chunk    *DataChunk      `json:"chunk,omitempty"`
+	Proc     *ProcRequest    `json:"proc,omitempty"`
+	Signal   *SignalRequest  `json:"signal,omitempty"`
+	File     *FileRequest    `json:"file,omitempty"`
+	Archive  *ArchiveRequest `json:"archive,omitempty"`
+	FS       *FSRequest      `json:"fs,omitempty"`
+	Watch    *WatchRequest   `json:"watch,omitempty"`
 }
 
 type Response struct {
+	ID uint64 `json:"id,omitempty"` // ID of the request being answered
+
 	OK    bool   `json:"ok"`
 	Error string `json:"error,omitempty"`
+	Code  string `json:"code,omitempty"` // one of the Code* constants, if known
+
+	// More is set on every frame of a streaming response except the last.
+	More bool `json:"more,omitempty"`
 
-	Ping *PingResponse `json:"ping,omitempty"`
-	Exec *ExecResponse `json:"exec,omitempty"`
-	Net  *NetResponse  `json:"net,omitempty"`
+	Ping   *PingResponse `json:"ping,omitempty"`
+	Exec   *ExecResponse `json:"exec,omitempty"`
+	Output *ExecOutput   `json:"output,omitempty"`
+	Net    *NetResponse  `json:"net,omitempty"`
+	Proc   *ProcResponse `json:"proc,omitempty"`
+	File   *FileInfo     `json:"file,omitempty"`
+	Chunk  *DataChunk    `json:"chunk,omitempty"`
+
+	Archive *ArchiveResponse `json:"archive,omitempty"`
+	FS      *FSResponse      `json:"fs,omitempty"`
+	Events  []FSEvent        `json:"events,omitempty"`
 }
 
 type PingResponse struct {
@@ -50,23 +106,249 @@ type PingResponse struct {
 // ExecRequest supports both a shell command and an argv form. Exactly one of
 // Cmd or Argv should be provided.
 type ExecRequest struct {
+	// ExecID names a running "exec"/"exec_stream" command so a "signal"
+	// request, possibly on another connection, can reach it. Optional.
+	ExecID string `json:"exec_id,omitempty"`
+
 	UseShell bool     `json:"use_shell"`
 	Cmd      string   `json:"cmd,omitempty"`
 	Argv     []string `json:"argv,omitempty"`
 	Cwd      string   `json:"cwd,omitempty"`
 	Env      []string `json:"env,omitempty"` // "KEY=value"
 
+	// Identity to run as. User names a guest account and supplies uid, primary
+	// gid, supplementary groups and HOME; UID/GID set ids explicitly and take
+	// precedence. All empty => run as the agent (root).
+	User string  `json:"user,omitempty"`
+	UID  *uint32 `json:"uid,omitempty"`
+	GID  *uint32 `json:"gid,omitempty"`
+
+	// Stdin is written to the process before stdin is closed. With StdinStream
+	// (exec_stream only) stdin stays open after Stdin is written and is fed by
+	// "stdin" frames until one has EOF set.
+	Stdin       []byte `json:"stdin,omitempty"`
+	StdinStream bool   `json:"stdin_stream,omitempty"`
+
 	TimeoutMs      int64 `json:"timeout_ms,omitempty"`       // 0 => server default
 	MaxOutputBytes int64 `json:"max_output_bytes,omitempty"` // 0 => agent default
 }
 
 type ExecResponse struct {
-	ExitCode int    `json:"exit_code"`
+	ExitCode int    `json:"exit_code"` // 128+n if killed by signal n
 	Stdout   string `json:"stdout"`
 	Stderr   string `json:"stderr"`
 	TimedOut bool   `json:"timed_out"`
 }
 
+// ExecOutput is an incremental chunk of process output. "exec_stream" emits
+// these before the final frame, which carries an ExecResponse with empty
+// Stdout/Stderr.
+type ExecOutput struct {
+	Stream string `json:"stream"` // "stdout", "stderr", or "pty"
+	Data   []byte `json:"data"`
+}
+
+// PTYRequest starts an interactive session on a new pseudo-terminal. Output is
+// streamed as ExecOutput frames with Stream "pty"; the final frame carries the
+// session's exit status in an ExecResponse.
+type PTYRequest struct {
+	Argv []string `json:"argv,omitempty"` // default: login shell
+	Cwd  string   `json:"cwd,omitempty"`
+	Env  []string `json:"env,omitempty"`  // "KEY=value"
+	User string   `json:"user,omitempty"` // see ExecRequest
+	Term string   `json:"term,omitempty"` // default "xterm-256color"
+	Rows uint16   `json:"rows,omitempty"`
+	Cols uint16   `json:"cols,omitempty"`
+}
+
+// PTYInput carries terminal input for a running "pty" session. Non-zero Rows
+// and Cols resize the terminal.
+type PTYInput struct {
+	Data []byte `json:"data,omitempty"`
+	Rows uint16 `json:"rows,omitempty"`
+	Cols uint16 `json:"cols,omitempty"`
+}
+
+// SignalRequest delivers a signal to the process group of a running exec.
+// Signal accepts "SIGTERM", "TERM" or "15".
+type SignalRequest struct {
+	ExecID string `json:"exec_id"`
+	Signal string `json:"signal"`
+}
+
+// DataChunk is a piece of a byte stream, e.g. stdin for a running exec or the
+// content of a file being transferred. EOF marks the end of the stream and may
+// accompany data.
+type DataChunk struct {
+	Data []byte `json:"data,omitempty"`
+	EOF  bool   `json:"eof,omitempty"`
+}
+
+// ProcRequest addresses a background process started with "proc_start".
+// Background processes are owned by the agent, not by the connection that
+// started them, and have no timeout.
+type ProcRequest struct {
+	ID string `json:"id,omitempty"`
+
+	Signal string `json:"signal,omitempty"` // proc_signal: "SIGTERM", "TERM" or "15"
+
+	Offset   int64 `json:"offset,omitempty"`    // proc_logs: absolute output offset to read from
+	MaxBytes int64 `json:"max_bytes,omitempty"` // proc_logs: 0 => whole buffer
+
+	TimeoutMs int64 `json:"timeout_ms,omitempty"` // proc_wait: 0 => agent default
+}
+
+type ProcResponse struct {
+	Process   *ProcInfo  `json:"process,omitempty"`
+	Processes []ProcInfo `json:"processes,omitempty"`
+	Logs      *ProcLogs  `json:"logs,omitempty"`
+}
+
+type ProcInfo struct {
+	ID              string   `json:"id"`
+	PID             int      `json:"pid"`
+	Argv            []string `json:"argv"`
+	Running         bool     `json:"running"`
+	ExitCode        int      `json:"exit_code"`        // valid once Running is false
+	Signal          string   `json:"signal,omitempty"` // set if terminated by a signal
+	StartedAtUnixMs int64    `json:"started_at_unix_ms"`
+	ExitedAtUnixMs  int64    `json:"exited_at_unix_ms,omitempty"`
+}
+
+// ProcLogs is a window of a process's combined stdout/stderr. Offsets count
+// bytes since the process started; only the most recent output is retained,
+// so Truncated reports that the requested offset was already discarded and
+// Offset was advanced to the oldest retained byte.
+type ProcLogs struct {
+	Data       []byte `json:"data"`
+	Offset     int64  `json:"offset"`
+	NextOffset int64  `json:"next_offset"`
+	Truncated  bool   `json:"truncated,omitempty"`
+}
+
+// FileRequest names a guest file for "file_write" and "file_read".
+//
+// "file_write" is followed by "file_data" frames carrying the content, the
+// last with EOF set; the agent answers with a single frame carrying the
+// written file's FileInfo, possibly early if the write fails. "file_read" is
+// answered by a frame carrying FileInfo, then frames carrying Chunk data, the
+// final one with EOF set.
+type FileRequest struct {
+	Path string `json:"path"` // absolute guest path
+
+	// file_write only. Mode is the permission bits (e.g. 0644, plus
+	// setuid/setgid/sticky); nil keeps the mode of an existing file and
+	// otherwise uses 0644. Atomic writes to a temporary file in the same
+	// directory and renames it over Path once complete. Parents creates
+	// missing parent directories.
+	Mode    *uint32 `json:"mode,omitempty"`
+	Atomic  bool    `json:"atomic,omitempty"`
+	Parents bool    `json:"parents,omitempty"`
+}
+
+// FileInfo describes a guest filesystem entry. Symlinks are described
+// themselves, not their targets.
+type FileInfo struct {
+	Path          string `json:"path"`
+	Name          string `json:"name,omitempty"` // base name of Path
+	Type          string `json:"type,omitempty"` // one of the FileType* constants
+	Size          int64  `json:"size"`
+	Mode          uint32 `json:"mode"` // permission bits
+	ModTimeUnixMs int64  `json:"mod_time_unix_ms"`
+	LinkTarget    string `json:"link_target,omitempty"` // symlinks only
+}
+
+// FileInfo.Type values.
+const (
+	FileTypeFile    = "file"
+	FileTypeDir     = "dir"
+	FileTypeSymlink = "symlink"
+	FileTypeFIFO    = "fifo"
+	FileTypeSocket  = "socket"
+	FileTypeDevice  = "device"
+	FileTypeOther   = "other"
+)
+
+// FSRequest is the payload of the filesystem metadata requests, which answer
+// with a single frame:
+//
+//   - "fs_list" lists the directory Path, sorted by name, in FSResponse.
+//   - "fs_stat" describes Path in Response.File.
+//   - "fs_mkdir" creates the directory Path (and missing parents if Parents,
+//     in which case an existing directory is not an error) and describes it.
+//   - "fs_remove" removes Path; a non-empty directory only if Recursive.
+//   - "fs_rename" moves Path to NewPath and describes the result. An existing
+//     NewPath is replaced only if Overwrite.
+type FSRequest struct {
+	Path    string `json:"path"` // absolute guest path
+	NewPath string `json:"new_path,omitempty"`
+
+	Mode      *uint32 `json:"mode,omitempty"` // fs_mkdir: permission bits; nil => 0755
+	Parents   bool    `json:"parents,omitempty"`
+	Recursive bool    `json:"recursive,omitempty"`
+	Overwrite bool    `json:"overwrite,omitempty"`
+
+	// fs_list: maximum number of entries; 0 or more than the agent's limit
+	// means the agent's limit.
+	Limit int `json:"limit,omitempty"`
+}
+
+type FSResponse struct {
+	Entries []FileInfo `json:"entries"`
+	// Truncated reports that the directory has more entries than Limit.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// WatchRequest starts a "watch" stream of changes under Path. The agent
+// answers with an empty frame once the watch is in place, then frames
+// carrying Events as changes happen. The stream runs until it is cancelled,
+// or ends on its own after reporting the deletion of Path itself.
+type WatchRequest struct {
+	Path      string `json:"path"` // absolute guest path; a file or directory
+	Recursive bool   `json:"recursive,omitempty"`
+}
+
+// FSEvent.Type values. FSEventOverflow means events were dropped and the
+// watcher should rescan.
+const (
+	FSEventCreate   = "create"
+	FSEventModify   = "modify"
+	FSEventDelete   = "delete"
+	FSEventRename   = "rename"
+	FSEventOverflow = "overflow"
+)
+
+type FSEvent struct {
+	Type       string `json:"type"`
+	Path       string `json:"path,omitempty"`
+	OldPath    string `json:"old_path,omitempty"` // rename only
+	IsDir      bool   `json:"is_dir,omitempty"`
+	TimeUnixMs int64  `json:"time_unix_ms"`
+}
+
+// ArchiveRequest names a guest directory for "archive_import" and
+// "archive_export".
+//
+// "archive_import" is followed by "file_data" frames carrying a tar stream,
+// which the agent extracts under Path (creating it if needed); entries can't
+// escape Path via ".." names or symlinks. The agent answers with a single
+// frame carrying an ArchiveResponse, possibly early if extraction fails.
+// "archive_export" is answered like "file_read": a frame with Path's
+// FileInfo, then Chunk frames carrying a tar of Path's contents.
+type ArchiveRequest struct {
+	Path string `json:"path"` // absolute guest path
+
+	// "none", "gzip" or "zstd". Empty means "none" for export and detect from
+	// the stream for import.
+	Compression string `json:"compression,omitempty"`
+}
+
+type ArchiveResponse struct {
+	Entries int   `json:"entries"` // entries extracted
+	Skipped int   `json:"skipped"` // unsupported entries (devices, fifos, ...)
+	Bytes   int64 `json:"bytes"`   // regular file content written
+}
+
 type NetRequest struct {
 	Interface string `json:"interface,omitempty"` // default "eth0"
 	Address   string `json:"address"`             // e.g. "172.16.5.2/30"